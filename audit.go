@@ -0,0 +1,209 @@
+package magnet
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Audit actions.
+const (
+	AuditAdd    = "add"
+	AuditRemove = "remove"
+)
+
+// Audit results.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+
+	// AuditPending means that the IaaS made the change, but an
+	// operator must act before the rule is satisfied.
+	AuditPending = "pending"
+)
+
+// AuditEntry records a single rule change made by Converge.
+type AuditEntry struct {
+	Time           time.Time `json:"time"`
+	User           string    `json:"user"`
+	Cluster        string    `json:"cluster"`
+	Action         string    `json:"action"`
+	Rule           string    `json:"rule"`
+	Key            int32     `json:"key,omitempty"`
+	VMsBefore      []string  `json:"vms_before"`
+	VMsAfter       []string  `json:"vms_after"`
+	UnbalancedJobs []string  `json:"unbalanced_jobs"`
+	Task           string    `json:"task"`
+	Result         string    `json:"result"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// Auditor records the changes made to a deployment.
+type Auditor interface {
+	Record(entries ...AuditEntry) error
+}
+
+// AuditEntries describes each rule change in rec, made by user.  When a
+// stale rule is replaced by a missing rule of the same name, both entries
+// record the member VMs before and after the replacement.
+func AuditEntries(user string, state *State, rec *RuleRecommendation) []AuditEntry {
+	before := make(map[string][]string)
+	for _, r := range rec.Stale {
+		before[r.Name] = sortedVMNames(r.VMs)
+	}
+	after := make(map[string][]string)
+	for _, r := range rec.Missing {
+		after[r.Name] = sortedVMNames(r.VMs)
+	}
+
+	unbalanced := UnbalancedJobs(state)
+	newEntry := func(action string, r *Rule) AuditEntry {
+		e := AuditEntry{
+			User:           user,
+			Cluster:        state.RuleContainer,
+			Action:         action,
+			Rule:           r.Name,
+			Key:            r.Key,
+			VMsBefore:      before[r.Name],
+			VMsAfter:       after[r.Name],
+			UnbalancedJobs: unbalanced,
+		}
+		if e.VMsBefore == nil {
+			e.VMsBefore = []string{}
+		}
+		if e.VMsAfter == nil {
+			e.VMsAfter = []string{}
+		}
+		return e
+	}
+
+	var entries []AuditEntry
+	for j := range rec.Stale {
+		entries = append(entries, newEntry(AuditRemove, &rec.Stale[j]))
+	}
+	for j := range rec.Missing {
+		entries = append(entries, newEntry(AuditAdd, &rec.Missing[j]))
+	}
+	return entries
+}
+
+// RecordAudit records entries with a, as the outcome of task, which
+// failed with convergeErr if it is non-nil, or awaits an operator if
+// convergeErr is a PendingError.  It does nothing if a is nil.
+func RecordAudit(a Auditor, entries []AuditEntry, task string, convergeErr error) error {
+	if a == nil || len(entries) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	for j := range entries {
+		entries[j].Time = now
+		entries[j].Task = task
+		entries[j].Result = AuditSuccess
+		if _, ok := convergeErr.(PendingError); ok {
+			entries[j].Result = AuditPending
+			entries[j].Error = convergeErr.Error()
+		} else if convergeErr != nil {
+			entries[j].Result = AuditFailure
+			entries[j].Error = convergeErr.Error()
+		}
+	}
+	return a.Record(entries...)
+}
+
+func sortedVMNames(vms []*VM) []string {
+	names := make([]string, 0, len(vms))
+	for _, vm := range vms {
+		if vm == nil {
+			continue
+		}
+		names = append(names, vm.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AuditLog is an Auditor that appends entries to a local file,
+// one JSON object per line.  Existing entries are never modified.
+type AuditLog struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Record appends entries to the audit log, creating it if necessary.
+func (a *AuditLog) Record(entries ...AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for i := range entries {
+		if err = enc.Encode(&entries[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// AuditQuery selects entries from an audit log.
+// Zero-valued fields match every entry.
+type AuditQuery struct {
+	Since   time.Time
+	Cluster string
+	Rule    string
+	User    string
+}
+
+func (q *AuditQuery) matches(e *AuditEntry) bool {
+	switch {
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case q.Cluster != "" && q.Cluster != e.Cluster:
+		return false
+	case q.Rule != "" && q.Rule != e.Rule:
+		return false
+	case q.User != "" && q.User != e.User:
+		return false
+	}
+	return true
+}
+
+// Entries returns the entries in the audit log that match q, oldest first.
+// A missing audit log has no entries.
+func (a *AuditLog) Entries(q AuditQuery) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.Open(a.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []AuditEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		if q.matches(&e) {
+			result = append(result, e)
+		}
+	}
+	return result, s.Err()
+}
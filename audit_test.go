@@ -0,0 +1,104 @@
+package magnet_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AuditLog", func() {
+	var (
+		dir string
+		a   *magnet.AuditLog
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "magnet-audit")
+		Ω(err).ShouldNot(HaveOccurred())
+		a = &magnet.AuditLog{Path: filepath.Join(dir, "audit.log")}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("has no entries before anything is recorded", func() {
+		entries, err := a.Entries(magnet.AuditQuery{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(BeEmpty())
+	})
+
+	It("appends entries across calls", func() {
+		old := magnet.AuditEntry{
+			Time:    time.Now().Add(-48 * time.Hour).UTC(),
+			User:    "administrator",
+			Cluster: "ClusterComputeResource:domain-c7",
+			Action:  magnet.AuditRemove,
+			Rule:    "router",
+			Key:     3,
+			Result:  magnet.AuditSuccess,
+		}
+		recent := magnet.AuditEntry{
+			Time:      time.Now().UTC(),
+			User:      "administrator",
+			Cluster:   "ClusterComputeResource:domain-c7",
+			Action:    magnet.AuditAdd,
+			Rule:      "diego_cell",
+			VMsBefore: []string{},
+			VMsAfter:  []string{"cell-1", "cell-2"},
+			Task:      "task-42",
+			Result:    magnet.AuditSuccess,
+		}
+		Ω(a.Record(old)).Should(Succeed())
+		Ω(a.Record(recent)).Should(Succeed())
+
+		entries, err := a.Entries(magnet.AuditQuery{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(HaveLen(2))
+		Ω(entries[0].Rule).Should(Equal("router"))
+		Ω(entries[1].VMsAfter).Should(Equal([]string{"cell-1", "cell-2"}))
+		Ω(entries[1].Task).Should(Equal("task-42"))
+
+		entries, err = a.Entries(magnet.AuditQuery{Since: time.Now().Add(-time.Hour)})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(HaveLen(1))
+		Ω(entries[0].Rule).Should(Equal("diego_cell"))
+
+		entries, err = a.Entries(magnet.AuditQuery{Rule: "router"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(HaveLen(1))
+		Ω(entries[0].Key).Should(BeEquivalentTo(3))
+	})
+
+	It("records the rule changes of a recommendation and their outcome", func() {
+		state := &magnet.State{RuleContainer: "project:p-1"}
+		router := magnet.Rule{Name: "router", VMs: []*magnet.VM{{Name: "router-2"}, {Name: "router-1"}}}
+		rec := &magnet.RuleRecommendation{
+			Stale:   []magnet.Rule{router, {Name: "old"}},
+			Missing: []magnet.Rule{{Name: "router", VMs: []*magnet.VM{{Name: "router-1"}}}},
+		}
+		entries := magnet.AuditEntries("magnet", state, rec)
+		Ω(magnet.RecordAudit(a, entries, "", errors.New("quota exceeded"))).Should(Succeed())
+
+		entries, err := a.Entries(magnet.AuditQuery{User: "magnet"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(HaveLen(3))
+		Ω(entries[0].Action).Should(Equal(magnet.AuditRemove))
+		Ω(entries[0].VMsBefore).Should(Equal([]string{"router-1", "router-2"}))
+		Ω(entries[0].VMsAfter).Should(Equal([]string{"router-1"}))
+		Ω(entries[1].Rule).Should(Equal("old"))
+		Ω(entries[1].VMsAfter).Should(BeEmpty())
+		Ω(entries[2].Action).Should(Equal(magnet.AuditAdd))
+		Ω(entries[2].Cluster).Should(Equal("project:p-1"))
+		Ω(entries[2].Result).Should(Equal(magnet.AuditFailure))
+		Ω(entries[2].Error).Should(Equal("quota exceeded"))
+
+		Ω(magnet.RecordAudit(nil, entries, "", nil)).Should(Succeed())
+	})
+})
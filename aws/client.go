@@ -0,0 +1,306 @@
+package aws
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// apiVersion is the version of the EC2 Query API magnet speaks.
+const apiVersion = "2016-11-15"
+
+// apiError is an error returned by the EC2 API.
+type apiError struct {
+	Action  string `xml:"-"`
+	Code    string `xml:"Errors>Error>Code"`
+	Message string `xml:"Errors>Error>Message"`
+	status  string
+}
+
+func (e *apiError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("aws: %s: %s", e.Action, e.status)
+	}
+	return fmt.Sprintf("aws: %s: %s: %s", e.Action, e.Code, e.Message)
+}
+
+// call sends an EC2 Query API request, signed with Signature Version 4,
+// and decodes the response into v if it is non-nil.
+func (i *IaaS) call(ctx context.Context, action string, params url.Values, v interface{}) error {
+	form := url.Values{"Action": {action}, "Version": {apiVersion}}
+	for k, vs := range params {
+		form[k] = vs
+	}
+	body := form.Encode()
+	req, err := http.NewRequest(http.MethodPost, i.config.Endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	i.sign(req, body, time.Now().UTC())
+
+	resp, err := i.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("aws: %v", magnet.Redact(err.Error(), i.config.SecretAccessKey, i.config.SessionToken))
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("aws: %s: %v", action, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &apiError{Action: action, status: resp.Status}
+		xml.Unmarshal(b, e)
+		return e
+	}
+	if v == nil {
+		return nil
+	}
+	if err = xml.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("aws: %s: %v", action, err)
+	}
+	return nil
+}
+
+// sign adds the Signature Version 4 headers to req, whose body is body.
+func (i *IaaS) sign(req *http.Request, body string, t time.Time) {
+	c := i.config
+	amzDate := t.Format("20060102T150405Z")
+	scope := strings.Join([]string{t.Format("20060102"), c.Region, "ec2", "aws4_request"}, "/")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", string(c.SessionToken))
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical []string
+	for _, k := range names {
+		canonical = append(canonical, k+":"+headers[k]+"\n")
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	request := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		strings.Join(canonical, ""),
+		signed,
+		hashHex(body),
+	}, "\n")
+
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hashHex(request)}, "\n")
+	key := []byte("AWS4" + string(c.SecretAccessKey))
+	for _, part := range []string{t.Format("20060102"), c.Region, "ec2", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hashHex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// tag is a key and value of an EC2 resource's tags.
+type tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+// instance is an EC2 instance.
+type instance struct {
+	ID    string `xml:"instanceId"`
+	State string `xml:"instanceState>name"`
+	VPC   string `xml:"vpcId"`
+	// the instance's placement
+	AZ    string `xml:"placement>availabilityZone"`
+	Group string `xml:"placement>groupName"`
+	Host  string `xml:"placement>hostId"` // the Dedicated Host, if any
+	Tags  []tag  `xml:"tagSet>item"`
+}
+
+// tag returns the value of the instance's tag with key.
+func (in *instance) tag(key string) string {
+	for _, t := range in.Tags {
+		if t.Key == key {
+			return t.Value
+		}
+	}
+	return ""
+}
+
+// instances lists the instances that haven't been terminated, and
+// are in vpc if it is set.
+func (i *IaaS) instances(ctx context.Context, vpc string) ([]instance, error) {
+	params := url.Values{
+		"Filter.1.Name":    {"instance-state-name"},
+		"Filter.1.Value.1": {"pending"},
+		"Filter.1.Value.2": {"running"},
+		"Filter.1.Value.3": {"stopping"},
+		"Filter.1.Value.4": {"stopped"},
+	}
+	if vpc != "" {
+		params.Set("Filter.2.Name", "vpc-id")
+		params.Set("Filter.2.Value.1", vpc)
+	}
+	var all []instance
+	for {
+		var resp struct {
+			Reservations []struct {
+				Instances []instance `xml:"instancesSet>item"`
+			} `xml:"reservationSet>item"`
+			NextToken string `xml:"nextToken"`
+		}
+		if err := i.call(ctx, "DescribeInstances", params, &resp); err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Reservations {
+			all = append(all, r.Instances...)
+		}
+		if resp.NextToken == "" {
+			return all, nil
+		}
+		params.Set("NextToken", resp.NextToken)
+	}
+}
+
+// zones lists the names of the region's available availability zones.
+func (i *IaaS) zones(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Zones []struct {
+			Name  string `xml:"zoneName"`
+			State string `xml:"zoneState"`
+		} `xml:"availabilityZoneInfo>item"`
+	}
+	if err := i.call(ctx, "DescribeAvailabilityZones", nil, &resp); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, z := range resp.Zones {
+		if z.State == "available" {
+			names = append(names, z.Name)
+		}
+	}
+	return names, nil
+}
+
+// dedicatedHost is an EC2 Dedicated Host.
+type dedicatedHost struct {
+	ID    string `xml:"hostId"`
+	AZ    string `xml:"availabilityZone"`
+	State string `xml:"state"`
+}
+
+// dedicatedHosts lists the account's available Dedicated Hosts.
+func (i *IaaS) dedicatedHosts(ctx context.Context) ([]dedicatedHost, error) {
+	var resp struct {
+		Hosts []dedicatedHost `xml:"hostSet>item"`
+	}
+	if err := i.call(ctx, "DescribeHosts", nil, &resp); err != nil {
+		return nil, err
+	}
+	var hosts []dedicatedHost
+	for _, h := range resp.Hosts {
+		if h.State == "available" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, nil
+}
+
+// placementGroup is an EC2 placement group.
+type placementGroup struct {
+	Name     string `xml:"groupName"`
+	ID       string `xml:"groupId"`
+	Strategy string `xml:"strategy"`
+	State    string `xml:"state"`
+	Tags     []tag  `xml:"tagSet>item"`
+}
+
+// strength returns the rule strength magnet tagged the group with.
+func (g *placementGroup) strength() string {
+	for _, t := range g.Tags {
+		if t.Key == strengthTag {
+			return t.Value
+		}
+	}
+	return ""
+}
+
+// spreadGroups lists the available spread placement groups.
+func (i *IaaS) spreadGroups(ctx context.Context) ([]placementGroup, error) {
+	params := url.Values{"Filter.1.Name": {"strategy"}, "Filter.1.Value.1": {"spread"}}
+	var resp struct {
+		Groups []placementGroup `xml:"placementGroupSet>item"`
+	}
+	if err := i.call(ctx, "DescribePlacementGroups", params, &resp); err != nil {
+		return nil, err
+	}
+	var groups []placementGroup
+	for _, g := range resp.Groups {
+		if g.Strategy == "spread" && g.State == "available" {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// createSpreadGroup creates a spread placement group, tagged with the
+// strength of its rule.
+func (i *IaaS) createSpreadGroup(ctx context.Context, name, strength string) error {
+	return i.call(ctx, "CreatePlacementGroup", url.Values{
+		"GroupName":                       {name},
+		"Strategy":                        {"spread"},
+		"TagSpecification.1.ResourceType": {"placement-group"},
+		"TagSpecification.1.Tag.1.Key":    {strengthTag},
+		"TagSpecification.1.Tag.1.Value":  {strength},
+	}, nil)
+}
+
+// tagStrength changes the strength a placement group is tagged with.
+func (i *IaaS) tagStrength(ctx context.Context, id, strength string) error {
+	return i.call(ctx, "CreateTags", url.Values{
+		"ResourceId.1": {id},
+		"Tag.1.Key":    {strengthTag},
+		"Tag.1.Value":  {strength},
+	}, nil)
+}
+
+func (i *IaaS) deletePlacementGroup(ctx context.Context, name string) error {
+	return i.call(ctx, "DeletePlacementGroup", url.Values{"GroupName": {name}}, nil)
+}
+
+// movePlacement moves a stopped instance into a placement group, or
+// out of its group if group is empty.
+func (i *IaaS) movePlacement(ctx context.Context, id, group string) error {
+	return i.call(ctx, "ModifyInstancePlacement", url.Values{"InstanceId": {id}, "GroupName": {group}}, nil)
+}
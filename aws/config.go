@@ -0,0 +1,105 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// DefaultGroupPrefix is the prefix of the placement groups magnet
+// manages when the config sets none.
+const DefaultGroupPrefix = "magnet-"
+
+// Config describes an AWS region and the BOSH deployments in it that
+// magnet manages.
+type Config struct {
+	Region          string        `yaml:"region"`
+	AccessKeyID     string        `yaml:"access-key-id"`
+	SecretAccessKey magnet.Secret `yaml:"secret-access-key"`
+	SessionToken    magnet.Secret `yaml:"session-token"` // optional, for temporary credentials
+	Endpoint        string        `yaml:"endpoint"`      // default https://ec2.<region>.amazonaws.com
+	VPC             string        `yaml:"vpc"`           // optional, only manage the instances in this VPC
+	GroupPrefix     string        `yaml:"group-prefix"`  // default DefaultGroupPrefix
+	Deployments     []string      `yaml:"deployments"`   // every deployment if empty
+}
+
+// ApplyEnv overrides c with the AWS_REGION (or AWS_DEFAULT_REGION),
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and
+// AWS_ENDPOINT_URL environment variables that are set, as the AWS CLI
+// reads them.
+func (c *Config) ApplyEnv() {
+	if v, ok := os.LookupEnv("AWS_DEFAULT_REGION"); ok {
+		c.Region = v
+	}
+	for name, field := range map[string]*string{
+		"AWS_REGION":            &c.Region,
+		"AWS_ACCESS_KEY_ID":     &c.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY": (*string)(&c.SecretAccessKey),
+		"AWS_SESSION_TOKEN":     (*string)(&c.SessionToken),
+		"AWS_ENDPOINT_URL":      &c.Endpoint,
+	} {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+}
+
+// groupName matches the characters AWS allows in placement group names.
+var groupName = regexp.MustCompile(`^[\x20-\x7e]*$`)
+
+// Validate returns every problem with c.
+func (c Config) Validate() []error {
+	var errs []error
+	for _, required := range []struct{ name, value string }{
+		{"region", c.Region},
+		{"access-key-id", c.AccessKeyID},
+		{"secret-access-key", string(c.SecretAccessKey)},
+	} {
+		if required.value == "" {
+			errs = append(errs, errors.New(required.name+" is required"))
+		}
+	}
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid endpoint %q", c.Endpoint))
+		}
+	}
+	if !groupName.MatchString(c.GroupPrefix) {
+		errs = append(errs, fmt.Errorf("invalid group-prefix %q", c.GroupPrefix))
+	}
+	return errs
+}
+
+// Unverified reports whether magnet connects to EC2 without verifying
+// its identity, because the endpoint is http.
+func (c Config) Unverified() bool {
+	u, err := url.Parse(c.Endpoint)
+	return err == nil && u.Scheme == "http"
+}
+
+// setDefaults fills in the optional settings that aren't set.
+func (c *Config) setDefaults() {
+	if c.Endpoint == "" {
+		c.Endpoint = "https://ec2." + c.Region + ".amazonaws.com"
+	}
+	if c.GroupPrefix == "" {
+		c.GroupPrefix = DefaultGroupPrefix
+	}
+}
+
+// managed reports whether magnet manages the instances of deployment.
+func (c *Config) managed(deployment string) bool {
+	if len(c.Deployments) == 0 {
+		return true
+	}
+	for _, d := range c.Deployments {
+		if d == deployment {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,404 @@
+// Package aws implements magnet.IaaS for Cloud Foundry deployments on
+// AWS, treating availability zones as hosts and using spread placement
+// groups as rules.
+package aws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// strengthTag is the tag that records the strength of a placement
+// group's rule, since spread placement groups have only one.
+const strengthTag = "magnet:strength"
+
+// IaaS is the EC2 instances of an AWS region.  Each availability zone
+// is a host, as is each Dedicated Host if any managed instance runs on
+// one, and each spread placement group whose name starts with the
+// configured prefix is a rule, unless all of its instances belong to
+// deployments that magnet doesn't manage.
+//
+// EC2 only moves an instance between placement groups while it is
+// stopped.  Converge moves the stopped instances itself, and returns an
+// *ActionsError listing the running ones that an operator must stop
+// and move (or recreate in the group, for example with a BOSH VM
+// extension that sets the placement group), which Check reports as
+// pending actions rather than a failure.
+//
+// Unlike vsphere.IaaS, it doesn't back up the rules before changing them.
+type IaaS struct {
+	// Instances, if non-nil, identifies the job, index and deployment
+	// of each instance, which is joined to its BOSH instance by ID (the
+	// VM CID).  Instances it doesn't describe are identified by their
+	// BOSH tags, as are all instances if it fails.  The AZ of a VM is
+	// always its availability zone, rather than the BOSH AZ.
+	Instances magnet.InstanceSource
+
+	// Auditor, if non-nil, records every placement group change made by
+	// Converge, as the access key ID.
+	Auditor magnet.Auditor
+
+	config *Config
+	client *http.Client
+	log    magnet.Logger
+}
+
+// New creates an IaaS configured by the environment variables of the
+// AWS CLI:
+//   - AWS_REGION or AWS_DEFAULT_REGION  (required)
+//   - AWS_ACCESS_KEY_ID                 (required)
+//   - AWS_SECRET_ACCESS_KEY             (required)
+//   - AWS_SESSION_TOKEN                 (default "")
+//   - AWS_ENDPOINT_URL                  (default https://ec2.<region>.amazonaws.com)
+//
+// If l is nil, nothing is logged.
+func New(l magnet.Logger) (*IaaS, error) {
+	var config Config
+	config.ApplyEnv()
+	return NewFromConfig(config, l)
+}
+
+// NewFromConfig creates an IaaS for the region described by config.
+// If l is nil, nothing is logged.
+func NewFromConfig(config Config, l magnet.Logger) (*IaaS, error) {
+	if l == nil {
+		l = magnet.NopLogger()
+	}
+	if errs := config.Validate(); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return nil, fmt.Errorf("aws: %s", strings.Join(msgs, "; "))
+	}
+	config.setDefaults()
+	i := &IaaS{
+		config: &config,
+		client: &http.Client{Timeout: time.Minute},
+		log:    l.With("region", config.Region),
+	}
+	if config.Unverified() {
+		i.log.Warn("the identity of the EC2 endpoint will not be verified")
+	}
+	return i, nil
+}
+
+// RegionName is the name of the region that magnet manages.
+func (i *IaaS) RegionName() string {
+	return i.config.Region
+}
+
+// Unverified reports whether the IaaS connects to EC2 without
+// verifying its identity.
+func (i *IaaS) Unverified() bool {
+	return i.config.Unverified()
+}
+
+// State lists the region's instances, availability zones and spread
+// placement groups.
+func (i *IaaS) State(ctx context.Context) (*magnet.State, error) {
+	instances, err := i.instances(ctx, i.config.VPC)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := i.zones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := i.spreadGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state := i.toState(ctx, instances, zones, groups)
+
+	dedicated := false
+	for _, vm := range state.VMs {
+		dedicated = dedicated || vm.HostUUID != vm.AZ
+	}
+	if !dedicated {
+		return state, nil
+	}
+	hosts, err := i.dedicatedHosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		state.Hosts = append(state.Hosts, &magnet.Host{ID: h.ID, Name: h.ID, Attributes: map[string]string{"availability-zone": h.AZ}})
+	}
+	return state, nil
+}
+
+func (i *IaaS) toState(ctx context.Context, instances []instance, zones []string, groups []placementGroup) *magnet.State {
+	state := &magnet.State{
+		RuleContainer: "region:" + i.config.Region,
+		VMContainer:   "region:" + i.config.Region,
+	}
+	if i.config.VPC != "" {
+		state.VMContainer = "vpc:" + i.config.VPC
+	}
+	for _, z := range zones {
+		state.Hosts = append(state.Hosts, &magnet.Host{ID: z, Name: z})
+	}
+	bosh := i.boshInstances(ctx)
+
+	byGroup := make(map[string][]*magnet.VM)
+	unmanaged := make(map[string]int) // by group
+	for j := range instances {
+		in := &instances[j]
+		v := &magnet.VM{
+			Name:       in.tag("Name"),
+			ID:         in.ID,
+			Reference:  in.ID,
+			HostUUID:   in.AZ,
+			HostName:   in.AZ,
+			Job:        in.tag("job"),
+			Index:      in.tag("index"),
+			Deployment: in.tag("deployment"),
+			AZ:         in.AZ,
+		}
+		if v.Name == "" {
+			v.Name = in.ID
+		}
+		if v.Job == "" {
+			v.Job = in.tag("instance_group")
+		}
+		if in.Host != "" {
+			v.HostUUID, v.HostName = in.Host, in.Host
+		}
+		if b, ok := bosh[in.ID]; ok {
+			v.Job, v.Index, v.Deployment = b.Job, b.Index, b.Deployment
+		}
+		if v.Job == "" || !i.config.managed(v.Deployment) {
+			unmanaged[in.Group]++
+			continue
+		}
+		state.VMs = append(state.VMs, v)
+		byGroup[in.Group] = append(byGroup[in.Group], v)
+	}
+
+	for _, g := range groups {
+		if !strings.HasPrefix(g.Name, i.config.GroupPrefix) {
+			continue
+		}
+		// the group of deployments that magnet doesn't manage
+		if len(byGroup[g.Name]) == 0 && unmanaged[g.Name] > 0 {
+			continue
+		}
+		r := &magnet.Rule{
+			Name:      strings.TrimPrefix(g.Name, i.config.GroupPrefix),
+			ID:        g.ID,
+			Enabled:   true,
+			Mandatory: g.strength() == magnet.RuleMandatory,
+			VMs:       byGroup[g.Name],
+		}
+		if r.VMs == nil {
+			r.VMs = []*magnet.VM{}
+		}
+		state.Rules = append(state.Rules, r)
+	}
+	return state
+}
+
+// boshInstances returns the instances that i.Instances describes, by
+// CID.
+func (i *IaaS) boshInstances(ctx context.Context) map[string]magnet.Instance {
+	byCID, err := magnet.InstancesByCID(ctx, i.Instances)
+	if err != nil {
+		i.log.Warn("failed to list BOSH instances, using instance tags", "err", err)
+	}
+	return byCID
+}
+
+// strength returns the strength to tag r's placement group with.
+func strength(r *magnet.Rule) string {
+	if r.Mandatory {
+		return magnet.RuleMandatory
+	}
+	return magnet.RulePreferred
+}
+
+// Action is a move between placement groups that Converge can't make
+// because the instance is running.
+type Action struct {
+	Instance string // the instance's ID
+	Name     string // the instance's Name tag, or its ID
+	// Group is the placement group to move the instance into, or
+	// empty to take it out of its group.
+	Group string
+}
+
+// ActionsError is the error returned by Converge when running
+// instances must be stopped and moved before the rules are satisfied.
+// It is a magnet.PendingError, so Check doesn't treat it as a failure.
+type ActionsError struct {
+	Actions []Action
+}
+
+// Pending describes each action, such as "stop i-4 (nats/1) and move it
+// to magnet-nats".
+func (e *ActionsError) Pending() []string {
+	pending := make([]string, len(e.Actions))
+	for j, a := range e.Actions {
+		group := a.Group
+		if group == "" {
+			group = "no group"
+		}
+		pending[j] = fmt.Sprintf("stop %s (%s) and move it to %s", a.Instance, a.Name, group)
+	}
+	return pending
+}
+
+func (e *ActionsError) Error() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "aws: %d instances must be stopped to change their placement groups:", len(e.Actions))
+	for j, a := range e.Actions {
+		if j > 0 {
+			buf.WriteString(",")
+		}
+		group := a.Group
+		if group == "" {
+			group = "no group"
+		}
+		fmt.Fprintf(buf, " %s (%s) to %s", a.Instance, a.Name, group)
+	}
+	return buf.String()
+}
+
+// Converge creates the placement groups of the missing rules and moves
+// their stopped instances into them, and moves the stopped instances
+// out of the groups of the stale rules, deleting the groups once they
+// are empty.  A stale rule that is replaced by a missing rule with the
+// same name keeps its group.  If running instances must then be moved,
+// it returns an *ActionsError.  If i has an Auditor, Converge records the
+// group changes and their outcome.
+func (i *IaaS) Converge(ctx context.Context, state *magnet.State, rec *magnet.RuleRecommendation) error {
+	var entries []magnet.AuditEntry
+	if i.Auditor != nil {
+		entries = magnet.AuditEntries(i.config.AccessKeyID, state, rec)
+	}
+	err := i.converge(ctx, state, rec)
+	if auditErr := magnet.RecordAudit(i.Auditor, entries, "", err); auditErr != nil {
+		i.log.With("cluster", state.RuleContainer).Error("failed to write audit log", "err", auditErr)
+		if err == nil {
+			return fmt.Errorf("aws: failed to write audit log: %v", auditErr)
+		}
+	}
+	return err
+}
+
+// converge makes the changes that Converge records.
+func (i *IaaS) converge(ctx context.Context, state *magnet.State, rec *magnet.RuleRecommendation) error {
+	log := i.log.With("cluster", state.RuleContainer)
+	// placements change while instances stop and start, so re-read them
+	instances, err := i.instances(ctx, i.config.VPC)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]*instance, len(instances))
+	for j := range instances {
+		current[instances[j].ID] = &instances[j]
+	}
+
+	stale := make(map[string]*magnet.Rule)
+	for j := range rec.Stale {
+		stale[rec.Stale[j].Name] = &rec.Stale[j]
+	}
+	// the placement group each instance should be in, by ID
+	wanted := make(map[string]string)
+	kept := make(map[string]bool)
+	for j := range rec.Missing {
+		r := &rec.Missing[j]
+		if r.Affinity || r.Hosts != nil {
+			log.Warn("only anti-affinity rules are supported on AWS", "rule", r.Name)
+			continue
+		}
+		name := i.config.GroupPrefix + r.Name
+		if old, ok := stale[r.Name]; ok {
+			kept[r.Name] = true
+			if old.Mandatory != r.Mandatory {
+				if err = i.tagStrength(ctx, old.ID, strength(r)); err != nil {
+					log.Error("failed to tag placement group", "rule", r.Name, "group", name, "err", err)
+					return err
+				}
+			}
+		} else {
+			if err = i.createSpreadGroup(ctx, name, strength(r)); err != nil {
+				log.Error("failed to create placement group", "rule", r.Name, "group", name, "err", err)
+				return err
+			}
+			log.Info("created placement group", "rule", r.Name, "group", name)
+		}
+		for _, vm := range r.VMs {
+			wanted[vm.ID] = name
+		}
+	}
+
+	var actions []Action
+	move := func(vm *magnet.VM, group string) error {
+		in, ok := current[vm.ID]
+		if !ok || in.Group == group {
+			return nil
+		}
+		if in.State != "stopped" {
+			actions = append(actions, Action{Instance: vm.ID, Name: vm.Name, Group: group})
+			return nil
+		}
+		if err := i.movePlacement(ctx, vm.ID, group); err != nil {
+			log.Error("failed to move instance", "instance", vm.ID, "group", group, "err", err)
+			return err
+		}
+		log.Info("moved instance", "instance", vm.ID, "from", in.Group, "group", group)
+		in.Group = group
+		return nil
+	}
+	for j := range rec.Missing {
+		for _, vm := range rec.Missing[j].VMs {
+			if group, ok := wanted[vm.ID]; ok {
+				if err = move(vm, group); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, r := range rec.Stale {
+		name := i.config.GroupPrefix + r.Name
+		for _, vm := range r.VMs {
+			if _, ok := wanted[vm.ID]; !ok {
+				if err = move(vm, ""); err != nil {
+					return err
+				}
+			}
+		}
+		// including the instances magnet doesn't manage
+		empty := true
+		for _, in := range current {
+			empty = empty && in.Group != name
+		}
+		if kept[r.Name] {
+			continue
+		}
+		if !empty {
+			log.Warn("placement group still has instances, so not deleting it", "rule", r.Name, "group", name)
+			continue
+		}
+		if err = i.deletePlacementGroup(ctx, name); err != nil {
+			log.Error("failed to delete placement group", "rule", r.Name, "group", name, "err", err)
+			return err
+		}
+		log.Info("deleted placement group", "rule", r.Name, "group", name)
+	}
+
+	if len(actions) == 0 {
+		return nil
+	}
+	for _, a := range actions {
+		log.Warn("instance must be stopped to move it", "instance", a.Instance, "name", a.Name, "group", a.Group)
+	}
+	return &ActionsError{Actions: actions}
+}
@@ -0,0 +1,301 @@
+package aws_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/aws"
+	"github.com/pivotalservices/magnet/mock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeInstance struct {
+	id, state, az, group, host string
+	tags                       map[string]string
+}
+
+type fakeGroup struct {
+	name, id, strategy, strength string
+}
+
+// fakeEC2 serves the parts of the EC2 Query API that magnet uses.
+type fakeEC2 struct {
+	*httptest.Server
+	instances []*fakeInstance
+	groups    []*fakeGroup
+	calls     []string // the changes made, such as "move i-3 magnet-nats"
+}
+
+var authorization = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=AKID/\d{8}/us-east-1/ec2/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=[0-9a-f]{64}$`)
+
+func newFakeEC2() *fakeEC2 {
+	bosh := func(job, index, deployment string) map[string]string {
+		return map[string]string{"Name": job + "/" + index, "job": job, "index": index, "deployment": deployment}
+	}
+	f := &fakeEC2{
+		instances: []*fakeInstance{
+			{id: "i-1", state: "running", az: "us-east-1a", group: "magnet-router", tags: bosh("router", "0", "cf")},
+			{id: "i-2", state: "running", az: "us-east-1a", group: "magnet-router", tags: bosh("router", "1", "cf")},
+			{id: "i-3", state: "stopped", az: "us-east-1b", tags: bosh("nats", "0", "cf")},
+			{id: "i-4", state: "running", az: "us-east-1c", tags: bosh("nats", "1", "cf")},
+			{id: "i-5", state: "stopped", az: "us-east-1b", group: "magnet-old", tags: bosh("mysql", "0", "mysql")},
+			{id: "i-6", state: "running", az: "us-east-1a", tags: map[string]string{"Name": "bastion"}},
+		},
+		groups: []*fakeGroup{
+			{name: "magnet-router", id: "pg-1", strategy: "spread", strength: "mandatory"},
+			{name: "magnet-old", id: "pg-2", strategy: "spread", strength: "preferred"},
+			{name: "other", id: "pg-3", strategy: "spread"},
+			{name: "magnet-hpc", id: "pg-4", strategy: "cluster"},
+		},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeEC2) serve(w http.ResponseWriter, r *http.Request) {
+	if !authorization.MatchString(r.Header.Get("Authorization")) || r.FormValue("Version") != "2016-11-15" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `<Response><Errors><Error><Code>AuthFailure</Code><Message>AWS was not able to validate the provided access credentials</Message></Error></Errors></Response>`)
+		return
+	}
+	buf := &bytes.Buffer{}
+	switch action := r.FormValue("Action"); action {
+	case "DescribeInstances":
+		// two pages, to check that magnet follows the token
+		page := f.instances[:3]
+		if r.FormValue("NextToken") == "page-2" {
+			page = f.instances[3:]
+		}
+		buf.WriteString("<DescribeInstancesResponse><reservationSet><item><instancesSet>")
+		for _, in := range page {
+			fmt.Fprintf(buf, `<item><instanceId>%s</instanceId><instanceState><name>%s</name></instanceState>`, in.id, in.state)
+			fmt.Fprintf(buf, `<placement><availabilityZone>%s</availabilityZone><groupName>%s</groupName><hostId>%s</hostId></placement><tagSet>`, in.az, in.group, in.host)
+			for k, v := range in.tags {
+				fmt.Fprintf(buf, `<item><key>%s</key><value>%s</value></item>`, k, v)
+			}
+			buf.WriteString("</tagSet></item>")
+		}
+		buf.WriteString("</instancesSet></item></reservationSet>")
+		if r.FormValue("NextToken") == "" {
+			buf.WriteString("<nextToken>page-2</nextToken>")
+		}
+		buf.WriteString("</DescribeInstancesResponse>")
+	case "DescribeAvailabilityZones":
+		buf.WriteString(`<DescribeAvailabilityZonesResponse><availabilityZoneInfo>
+			<item><zoneName>us-east-1a</zoneName><zoneState>available</zoneState></item>
+			<item><zoneName>us-east-1b</zoneName><zoneState>available</zoneState></item>
+			<item><zoneName>us-east-1c</zoneName><zoneState>available</zoneState></item>
+			<item><zoneName>us-east-1d</zoneName><zoneState>impaired</zoneState></item>
+		</availabilityZoneInfo></DescribeAvailabilityZonesResponse>`)
+	case "DescribeHosts":
+		buf.WriteString(`<DescribeHostsResponse><hostSet>
+			<item><hostId>h-1</hostId><availabilityZone>us-east-1a</availabilityZone><state>available</state></item>
+			<item><hostId>h-2</hostId><availabilityZone>us-east-1b</availabilityZone><state>available</state></item>
+			<item><hostId>h-3</hostId><availabilityZone>us-east-1b</availabilityZone><state>released</state></item>
+		</hostSet></DescribeHostsResponse>`)
+	case "DescribePlacementGroups":
+		buf.WriteString("<DescribePlacementGroupsResponse><placementGroupSet>")
+		for _, g := range f.groups {
+			fmt.Fprintf(buf, `<item><groupName>%s</groupName><groupId>%s</groupId><strategy>%s</strategy><state>available</state><tagSet>`, g.name, g.id, g.strategy)
+			if g.strength != "" {
+				fmt.Fprintf(buf, `<item><key>magnet:strength</key><value>%s</value></item>`, g.strength)
+			}
+			buf.WriteString("</tagSet></item>")
+		}
+		buf.WriteString("</placementGroupSet></DescribePlacementGroupsResponse>")
+	case "CreatePlacementGroup":
+		f.calls = append(f.calls, fmt.Sprintf("create %s %s %s=%s", r.FormValue("GroupName"), r.FormValue("Strategy"),
+			r.FormValue("TagSpecification.1.Tag.1.Key"), r.FormValue("TagSpecification.1.Tag.1.Value")))
+	case "CreateTags":
+		f.calls = append(f.calls, fmt.Sprintf("tag %s %s=%s", r.FormValue("ResourceId.1"), r.FormValue("Tag.1.Key"), r.FormValue("Tag.1.Value")))
+	case "ModifyInstancePlacement":
+		f.calls = append(f.calls, fmt.Sprintf("move %s %s", r.FormValue("InstanceId"), r.FormValue("GroupName")))
+	case "DeletePlacementGroup":
+		f.calls = append(f.calls, "delete "+r.FormValue("GroupName"))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<Response><Errors><Error><Code>InvalidAction</Code><Message>%s</Message></Error></Errors></Response>`, action)
+		return
+	}
+	if buf.Len() == 0 {
+		buf.WriteString("<Response><return>true</return></Response>")
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buf.Bytes())
+}
+
+func (f *fakeEC2) config() aws.Config {
+	return aws.Config{Region: "us-east-1", AccessKeyID: "AKID", SecretAccessKey: "s3cret", Endpoint: f.URL}
+}
+
+func vmNames(vms []*magnet.VM) []string {
+	names := make([]string, len(vms))
+	for i, vm := range vms {
+		names[i] = vm.Name
+	}
+	return names
+}
+
+func hostIDs(hosts []*magnet.Host) []string {
+	ids := make([]string, len(hosts))
+	for i, h := range hosts {
+		ids[i] = h.ID
+	}
+	return ids
+}
+
+var _ = Describe("IaaS", func() {
+	var fake *fakeEC2
+	BeforeEach(func() {
+		fake = newFakeEC2()
+	})
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	It("lists the instances of BOSH jobs, the availability zones and magnet's spread placement groups", func() {
+		i, err := aws.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(i.Unverified()).Should(BeTrue())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(state.RuleContainer).Should(Equal("region:us-east-1"))
+		Ω(hostIDs(state.Hosts)).Should(Equal([]string{"us-east-1a", "us-east-1b", "us-east-1c"}))
+		Ω(vmNames(state.VMs)).Should(Equal([]string{"router/0", "router/1", "nats/0", "nats/1", "mysql/0"}))
+		Ω(*state.VMs[2]).Should(Equal(magnet.VM{
+			Name: "nats/0", ID: "i-3", Reference: "i-3", HostUUID: "us-east-1b", HostName: "us-east-1b",
+			Job: "nats", Index: "0", Deployment: "cf", AZ: "us-east-1b",
+		}))
+
+		Ω(state.Rules).Should(HaveLen(2))
+		Ω(state.Rules[0].Name).Should(Equal("router"))
+		Ω(state.Rules[0].ID).Should(Equal("pg-1"))
+		Ω(state.Rules[0].Mandatory).Should(BeTrue())
+		Ω(vmNames(state.Rules[0].VMs)).Should(Equal([]string{"router/0", "router/1"}))
+		Ω(state.Rules[1].Name).Should(Equal("old"))
+		Ω(state.Rules[1].Mandatory).Should(BeFalse())
+		Ω(magnet.IsBalanced(state)).Should(BeFalse())
+	})
+
+	It("counts Dedicated Hosts as hosts, and identifies instances with the BOSH director", func() {
+		fake.instances[0].host = "h-1"
+		c := fake.config()
+		c.Deployments = []string{"cf"}
+		i, err := aws.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		i.Instances = mock.Instances{{Deployment: "cf", Job: "jumpbox", Index: "0", AZ: "z1", CID: "i-6"}}
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(hostIDs(state.Hosts)).Should(Equal([]string{"us-east-1a", "us-east-1b", "us-east-1c", "h-1", "h-2"}))
+		Ω(state.Hosts[3].Attributes).Should(Equal(map[string]string{"availability-zone": "us-east-1a"}))
+		Ω(vmNames(state.VMs)).Should(Equal([]string{"router/0", "router/1", "nats/0", "nats/1", "bastion"}))
+		Ω(state.VMs[0].HostUUID).Should(Equal("h-1"))
+		Ω(state.VMs[4].Job).Should(Equal("jumpbox"))
+		Ω(state.VMs[4].AZ).Should(Equal("us-east-1a"))
+	})
+
+	It("creates, tags and deletes placement groups, and moves the stopped instances", func() {
+		i, err := aws.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		router := *state.Rules[0]
+		router.ID, router.Mandatory = "", false
+		nats := magnet.Rule{Name: "nats", Enabled: true, VMs: state.VMs[2:4]}
+		rec := &magnet.RuleRecommendation{
+			Stale:   []magnet.Rule{*state.Rules[0], *state.Rules[1]},
+			Missing: []magnet.Rule{router, nats},
+		}
+		err = i.Converge(context.Background(), state, rec)
+		Ω(fake.calls).Should(Equal([]string{
+			"tag pg-1 magnet:strength=preferred",
+			"create magnet-nats spread magnet:strength=preferred",
+			"move i-3 magnet-nats",
+			"move i-5 ",
+			"delete magnet-old",
+		}))
+		Ω(err).Should(BeAssignableToTypeOf(&aws.ActionsError{}))
+		Ω(err.(*aws.ActionsError).Actions).Should(Equal([]aws.Action{{Instance: "i-4", Name: "nats/1", Group: "magnet-nats"}}))
+		Ω(err).Should(MatchError("aws: 1 instances must be stopped to change their placement groups: i-4 (nats/1) to magnet-nats"))
+	})
+
+	It("keeps the placement groups of stale rules with running instances", func() {
+		fake.instances[4].state = "running"
+		i, err := aws.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = i.Converge(context.Background(), state, &magnet.RuleRecommendation{Stale: []magnet.Rule{*state.Rules[1]}})
+		Ω(fake.calls).Should(BeEmpty())
+		Ω(err).Should(MatchError(ContainSubstring("i-5 (mysql/0) to no group")))
+	})
+
+	It("ignores the placement groups of other deployments", func() {
+		c := fake.config()
+		c.Deployments = []string{"cf"}
+		i, err := aws.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(state.Rules).Should(HaveLen(1))
+		Ω(state.Rules[0].Name).Should(Equal("router"))
+	})
+
+	It("keeps the placement groups of stale rules with instances it doesn't manage", func() {
+		fake.instances[5].group = "magnet-old"
+		i, err := aws.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(vmNames(state.Rules[1].VMs)).Should(Equal([]string{"mysql/0"}))
+
+		err = i.Converge(context.Background(), state, &magnet.RuleRecommendation{Stale: []magnet.Rule{*state.Rules[1]}})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fake.calls).Should(Equal([]string{"move i-5 "}))
+	})
+
+	It("reports the errors of the EC2 API", func() {
+		c := fake.config()
+		c.AccessKeyID = "wrong"
+		i, err := aws.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = i.State(context.Background())
+		Ω(err).Should(MatchError("aws: DescribeInstances: AuthFailure: AWS was not able to validate the provided access credentials"))
+	})
+})
+
+var _ = Describe("Config", func() {
+	It("reads the AWS CLI's environment variables", func() {
+		for name, value := range map[string]string{
+			"AWS_DEFAULT_REGION":    "us-west-2",
+			"AWS_REGION":            "us-east-1",
+			"AWS_ACCESS_KEY_ID":     "AKID",
+			"AWS_SECRET_ACCESS_KEY": "s3cret",
+		} {
+			os.Setenv(name, value)
+			defer os.Unsetenv(name)
+		}
+		var c aws.Config
+		c.ApplyEnv()
+		Ω(c).Should(Equal(aws.Config{Region: "us-east-1", AccessKeyID: "AKID", SecretAccessKey: "s3cret"}))
+		Ω(c.Validate()).Should(BeEmpty())
+		Ω(c.Unverified()).Should(BeFalse())
+	})
+
+	It("validates the settings", func() {
+		c := aws.Config{Endpoint: "ec2", GroupPrefix: "magnet\n"}
+		Ω(c.Validate()).Should(HaveLen(5))
+	})
+})
@@ -0,0 +1,134 @@
+package bosh
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// DefaultPort is the port of a director whose environment has none.
+const DefaultPort = "25555"
+
+// Config describes a BOSH director and the deployments whose instances
+// magnet reads from it.
+type Config struct {
+	Environment  string        `yaml:"environment"` // the director's URL or address
+	Client       string        `yaml:"client"`
+	ClientSecret magnet.Secret `yaml:"client-secret"`
+	CACert       string        `yaml:"ca-cert"`     // path of a PEM bundle, or the PEM itself
+	Deployments  []string      `yaml:"deployments"` // every deployment if empty
+}
+
+// ApplyEnv overrides c with the BOSH_ENVIRONMENT, BOSH_CLIENT,
+// BOSH_CLIENT_SECRET, BOSH_CA_CERT and BOSH_DEPLOYMENT environment
+// variables that are set, as the BOSH CLI reads them.
+func (c *Config) ApplyEnv() {
+	for name, field := range map[string]*string{
+		"BOSH_ENVIRONMENT":   &c.Environment,
+		"BOSH_CLIENT":        &c.Client,
+		"BOSH_CLIENT_SECRET": (*string)(&c.ClientSecret),
+		"BOSH_CA_CERT":       &c.CACert,
+	} {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+	if v, ok := os.LookupEnv("BOSH_DEPLOYMENT"); ok {
+		c.Deployments = []string{v}
+	}
+}
+
+// Validate returns every problem with c.
+func (c *Config) Validate() []error {
+	var errs []error
+	if c.Environment == "" {
+		errs = append(errs, errors.New("environment is required"))
+	} else if _, err := c.url(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Client == "" {
+		errs = append(errs, errors.New("client is required"))
+	}
+	if c.ClientSecret == "" {
+		errs = append(errs, errors.New("client-secret is required"))
+	}
+	if c.CACert != "" {
+		if _, err := c.roots(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, d := range c.Deployments {
+		if d == "" || strings.Contains(d, "/") {
+			errs = append(errs, fmt.Errorf("invalid deployment name %q", d))
+		}
+	}
+	return errs
+}
+
+// Director creates a Director for c.
+func (c *Config) Director() (*Director, error) {
+	if errs := c.Validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("bosh: %v", errs[0])
+	}
+	u, _ := c.url()
+	roots, _ := c.roots()
+	return &Director{
+		URL:          u,
+		Client:       c.Client,
+		ClientSecret: c.ClientSecret,
+		Deployments:  c.Deployments,
+		HTTPClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		},
+	}, nil
+}
+
+// url returns the URL of the director.  The environment may omit the
+// scheme, which defaults to https, and the port.
+func (c *Config) url() (string, error) {
+	env := c.Environment
+	if !strings.Contains(env, "://") {
+		env = "https://" + env
+	}
+	u, err := url.Parse(env)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid environment %q", c.Environment)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// roots returns the CAs to trust, or nil for the system's.
+func (c *Config) roots() (*x509.CertPool, error) {
+	if c.CACert == "" {
+		return nil, nil
+	}
+	pem := []byte(c.CACert)
+	if !strings.Contains(c.CACert, "-----BEGIN") {
+		var err error
+		if pem, err = ioutil.ReadFile(c.CACert); err != nil {
+			return nil, fmt.Errorf("ca-cert: %v", err)
+		}
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("ca-cert: no PEM certificates found")
+	}
+	return pool, nil
+}
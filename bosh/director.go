@@ -0,0 +1,237 @@
+// Package bosh reads the instances of BOSH deployments from their
+// director, so that magnet can identify the jobs of VMs without
+// relying on the VMs' metadata.
+package bosh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// Director is a magnet.InstanceSource that lists the instances of
+// deployments with a BOSH director's API.  It authenticates as a UAA
+// client if the director uses UAA, and with basic authentication
+// otherwise.
+type Director struct {
+	URL          string
+	Client       string
+	ClientSecret magnet.Secret
+	Deployments  []string // every deployment if empty
+	HTTPClient   *http.Client
+
+	mu     sync.Mutex
+	uaaURL string // empty if the director uses basic authentication
+	known  bool   // whether the authentication type is known
+	token  string
+	expiry time.Time
+}
+
+// tokenMargin is how long before it expires a UAA token is renewed.
+const tokenMargin = time.Minute
+
+// instance is an entry of GET /deployments/:name/instances.
+type instance struct {
+	ID    string `json:"id"`
+	Job   string `json:"job"`
+	Index *int   `json:"index"`
+	AZ    string `json:"az"`
+	CID   string `json:"cid"`
+}
+
+// Instances lists the instances that have VMs.
+func (d *Director) Instances(ctx context.Context) ([]magnet.Instance, error) {
+	deployments := d.Deployments
+	if len(deployments) == 0 {
+		var list []struct {
+			Name string `json:"name"`
+		}
+		if err := d.get(ctx, "/deployments", &list); err != nil {
+			return nil, err
+		}
+		for _, dep := range list {
+			deployments = append(deployments, dep.Name)
+		}
+	}
+
+	var instances []magnet.Instance
+	for _, dep := range deployments {
+		var list []instance
+		if err := d.get(ctx, "/deployments/"+url.PathEscape(dep)+"/instances", &list); err != nil {
+			return nil, err
+		}
+		for _, in := range list {
+			if in.CID == "" {
+				continue
+			}
+			index := ""
+			if in.Index != nil {
+				index = strconv.Itoa(*in.Index)
+			}
+			instances = append(instances, magnet.Instance{
+				Deployment: dep,
+				Job:        in.Job,
+				Index:      index,
+				AZ:         in.AZ,
+				ID:         in.ID,
+				CID:        in.CID,
+			})
+		}
+	}
+	return instances, nil
+}
+
+// get GETs path from the director, and decodes the response into v.
+// A rejected UAA token is renewed once.
+func (d *Director) get(ctx context.Context, path string, v interface{}) error {
+	resp, err := d.do(ctx, path)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && d.usesUAA() {
+		resp.Body.Close()
+		d.mu.Lock()
+		d.token = ""
+		d.mu.Unlock()
+		resp, err = d.do(ctx, path)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bosh: GET %s: %s", path, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("bosh: GET %s: %v", path, err)
+	}
+	return nil
+}
+
+func (d *Director) do(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(d.URL, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if err = d.authenticate(ctx, req); err != nil {
+		return nil, err
+	}
+	resp, err := d.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("bosh: %v", magnet.Redact(err.Error(), d.ClientSecret))
+	}
+	return resp, nil
+}
+
+// authenticate adds the director's credentials to req.
+func (d *Director) authenticate(ctx context.Context, req *http.Request) error {
+	if err := d.discover(ctx); err != nil {
+		return err
+	}
+	if !d.usesUAA() {
+		req.SetBasicAuth(d.Client, string(d.ClientSecret))
+		return nil
+	}
+	token, err := d.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// discover asks the director how it authenticates, once.
+func (d *Director) discover(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.known {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(d.URL, "/")+"/info", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("bosh: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bosh: GET /info: %s", resp.Status)
+	}
+	var info struct {
+		Auth struct {
+			Type    string `json:"type"`
+			Options struct {
+				URL string `json:"url"`
+			} `json:"options"`
+		} `json:"user_authentication"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return fmt.Errorf("bosh: GET /info: %v", err)
+	}
+	if info.Auth.Type == "uaa" {
+		if info.Auth.Options.URL == "" {
+			return fmt.Errorf("bosh: the director uses UAA, but doesn't say where it is")
+		}
+		d.uaaURL = info.Auth.Options.URL
+	}
+	d.known = true
+	return nil
+}
+
+func (d *Director) usesUAA() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.uaaURL != ""
+}
+
+// accessToken returns a UAA access token for the client, requesting
+// a new one if it has none or its token is about to expire.
+func (d *Director) accessToken(ctx context.Context) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.token != "" && time.Now().Before(d.expiry.Add(-tokenMargin)) {
+		return d.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(d.uaaURL, "/")+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(d.Client, string(d.ClientSecret))
+	resp, err := d.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("bosh: uaa: %v", magnet.Redact(err.Error(), d.ClientSecret))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bosh: uaa: requesting a token for client %q: %s", d.Client, resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("bosh: uaa: invalid token response")
+	}
+	d.token = token.AccessToken
+	d.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return d.token, nil
+}
+
+func (d *Director) client() *http.Client {
+	if d.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return d.HTTPClient
+}
@@ -0,0 +1,175 @@
+package bosh_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/bosh"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeDirector serves the parts of the director's API that magnet uses.
+type fakeDirector struct {
+	uaa      *httptest.Server // nil for basic authentication
+	tokens   int
+	director *httptest.Server
+}
+
+func newFakeDirector(useUAA bool) *fakeDirector {
+	f := &fakeDirector{}
+	if useUAA {
+		f.uaa = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, secret, _ := r.BasicAuth()
+			if r.URL.Path != "/oauth/token" || id != "magnet" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			f.tokens++
+			fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600}`, f.tokens)
+		}))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		if f.uaa != nil {
+			fmt.Fprintf(w, `{"user_authentication": {"type": "uaa", "options": {"url": %q}}}`, f.uaa.URL)
+			return
+		}
+		fmt.Fprint(w, `{"user_authentication": {"type": "basic", "options": {}}}`)
+	})
+	authorized := func(r *http.Request) bool {
+		if f.uaa != nil {
+			return r.Header.Get("Authorization") == fmt.Sprintf("Bearer token-%d", f.tokens)
+		}
+		id, secret, _ := r.BasicAuth()
+		return id == "magnet" && secret == "s3cret"
+	}
+	mux.HandleFunc("/deployments", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `[{"name": "cf"}, {"name": "mysql"}]`)
+	})
+	mux.HandleFunc("/deployments/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		instances := map[string]interface{}{
+			"/deployments/cf/instances": []map[string]interface{}{
+				{"id": "a1", "job": "router", "index": 0, "az": "z1", "cid": "vm-1", "expects_vm": true},
+				{"id": "a2", "job": "router", "index": 1, "az": "z2", "cid": "vm-2", "expects_vm": true},
+				{"id": "a3", "job": "smoke-tests", "index": nil, "az": nil, "cid": nil, "expects_vm": false},
+			},
+			"/deployments/mysql/instances": []map[string]interface{}{
+				{"id": "b1", "job": "mysql", "index": 0, "az": "z1", "cid": "vm-3", "expects_vm": true},
+			},
+		}[r.URL.Path]
+		if instances == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(instances)
+	})
+	f.director = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeDirector) Close() {
+	f.director.Close()
+	if f.uaa != nil {
+		f.uaa.Close()
+	}
+}
+
+var _ = Describe("Director", func() {
+	var fake *fakeDirector
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	for _, useUAA := range []bool{false, true} {
+		useUAA := useUAA
+		It(fmt.Sprintf("lists the instances with VMs (UAA: %t)", useUAA), func() {
+			fake = newFakeDirector(useUAA)
+			d := &bosh.Director{URL: fake.director.URL, Client: "magnet", ClientSecret: "s3cret"}
+			instances, err := d.Instances(context.Background())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(instances).Should(Equal([]magnet.Instance{
+				{Deployment: "cf", Job: "router", Index: "0", AZ: "z1", ID: "a1", CID: "vm-1"},
+				{Deployment: "cf", Job: "router", Index: "1", AZ: "z2", ID: "a2", CID: "vm-2"},
+				{Deployment: "mysql", Job: "mysql", Index: "0", AZ: "z1", ID: "b1", CID: "vm-3"},
+			}))
+		})
+	}
+
+	It("only lists the configured deployments", func() {
+		fake = newFakeDirector(false)
+		d := &bosh.Director{URL: fake.director.URL, Client: "magnet", ClientSecret: "s3cret", Deployments: []string{"mysql"}}
+		instances, err := d.Instances(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(instances).Should(HaveLen(1))
+		Ω(instances[0].Job).Should(Equal("mysql"))
+	})
+
+	It("reuses its UAA token, and renews it once it's rejected", func() {
+		fake = newFakeDirector(true)
+		d := &bosh.Director{URL: fake.director.URL, Client: "magnet", ClientSecret: "s3cret"}
+		_, err := d.Instances(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = d.Instances(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fake.tokens).Should(Equal(1))
+
+		// another client has been issued a token, invalidating ours
+		fake.tokens++
+		_, err = d.Instances(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fake.tokens).Should(Equal(3))
+	})
+
+	It("reports bad credentials and missing deployments", func() {
+		fake = newFakeDirector(false)
+		d := &bosh.Director{URL: fake.director.URL, Client: "magnet", ClientSecret: "wrong"}
+		_, err := d.Instances(context.Background())
+		Ω(err).Should(MatchError(ContainSubstring("401")))
+
+		d = &bosh.Director{URL: fake.director.URL, Client: "magnet", ClientSecret: "s3cret", Deployments: []string{"nope"}}
+		_, err = d.Instances(context.Background())
+		Ω(err).Should(MatchError(ContainSubstring("404")))
+	})
+})
+
+var _ = Describe("Config", func() {
+	It("reads the BOSH CLI's environment variables", func() {
+		for name, value := range map[string]string{
+			"BOSH_ENVIRONMENT":   "10.0.0.6",
+			"BOSH_CLIENT":        "admin",
+			"BOSH_CLIENT_SECRET": "s3cret",
+			"BOSH_DEPLOYMENT":    "cf",
+		} {
+			os.Setenv(name, value)
+			defer os.Unsetenv(name)
+		}
+		var c bosh.Config
+		c.ApplyEnv()
+		Ω(c).Should(Equal(bosh.Config{Environment: "10.0.0.6", Client: "admin", ClientSecret: "s3cret", Deployments: []string{"cf"}}))
+
+		d, err := c.Director()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(d.URL).Should(Equal("https://10.0.0.6:25555"))
+	})
+
+	It("validates the settings", func() {
+		c := bosh.Config{Environment: "https://", CACert: "/does/not/exist", Deployments: []string{""}}
+		Ω(c.Validate()).Should(HaveLen(5))
+	})
+})
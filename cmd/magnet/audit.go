@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// audit prints the entries in the audit log that match the query
+// described by args.
+func audit(args []string) error {
+	fs := commandFlags("audit")
+	since := fs.Duration("since", 0, "only show changes made within this duration (e.g. 24h)")
+	cluster := fs.String("cluster", "", "only show changes to this cluster (MoRef)")
+	rule := fs.String("rule", "", "only show changes to this rule")
+	user := fs.String("user", "", "only show changes made by this vCenter user")
+	fs.Parse(args)
+	if err := checkConfig(); err != nil {
+		return err
+	}
+
+	q := magnet.AuditQuery{Cluster: *cluster, Rule: *rule, User: *user}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	entries, err := (&magnet.AuditLog{Path: *auditLog}).Entries(q)
+	if err != nil {
+		return err
+	}
+
+	if *outFormat != magnet.OutputText {
+		// the audit log is already JSON lines, so
+		// every structured format gets the same output
+		enc := json.NewEncoder(os.Stdout)
+		for i := range entries {
+			if err := enc.Encode(&entries[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 8, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "TIME\tUSER\tCLUSTER\tACTION\tRULE\tVMS BEFORE\tVMS AFTER\tTASK\tRESULT")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format(time.RFC3339), e.User, e.Cluster, e.Action, e.Rule,
+			strings.Join(e.VMsBefore, ","), strings.Join(e.VMsAfter, ","), e.Task, e.Result)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pivotalservices/magnet"
+	"gopkg.in/yaml.v2"
+)
+
+// newChecker creates a Checker for the selected target from the flags.
+func newChecker(l magnet.Logger) (*magnet.Checker, error) {
+	v, err := newIaaS(l)
+	if err != nil {
+		return nil, err
+	}
+	n, err := notifier()
+	if err != nil {
+		return nil, err
+	}
+	c := &magnet.Checker{
+		IaaS:     v,
+		Logger:   l,
+		Notifier: n,
+		Limits: &magnet.Limits{
+			MaxAdded:           *maxAdded,
+			MaxRemoved:         *maxRemoved,
+			MaxRemovedFraction: *maxRemovedFraction,
+			MaxVMDrop:          *maxVMDrop,
+			AcceptVMDropAfter:  *acceptVMDropAfter,
+		},
+	}
+	if selected != nil {
+		c.Jobs = &selected.Jobs
+		c.Policies = selected.Policies
+	}
+	if *requireApproval {
+		c.Proposals = newStore()
+	}
+	return c, nil
+}
+
+// currentState parses the flags of a command that takes no
+// arguments, and gets the state of the selected target.
+func currentState(fs *flag.FlagSet, args []string) (*magnet.State, error) {
+	fs.Parse(args)
+	if err := checkConfig(); err != nil {
+		return nil, err
+	}
+	l, err := newLogger()
+	if err != nil {
+		return nil, err
+	}
+	c, err := newChecker(l)
+	if err != nil {
+		return nil, err
+	}
+	return c.State(context.Background())
+}
+
+// status prints whether each job is balanced.
+func status(args []string) error {
+	s, err := currentState(commandFlags("status"), args)
+	if err != nil {
+		return err
+	}
+	return magnet.PrintState(s, nil)
+}
+
+// plan prints the recommendations for the current state,
+// without applying them.
+func plan(args []string) error {
+	s, err := currentState(commandFlags("plan"), args)
+	if err != nil {
+		return err
+	}
+	return magnet.PrintState(s, magnet.Recommendations(s))
+}
+
+// apply checks the selected target once, converging it if necessary.
+func apply(args []string) error {
+	commandFlags("apply").Parse(args)
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	l, err := newLogger()
+	if err != nil {
+		return err
+	}
+	c, err := newChecker(l)
+	if err != nil {
+		return err
+	}
+	return c.Check(context.Background())
+}
+
+// vms lists the VMs of the selected target.
+func vms(args []string) error {
+	s, err := currentState(commandFlags("vms"), args)
+	if err != nil {
+		return err
+	}
+	vms := append([]*magnet.VM(nil), s.VMs...)
+	sort.Slice(vms, func(i, j int) bool {
+		if vms[i].Job != vms[j].Job {
+			return vms[i].Job < vms[j].Job
+		}
+		return vms[i].Name < vms[j].Name
+	})
+
+	if *outFormat != magnet.OutputText {
+		type vmReport struct {
+			Name string `json:"name" yaml:"name"`
+			Job  string `json:"job" yaml:"job"`
+			Host string `json:"host" yaml:"host"`
+		}
+		reports := make([]vmReport, len(vms))
+		for i, vm := range vms {
+			reports[i] = vmReport{Name: vm.Name, Job: vm.Job, Host: hostName(vm)}
+		}
+		return writeStructured(reports)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 8, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "NAME\tJOB\tHOST")
+	for _, vm := range vms {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", vm.Name, vm.Job, hostName(vm))
+	}
+	return nil
+}
+
+// rulesList lists the rules of the selected target.
+func rulesList(args []string) error {
+	s, err := currentState(commandFlags("rules list"), args)
+	if err != nil {
+		return err
+	}
+	rules := make([]magnet.Rule, len(s.Rules))
+	for i := range s.Rules {
+		rules[i] = *s.Rules[i]
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Name != rules[j].Name {
+			return rules[i].Name < rules[j].Name
+		}
+		return rules[i].Key < rules[j].Key
+	})
+	reports := magnet.RuleReports(rules)
+	if *outFormat != magnet.OutputText {
+		return writeStructured(reports)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 8, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "NAME\tTYPE\tENABLED\tMANDATORY\tSATISFIED\tVMS")
+	for i, r := range rules {
+		kind := "anti-affinity"
+		if r.Affinity {
+			kind = "affinity"
+		} else if r.Hosts != nil {
+			kind = "vm-host"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%t\t%t\t%s\n", r.Name, kind, r.Enabled, r.Mandatory, !r.Violated, strings.Join(reports[i].VMs, ","))
+	}
+	return nil
+}
+
+func hostName(vm *magnet.VM) string {
+	if vm.HostName != "" {
+		return vm.HostName
+	}
+	return vm.HostUUID
+}
+
+// writeStructured writes v to stdout in the -o format.
+func writeStructured(v interface{}) error {
+	if *outFormat == magnet.OutputYAML {
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
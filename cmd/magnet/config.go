@@ -0,0 +1,477 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/aws"
+	"github.com/pivotalservices/magnet/bosh"
+	"github.com/pivotalservices/magnet/openstack"
+	"github.com/pivotalservices/magnet/proxmox"
+	"github.com/pivotalservices/magnet/vsphere"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is the layout of the file named by -config.
+type configFile struct {
+	// Settings sets flags, by name, for every target.
+	Settings map[string]interface{} `yaml:"settings"`
+	Targets  []*target              `yaml:"targets"`
+}
+
+// target is a cluster for magnet to manage.
+type target struct {
+	Name    string           `yaml:"name"`
+	VSphere vsphere.Config   `yaml:"vsphere"`
+	Jobs    magnet.JobFilter `yaml:"jobs"`
+
+	// OpenStack, AWS or Proxmox, if set, makes the target an
+	// OpenStack project, an AWS region or a Proxmox VE cluster instead
+	// of a vSphere cluster.
+	OpenStack *openstack.Config `yaml:"openstack"`
+	AWS       *aws.Config       `yaml:"aws"`
+	Proxmox   *proxmox.Config   `yaml:"proxmox"`
+
+	// BOSH, if set, identifies the jobs of VMs with a BOSH director.
+	BOSH *bosh.Config `yaml:"bosh"`
+
+	// Policies sets the policies of jobs, except those set by
+	// the magnet-policy custom attribute of their VMs.
+	Policies magnet.Policies `yaml:"policies"`
+
+	// Settings sets flags, by name, for this target.  They take
+	// precedence over the file's top-level settings.
+	Settings map[string]interface{} `yaml:"settings"`
+}
+
+// selected is the target chosen by -target, or nil if there's no
+// config file and the IaaS is configured by the environment.
+var selected *target
+
+// kind returns the IaaS of t, which is set by -iaas if t is nil.
+func (t *target) kind() string {
+	switch {
+	case t == nil:
+		return *iaas
+	case t.OpenStack != nil:
+		return iaasOpenStack
+	case t.AWS != nil:
+		return iaasAWS
+	case t.Proxmox != nil:
+		return iaasProxmox
+	}
+	return iaasVSphere
+}
+
+// commandLineOnly are the flags that can't be set in the config file.
+var commandLineOnly = map[string]bool{"v": true, "config": true, "target": true, "env-file": true, "iaas": true}
+
+// envName is the environment variable that sets the named flag.
+func envName(flag string) string {
+	return "MAGNET_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// configure sets each flag that wasn't set on the command line from,
+// in order of precedence, its environment variable, the selected
+// target's settings and the config file's settings.  It returns the
+// selected target, and every problem it finds with the configuration.
+func configure(fs *flag.FlagSet) (*target, []error) {
+	var errs []error
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	setFromEnv := func(f *flag.Flag) {
+		if explicit[f.Name] {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", envName(f.Name), err))
+			}
+			explicit[f.Name] = true
+		}
+	}
+	// the env file may set the other variables
+	setFromEnv(fs.Lookup("env-file"))
+	if *envFile != "" {
+		if err := loadEnvFile(*envFile); err != nil {
+			return nil, append(errs, err)
+		}
+	}
+	fs.VisitAll(setFromEnv)
+
+	if *configPath == "" {
+		return nil, append(errs, checkFlags()...)
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	errs = append(errs, cfg.validate(fs)...)
+	layers := []map[string]interface{}{cfg.Settings}
+	t, err := cfg.target(*targetName)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		layers = append([]map[string]interface{}{t.Settings}, layers...)
+	}
+	for _, settings := range layers {
+		for name, v := range settings {
+			f := fs.Lookup(name)
+			if f == nil || commandLineOnly[name] || explicit[name] {
+				continue
+			}
+			// validate has reported any invalid values
+			if err := f.Value.Set(settingValue(v)); err == nil {
+				explicit[name] = true
+			}
+		}
+	}
+	if t != nil && *forbidInsecure {
+		var unverified bool
+		switch t.kind() {
+		case iaasOpenStack:
+			unverified = t.OpenStack.Unverified()
+		case iaasAWS:
+			unverified = t.AWS.Unverified()
+		case iaasProxmox:
+			unverified = t.Proxmox.Unverified()
+		default:
+			unverified = t.VSphere.Unverified()
+		}
+		if unverified {
+			errs = append(errs, fmt.Errorf("targets.%s.%s: %v", t.Name, t.kind(), errInsecure))
+		}
+	}
+	return t, append(errs, checkFlags()...)
+}
+
+// loadConfig reads the config file at path, and applies the VSPHERE_*,
+// OS_*, AWS_* or PROXMOX_* environment variables to each of its targets.
+func loadConfig(path string) (*configFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg configFile
+	if err = yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, t := range cfg.Targets {
+		switch t.kind() {
+		case iaasOpenStack:
+			t.OpenStack.ApplyEnv()
+		case iaasAWS:
+			t.AWS.ApplyEnv()
+		case iaasProxmox:
+			if err = t.Proxmox.ApplyEnv(); err != nil {
+				return nil, err
+			}
+		default:
+			if err = t.VSphere.ApplyEnv(); err != nil {
+				return nil, err
+			}
+		}
+		t.BOSH = boshFromEnv(t.BOSH)
+	}
+	return &cfg, nil
+}
+
+// reloadTarget re-reads the env file and the config file, and
+// returns the selected target.
+func reloadTarget() (*target, error) {
+	if *envFile != "" {
+		if err := loadEnvFile(*envFile); err != nil {
+			return nil, err
+		}
+	}
+	if *configPath == "" {
+		return nil, nil
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return nil, err
+	}
+	t, err := cfg.target(*targetName)
+	if err != nil {
+		return nil, err
+	}
+	if errs := append(t.Jobs.Validate(), t.Policies.Validate()...); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return t, nil
+}
+
+// boshFromEnv applies the BOSH_* environment variables to c.  If c is
+// nil, they configure a director if BOSH_ENVIRONMENT is set.
+func boshFromEnv(c *bosh.Config) *bosh.Config {
+	if c == nil {
+		if _, ok := os.LookupEnv("BOSH_ENVIRONMENT"); !ok {
+			return nil
+		}
+		c = &bosh.Config{}
+	}
+	c.ApplyEnv()
+	return c
+}
+
+// target returns the named target.  The name may be omitted
+// if the file declares a single target.
+func (cfg *configFile) target(name string) (*target, error) {
+	if name == "" {
+		if len(cfg.Targets) != 1 {
+			return nil, fmt.Errorf("%s declares %d targets, choose one with -target", *configPath, len(cfg.Targets))
+		}
+		return cfg.Targets[0], nil
+	}
+	for _, t := range cfg.Targets {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no target named %q", *configPath, name)
+}
+
+// validate returns every problem with the file's settings and targets.
+func (cfg *configFile) validate(fs *flag.FlagSet) []error {
+	errs := validateSettings(fs, "settings", cfg.Settings)
+	names := make(map[string]bool)
+	for i, t := range cfg.Targets {
+		prefix := fmt.Sprintf("targets[%d]", i)
+		if t.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", prefix))
+		} else {
+			prefix = "targets." + t.Name
+			if names[t.Name] {
+				errs = append(errs, fmt.Errorf("%s: duplicate target name", prefix))
+			}
+			names[t.Name] = true
+		}
+		var iaasErrs []error
+		switch t.kind() {
+		case iaasOpenStack:
+			iaasErrs = t.OpenStack.Validate()
+		case iaasAWS:
+			iaasErrs = t.AWS.Validate()
+		case iaasProxmox:
+			iaasErrs = t.Proxmox.Validate()
+		default:
+			iaasErrs = t.VSphere.Validate()
+		}
+		for _, err := range iaasErrs {
+			errs = append(errs, fmt.Errorf("%s.%s: %v", prefix, t.kind(), err))
+		}
+		set := 0
+		for _, ok := range []bool{t.OpenStack != nil, t.AWS != nil, t.Proxmox != nil} {
+			if ok {
+				set++
+			}
+		}
+		if set > 1 {
+			errs = append(errs, fmt.Errorf("%s: only one of openstack, aws and proxmox may be set", prefix))
+		}
+		for _, err := range t.Jobs.Validate() {
+			errs = append(errs, fmt.Errorf("%s.jobs: %v", prefix, err))
+		}
+		if t.BOSH != nil {
+			for _, err := range t.BOSH.Validate() {
+				errs = append(errs, fmt.Errorf("%s.bosh: %v", prefix, err))
+			}
+		}
+		for _, err := range t.Policies.Validate() {
+			errs = append(errs, fmt.Errorf("%s.policies: %v", prefix, err))
+		}
+		errs = append(errs, validateSettings(fs, prefix+".settings", t.Settings)...)
+	}
+	if len(cfg.Targets) == 0 {
+		errs = append(errs, errors.New("no targets are declared"))
+	}
+	return errs
+}
+
+// validateSettings checks that each setting names a flag and
+// has a value the flag accepts.
+func validateSettings(fs *flag.FlagSet, prefix string, settings map[string]interface{}) []error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		f := fs.Lookup(name)
+		switch {
+		case commandLineOnly[name]:
+			errs = append(errs, fmt.Errorf("%s: %s can only be set on the command line", prefix, name))
+		case f == nil:
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", prefix, name))
+		default:
+			if err := checkValue(f, settingValue(settings[name])); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %v", prefix, name, err))
+			}
+		}
+	}
+	return errs
+}
+
+// checkValue returns an error if f won't accept v.
+func checkValue(f *flag.Flag, v string) error {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch getter.Get().(type) {
+	case bool:
+		_, err = strconv.ParseBool(v)
+	case int:
+		_, err = strconv.Atoi(v)
+	case float64:
+		_, err = strconv.ParseFloat(v, 64)
+	case time.Duration:
+		_, err = time.ParseDuration(v)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q", v)
+	}
+	return nil
+}
+
+// settingValue converts a YAML setting to a flag value.
+// Lists become comma-separated values.
+func settingValue(v interface{}) string {
+	if list, ok := v.([]interface{}); ok {
+		values := make([]string, len(list))
+		for i := range list {
+			values[i] = fmt.Sprint(list[i])
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// checkFlags returns every problem with the values of the flags
+// that are parsed after configuration.
+func checkFlags() []error {
+	var errs []error
+	check := func(flag string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %v", flag, err))
+		}
+	}
+	_, err := magnet.ParseLevel(*logLevel)
+	check("log-level", err)
+	_, err = magnet.NewLogger(ioutil.Discard, *logFormat, magnet.LevelInfo)
+	check("log-format", err)
+	check("o", magnet.SetFormat(*outFormat))
+	_, err = magnet.ParseSchedule(*poll)
+	check("p", err)
+	if *act != "" {
+		_, err = magnet.ParseSchedule(*act)
+		check("act", err)
+	}
+	if *quietHours != "" {
+		_, err = magnet.ParseCron(*quietHours)
+		check("quiet-hours", err)
+	}
+	switch *leaderElection {
+	case "", "vcenter", "file":
+	default:
+		check("leader-election", fmt.Errorf("unknown leader election %q", *leaderElection))
+	}
+	switch *iaas {
+	case iaasVSphere, iaasOpenStack, iaasAWS, iaasProxmox:
+	default:
+		check("iaas", fmt.Errorf("unknown IaaS %q", *iaas))
+	}
+	for _, event := range splitList(*notifyEvents) {
+		_, err = magnet.ParseEventType(event)
+		check("notify-events", err)
+	}
+	return errs
+}
+
+// configCommand runs the config subcommands.
+func configCommand(args []string) error {
+	fs := commandFlags("config")
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) != "validate" {
+		fs.Usage()
+		return errors.New("no config command specified")
+	}
+	errs := configErrs
+	if selected == nil && *configPath == "" {
+		errs = append(errs, envErrs()...)
+	}
+	if len(errs) == 0 {
+		fmt.Println("configuration is valid")
+		return nil
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "  - %v\n", err)
+	}
+	return errors.New("configuration is invalid")
+}
+
+// envErrs returns every problem with the IaaS and BOSH director
+// configured by the environment.
+func envErrs() []error {
+	var errs []error
+	switch *iaas {
+	case iaasOpenStack:
+		var config openstack.Config
+		config.ApplyEnv()
+		for _, err := range config.Validate() {
+			errs = append(errs, fmt.Errorf("openstack: %v", err))
+		}
+		if *forbidInsecure && config.Unverified() {
+			errs = append(errs, fmt.Errorf("openstack: %v", errInsecure))
+		}
+	case iaasAWS:
+		var config aws.Config
+		config.ApplyEnv()
+		for _, err := range config.Validate() {
+			errs = append(errs, fmt.Errorf("aws: %v", err))
+		}
+		if *forbidInsecure && config.Unverified() {
+			errs = append(errs, fmt.Errorf("aws: %v", errInsecure))
+		}
+	case iaasProxmox:
+		var config proxmox.Config
+		if err := config.ApplyEnv(); err != nil {
+			errs = append(errs, err)
+		}
+		for _, err := range config.Validate() {
+			errs = append(errs, fmt.Errorf("proxmox: %v", err))
+		}
+		if *forbidInsecure && config.Unverified() {
+			errs = append(errs, fmt.Errorf("proxmox: %v", errInsecure))
+		}
+	default:
+		var config vsphere.Config
+		if err := config.ApplyEnv(); err != nil {
+			errs = append(errs, err)
+		}
+		for _, err := range config.Validate() {
+			errs = append(errs, fmt.Errorf("vsphere: %v", err))
+		}
+		if *forbidInsecure && config.Unverified() {
+			errs = append(errs, fmt.Errorf("vsphere: %v", errInsecure))
+		}
+	}
+	if b := boshFromEnv(nil); b != nil {
+		for _, err := range b.Validate() {
+			errs = append(errs, fmt.Errorf("bosh: %v", err))
+		}
+	}
+	return errs
+}
@@ -2,21 +2,112 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/aws"
+	"github.com/pivotalservices/magnet/openstack"
+	"github.com/pivotalservices/magnet/proxmox"
 	"github.com/pivotalservices/magnet/vsphere"
 )
 
 var Version = "dev"
 
 var (
-	ver  = flag.Bool("v", false, "print the version")
-	poll = flag.Int("p", 5, "polling period (minutes)")
+	ver        = flag.Bool("v", false, "print the version")
+	poll       = flag.String("p", "5m", "when to check: a duration (30s, 2m30s), whole minutes or a cron expression")
+	logLevel   = flag.String("log-level", "info", "log level (debug, info, warn, error)")
+	logFormat  = flag.String("log-format", magnet.FormatLogfmt, "log format (logfmt, json)")
+	outFormat  = flag.String("o", magnet.OutputText, "output format (text, json, yaml)")
+	auditLog   = flag.String("audit-log", "magnet-audit.log", "path of the audit log of rule changes")
+	envFile    = flag.String("env-file", "", "file of NAME=value environment variables to read (and re-read on SIGHUP)")
+	configPath = flag.String("config", "", "YAML file of targets and settings")
+	targetName = flag.String("target", "", "name of the target in -config to manage (default the only target)")
+	iaas       = flag.String("iaas", iaasVSphere, "IaaS configured by the environment when there's no -config: vsphere, openstack, aws or proxmox")
+
+	act              = flag.String("act", "", "when to apply recommendations, in the same form as -p (default every check)")
+	quietHours       = flag.String("quiet-hours", "", "cron expression matching the minutes in which no changes are made (e.g. \"* 0-6 * * *\")")
+	pollTimeout      = flag.Duration("poll-timeout", magnet.DefaultPollTimeout, "how long a single check may take")
+	maxBackoff       = flag.Duration("max-backoff", magnet.DefaultMaxBackoff, "longest wait between checks after consecutive failures")
+	failureThreshold = flag.Int("failure-threshold", 3, "consecutive failed checks before the daemon reports itself unready (0 to disable)")
+	leaderElection   = flag.String("leader-election", "", "elect a leader among daemons managing the same cluster: vcenter or file (default none)")
+	leaderLock       = flag.String("leader-lock", "magnet.lock", "lock file for -leader-election file")
+	leaderLease      = flag.Duration("leader-lease", 15*time.Minute, "how long a -leader-election vcenter lease lasts without being renewed")
+	leaderID         = flag.String("leader-id", "", "identifies this daemon in a -leader-election vcenter lease (default host/pid)")
+	forbidInsecure   = flag.Bool("forbid-insecure", false, "refuse to connect to a vCenter, OpenStack, EC2 or Proxmox endpoint without verifying its certificate")
+	applyDRS         = flag.Bool("apply-drs-recommendations", false, "after changing rules, apply the DRS recommendations that fix their violations (for clusters where DRS isn't fully automated)")
+	migrationTimeout = flag.Duration("migration-timeout", vsphere.DefaultMigrationTimeout, "how long to wait for the migrations of applied DRS recommendations, or of Proxmox VMs")
+	drainTimeout     = flag.Duration("drain-timeout", magnet.DefaultDrainTimeout, "how long to let a check in progress finish when shutting down")
+
+	notifyWebhook = flag.String("notify-webhook", "", "URL to POST JSON notifications to")
+	notifySlack   = flag.String("notify-slack", "", "Slack-compatible webhook URL to post notifications to")
+	notifySMTP    = flag.String("notify-smtp", "", "host:port of the mail server to send notifications through")
+	notifyFrom    = flag.String("notify-smtp-from", "magnet@localhost", "sender of notification emails")
+	notifyTo      = flag.String("notify-smtp-to", "", "comma-separated recipients of notification emails")
+	notifyEvents  = flag.String("notify-events", "unbalanced,converged,converge_failed,proposed,limit_exceeded,actions_pending,poll_failing,poll_recovered", "comma-separated events to notify on")
+	notifyDedup   = flag.Duration("notify-dedup", time.Hour, "suppress repeats of an identical notification for this long")
+
+	requireApproval = flag.Bool("require-approval", false, "wait for recommendations to be approved before applying them")
+	proposalsDir    = flag.String("proposals-dir", "magnet-proposals", "directory to store proposals awaiting approval in")
+	proposalTTL     = flag.Duration("proposal-ttl", 24*time.Hour, "how long a proposal may wait for approval")
+	listen          = flag.String("listen", "", "address to serve the HTTP API on (e.g. 127.0.0.1:8080); approving over it requires MAGNET_APPROVAL_TOKEN")
+
+	maxAdded           = flag.Int("max-rules-added", 0, "refuse to add more than this many rules per check (0 for no limit)")
+	maxRemoved         = flag.Int("max-rules-removed", 0, "refuse to remove more than this many rules per check (0 for no limit)")
+	maxRemovedFraction = flag.Float64("max-rules-removed-fraction", 0.5, "refuse to remove more than this fraction of the existing rules per check (0 for no limit)")
+	backupsDir         = flag.String("backups-dir", "magnet-backups", "directory to store snapshots of cluster rules in")
+	maxVMDrop          = flag.Float64("max-vm-drop", 0.2, "refuse to converge if the VM count drops by more than this fraction between checks (0 for no limit)")
+	acceptVMDropAfter  = flag.Int("accept-vm-drop-after", 3, "accept a dropped VM count once this many consecutive checks have seen it (0 to refuse until the VMs return)")
 )
 
+// command is a magnet subcommand.
+type command struct {
+	args    string // describes the command's arguments in its usage
+	summary string
+	run     func(args []string) error
+}
+
+// commandNames lists the commands in the order they are described.
+var commandNames = []string{"status", "plan", "apply", "daemon", "vms", "rules", "audit", "proposals", "approve", "config", "help"}
+
+var commands map[string]*command
+
+// subcommands describes the commands run by other commands, such as
+// "rules list", for commandFlags.  Their parents run them.
+var subcommands = map[string]*command{
+	"rules list":    {"", "list the cluster's rules", nil},
+	"rules backup":  {"", "snapshot the cluster's rules", nil},
+	"rules history": {"[flags]", "list snapshots of the cluster's rules", nil},
+	"rules restore": {"[flags] <version>", "replace the cluster's rules with a snapshot", nil},
+}
+
+func init() {
+	commands = map[string]*command{
+		"status":    {"", "show whether each job is balanced", status},
+		"plan":      {"", "show the rule changes that would balance the jobs, without making them", plan},
+		"apply":     {"", "check once, making the rule changes that balance the jobs", apply},
+		"daemon":    {"", "check on a schedule until interrupted (the default command)", daemon},
+		"vms":       {"", "list the VMs, their jobs and their hosts", vms},
+		"rules":     {"<command>", "list, back up and restore the cluster's rules", rules},
+		"audit":     {"[flags]", "list the rule changes magnet has made", audit},
+		"proposals": {"", "list the proposals awaiting approval", proposals},
+		"approve":   {"<id>", "approve a proposal", approve},
+		"config":    {"validate", "check the flags, environment and config file", configCommand},
+		"help":      {"[command]", "show help for a command", help},
+	}
+	flag.Usage = usage
+}
+
+// configErrs are the problems found by configure.  Commands report them
+// after parsing their own flags, so that -h works whatever they are.
+var configErrs []error
+
 func main() {
 	flag.Parse()
 	if *ver {
@@ -24,18 +115,331 @@ func main() {
 		return
 	}
 
-	v, err := vsphere.New()
-	if err != nil {
+	selected, configErrs = configure(flag.CommandLine)
+	name, args := "daemon", []string(nil)
+	if flag.NArg() > 0 {
+		name, args = flag.Arg(0), flag.Args()[1:]
+	}
+	c, ok := commands[name]
+	if !ok {
+		usage()
+		exit(fmt.Errorf("unknown command %q", name))
+	}
+	if err := c.run(args); err != nil {
 		exit(err)
 	}
-	d := &magnet.Daemon{IaaS: v, Period: *poll}
-	err = d.Run(context.Background())
+}
+
+// usage describes the global flags and the commands.
+func usage() {
+	fmt.Fprint(os.Stderr, "Usage: magnet [global flags] [command]\n\nCommands:\n")
+	for _, name := range commandNames {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprint(os.Stderr, "\nRun 'magnet help <command>' for help with a command.\n\nGlobal flags:\n")
+	flag.PrintDefaults()
+}
+
+// commandFlags creates the flags of the named command.
+func commandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		c, ok := commands[name]
+		if !ok {
+			c = subcommands[name]
+		}
+		fmt.Fprintf(os.Stderr, "Usage: magnet [global flags] %s\n\n%s.\n", strings.TrimSpace(name+" "+c.args), strings.ToUpper(c.summary[:1])+c.summary[1:])
+		if hasFlags(fs) {
+			fmt.Fprint(os.Stderr, "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+		fmt.Fprint(os.Stderr, "\nRun 'magnet -h' for the global flags.\n")
+	}
+	return fs
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	n := 0
+	fs.VisitAll(func(*flag.Flag) { n++ })
+	return n > 0
+}
+
+// checkConfig returns the first problem found by configure,
+// and prints the others.
+func checkConfig() error {
+	if len(configErrs) == 0 {
+		return nil
+	}
+	for _, err := range configErrs[1:] {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	}
+	return configErrs[0]
+}
+
+// help describes a command, or all of them.
+func help(args []string) error {
+	fs := commandFlags("help")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usage()
+		return nil
+	}
+	c, ok := commands[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+	return c.run([]string{"-h"})
+}
+
+// newStore creates the proposal store described by the flags.
+func newStore() *magnet.ProposalStore {
+	return &magnet.ProposalStore{Dir: *proposalsDir, TTL: *proposalTTL}
+}
+
+// daemon runs the magnet daemon until it is interrupted.
+func daemon(args []string) error {
+	commandFlags("daemon").Parse(args)
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	l, err := newLogger()
 	if err != nil {
-		exit(err)
+		return err
+	}
+	v, err := newIaaS(l)
+	if err != nil {
+		return err
+	}
+	n, err := notifier()
+	if err != nil {
+		return err
+	}
+	schedule, err := magnet.ParseSchedule(*poll)
+	if err != nil {
+		return err
+	}
+	var lease *vsphere.Lease
+	d := &magnet.Daemon{
+		IaaS:             v,
+		Schedule:         schedule,
+		Logger:           l,
+		Notifier:         n,
+		Timeout:          *pollTimeout,
+		MaxBackoff:       *maxBackoff,
+		FailureThreshold: *failureThreshold,
+		DrainTimeout:     *drainTimeout,
+		Limits: &magnet.Limits{
+			MaxAdded:           *maxAdded,
+			MaxRemoved:         *maxRemoved,
+			MaxRemovedFraction: *maxRemovedFraction,
+			MaxVMDrop:          *maxVMDrop,
+			AcceptVMDropAfter:  *acceptVMDropAfter,
+		},
 	}
-	os.Exit(0)
+	if selected != nil {
+		d.Jobs = &selected.Jobs
+		d.Policies = selected.Policies
+	}
+	d.Reload = func() (*magnet.DaemonConfig, error) {
+		// check the whole configuration before replacing any of it
+		t, err := reloadTarget()
+		if err != nil {
+			return nil, err
+		}
+		v, err := iaasFor(t, l)
+		if err != nil {
+			return nil, err
+		}
+		c := &magnet.DaemonConfig{IaaS: v}
+		if t != nil {
+			c.Jobs = &t.Jobs
+			c.Policies = t.Policies
+		}
+		if lease != nil {
+			vs, ok := v.(*vsphere.IaaS)
+			if !ok {
+				return nil, errors.New("-leader-election vcenter requires a vSphere target")
+			}
+			c.Elector = &vsphere.Lease{IaaS: vs, Holder: lease.Holder, TTL: lease.TTL, Attribute: lease.Attribute}
+		}
+		selected = t
+		return c, nil
+	}
+	if *act != "" {
+		if d.ActSchedule, err = magnet.ParseSchedule(*act); err != nil {
+			return err
+		}
+	}
+	if *quietHours != "" {
+		if d.QuietHours, err = magnet.ParseCron(*quietHours); err != nil {
+			return err
+		}
+	}
+	switch *leaderElection {
+	case "":
+	case "vcenter":
+		vs, ok := v.(*vsphere.IaaS)
+		if !ok {
+			return errors.New("-leader-election vcenter requires a vSphere target")
+		}
+		lease = &vsphere.Lease{IaaS: vs, Holder: *leaderID, TTL: *leaderLease}
+		d.Elector = lease
+	case "file":
+		d.Elector = &magnet.FileLock{Path: *leaderLock}
+	default:
+		return fmt.Errorf("unknown leader election %q", *leaderElection)
+	}
+	if *requireApproval {
+		d.Proposals = newStore()
+	}
+	if *listen != "" {
+		srv := &magnet.Server{Daemon: d, Proposals: d.Proposals, ApprovalToken: magnet.Secret(os.Getenv("MAGNET_APPROVAL_TOKEN"))}
+		go func() {
+			l.Info("serving HTTP API", "addr", *listen)
+			if err := http.ListenAndServe(*listen, srv); err != nil {
+				l.Error("HTTP API stopped", "err", err)
+			}
+		}()
+	}
+	return d.Run(context.Background())
+}
+
+// newLogger creates a Logger from the logging flags.
+func newLogger() (magnet.Logger, error) {
+	level, err := magnet.ParseLevel(*logLevel)
+	if err != nil {
+		return nil, err
+	}
+	return magnet.NewLogger(os.Stderr, *logFormat, level)
+}
+
+// The IaaSes that -iaas selects.
+const (
+	iaasVSphere   = "vsphere"
+	iaasOpenStack = "openstack"
+	iaasAWS       = "aws"
+	iaasProxmox   = "proxmox"
+)
+
+// newIaaS creates the IaaS for the selected target.
+func newIaaS(l magnet.Logger) (magnet.IaaS, error) {
+	return iaasFor(selected, l)
+}
+
+// iaasFor creates the IaaS for t, or configured by the environment
+// if t is nil.
+func iaasFor(t *target, l magnet.Logger) (magnet.IaaS, error) {
+	b := boshFromEnv(nil)
+	if t != nil {
+		b = t.BOSH
+	}
+	var instances magnet.InstanceSource
+	if b != nil {
+		d, err := b.Director()
+		if err != nil {
+			return nil, err
+		}
+		instances = d
+	}
+
+	switch t.kind() {
+	case iaasOpenStack:
+		return newOpenStack(t, instances, l)
+	case iaasAWS:
+		return newAWS(t, instances, l)
+	case iaasProxmox:
+		return newProxmox(t, instances, l)
+	}
+	return newVSphere(t, instances, l)
+}
+
+// newVSphere creates a vSphere IaaS for t that audits and backs up
+// its changes.
+func newVSphere(t *target, instances magnet.InstanceSource, l magnet.Logger) (magnet.IaaS, error) {
+	var v *vsphere.IaaS
+	var err error
+	if t != nil {
+		v, err = vsphere.NewFromConfig(t.VSphere, l.With("target", t.Name))
+	} else {
+		v, err = vsphere.New(l)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *forbidInsecure && v.Unverified() {
+		return nil, errInsecure
+	}
+	v.Auditor = &magnet.AuditLog{Path: *auditLog}
+	v.Backups = &vsphere.BackupStore{Dir: *backupsDir}
+	v.ApplyRecommendations = *applyDRS
+	v.MigrationTimeout = *migrationTimeout
+	v.Instances = instances
+	return v, nil
+}
+
+// newOpenStack creates an OpenStack IaaS for t that audits its changes.
+func newOpenStack(t *target, instances magnet.InstanceSource, l magnet.Logger) (magnet.IaaS, error) {
+	var o *openstack.IaaS
+	var err error
+	if t != nil {
+		o, err = openstack.NewFromConfig(*t.OpenStack, l.With("target", t.Name))
+	} else {
+		o, err = openstack.New(l)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *forbidInsecure && o.Unverified() {
+		return nil, errInsecure
+	}
+	o.Auditor = &magnet.AuditLog{Path: *auditLog}
+	o.Instances = instances
+	return o, nil
 }
 
+// newAWS creates an AWS IaaS for t that audits its changes.
+func newAWS(t *target, instances magnet.InstanceSource, l magnet.Logger) (magnet.IaaS, error) {
+	var a *aws.IaaS
+	var err error
+	if t != nil {
+		a, err = aws.NewFromConfig(*t.AWS, l.With("target", t.Name))
+	} else {
+		a, err = aws.New(l)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *forbidInsecure && a.Unverified() {
+		return nil, errInsecure
+	}
+	a.Auditor = &magnet.AuditLog{Path: *auditLog}
+	a.Instances = instances
+	return a, nil
+}
+
+// newProxmox creates a Proxmox VE IaaS for t that audits its changes.
+func newProxmox(t *target, instances magnet.InstanceSource, l magnet.Logger) (magnet.IaaS, error) {
+	var p *proxmox.IaaS
+	var err error
+	if t != nil {
+		p, err = proxmox.NewFromConfig(*t.Proxmox, l.With("target", t.Name))
+	} else {
+		p, err = proxmox.New(l)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *forbidInsecure && p.Unverified() {
+		return nil, errInsecure
+	}
+	p.Auditor = &magnet.AuditLog{Path: *auditLog}
+	p.MigrationTimeout = *migrationTimeout
+	p.Instances = instances
+	return p, nil
+}
+
+var errInsecure = errors.New("-forbid-insecure is set, but the IaaS's certificate would not be verified (insecure or http)")
+
 func printVersion() {
 	fmt.Println(Version)
 }
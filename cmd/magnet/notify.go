@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/notify"
+)
+
+// notifier builds a Notifier from the notification flags.
+// SMTP credentials are read from MAGNET_SMTP_USERNAME and
+// MAGNET_SMTP_PASSWORD.  It returns nil if no notifiers are configured.
+func notifier() (magnet.Notifier, error) {
+	var ns []magnet.Notifier
+	if *notifyWebhook != "" {
+		ns = append(ns, &notify.Webhook{URL: *notifyWebhook})
+	}
+	if *notifySlack != "" {
+		ns = append(ns, &notify.Slack{URL: *notifySlack})
+	}
+	if *notifySMTP != "" {
+		to := splitList(*notifyTo)
+		if len(to) == 0 {
+			return nil, errors.New("-notify-smtp-to is required when -notify-smtp is set")
+		}
+		ns = append(ns, &notify.SMTP{
+			Addr:     *notifySMTP,
+			From:     *notifyFrom,
+			To:       to,
+			Username: os.Getenv("MAGNET_SMTP_USERNAME"),
+			Password: magnet.Secret(os.Getenv("MAGNET_SMTP_PASSWORD")),
+		})
+	}
+	if len(ns) == 0 {
+		return nil, nil
+	}
+
+	var types []magnet.EventType
+	for _, s := range splitList(*notifyEvents) {
+		t, err := magnet.ParseEventType(s)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	// deduplicate each notifier separately, so that one failing
+	// notifier doesn't make the others repeat every event
+	for i, n := range ns {
+		ns[i] = notify.Dedup(notify.Filter(n, types...), *notifyDedup)
+	}
+	if len(ns) == 1 {
+		return ns[0], nil
+	}
+	return notify.Multi(ns...), nil
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// proposals lists the proposals in the store.
+func proposals(args []string) error {
+	commandFlags("proposals").Parse(args)
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	ps, err := newStore().List()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 8, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "ID\tSTATUS\tAPPROVED\tCREATED\tEXPIRES\tADD\tREMOVE")
+	for _, p := range ps {
+		var add, remove int
+		if rec := p.Report.Recommendations; rec != nil {
+			add, remove = len(rec.Missing), len(rec.Stale)
+		}
+		expires := "never"
+		if !p.Expires.IsZero() {
+			expires = p.Expires.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\t%d\t%d\n", p.ID, p.Status, p.Approved,
+			p.Created.Local().Format(time.RFC3339), expires, add, remove)
+	}
+	return nil
+}
+
+// approve approves the proposal whose ID is the first of args.
+func approve(args []string) error {
+	fs := commandFlags("approve")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("no proposal specified")
+	}
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	id := fs.Arg(0)
+	if err := newStore().Approve(id); err != nil {
+		return fmt.Errorf("proposal %s: %v", id, err)
+	}
+	fmt.Printf("Approved proposal %s.  It will be applied at the next check if the deployment is unchanged.\n", id)
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pivotalservices/magnet/vsphere"
+)
+
+const rulesUsage = `Usage: magnet rules <command>
+
+Commands:
+  list                 list the cluster's rules
+  backup               snapshot the cluster's rules
+  history              list snapshots of the cluster's rules
+  restore <version>    replace the cluster's rules with a snapshot
+`
+
+// rules runs one of the rules subcommands.
+func rules(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, rulesUsage)
+		return errors.New("no rules command specified")
+	}
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stderr, rulesUsage)
+		return nil
+	case "list":
+		return rulesList(args[1:])
+	case "backup":
+		return rulesBackup(args[1:])
+	case "history":
+		return rulesHistory(args[1:])
+	case "restore":
+		return rulesRestore(args[1:])
+	}
+	fmt.Fprint(os.Stderr, rulesUsage)
+	return fmt.Errorf("unknown rules command %q", args[0])
+}
+
+// rulesIaaS creates the vSphere IaaS that the backup subcommands of
+// rules need, once their flags are parsed.
+func rulesIaaS(command string) (*vsphere.IaaS, error) {
+	if err := checkConfig(); err != nil {
+		return nil, err
+	}
+	l, err := newLogger()
+	if err != nil {
+		return nil, err
+	}
+	i, err := newIaaS(l)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := i.(*vsphere.IaaS)
+	if !ok {
+		return nil, fmt.Errorf("rules %s is only supported on vSphere", command)
+	}
+	return v, nil
+}
+
+func rulesBackup(args []string) error {
+	commandFlags("rules backup").Parse(args)
+	v, err := rulesIaaS("backup")
+	if err != nil {
+		return err
+	}
+	s, err := v.Backup(context.Background(), "manual")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved version %d (%d rules, %d groups)\n", s.Version, len(s.Rules), len(s.Groups))
+	return nil
+}
+
+func rulesHistory(args []string) error {
+	fs := commandFlags("rules history")
+	from := fs.String("cluster", "", "name of the cluster whose snapshots to list (default the configured cluster)")
+	fs.Parse(args)
+	v, err := rulesIaaS("history")
+	if err != nil {
+		return err
+	}
+	if *from == "" {
+		*from = v.ClusterName()
+	}
+
+	history, err := v.Backups.History(*from)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 8, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "VERSION\tTIME\tCLUSTER\tRULES\tGROUPS\tREASON")
+	for _, s := range history {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\n", s.Version, s.Time.Local().Format(time.RFC3339),
+			s.Cluster, len(s.Rules), len(s.Groups), s.Reason)
+	}
+	return nil
+}
+
+func rulesRestore(args []string) error {
+	fs := commandFlags("rules restore")
+	from := fs.String("cluster", "", "name of the cluster whose snapshot to restore, e.g. after disaster recovery (default the configured cluster)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("no version specified")
+	}
+	version, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid version %q", fs.Arg(0))
+	}
+	v, err := rulesIaaS("restore")
+	if err != nil {
+		return err
+	}
+	if *from == "" {
+		*from = v.ClusterName()
+	}
+
+	s, err := v.Backups.Get(*from, version)
+	if err != nil {
+		return err
+	}
+	if err = v.Restore(context.Background(), s); err != nil {
+		return err
+	}
+	fmt.Printf("Restored version %d (%d rules, %d groups)\n", s.Version, len(s.Rules), len(s.Groups))
+	return nil
+}
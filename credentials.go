@@ -0,0 +1,67 @@
+package magnet
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// redacted replaces secrets wherever they would be printed.
+const redacted = "REDACTED"
+
+// Secret is a string, such as a password or token, that is redacted when
+// it is printed, logged or encoded.  Convert it to a string to use it.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// GoString redacts s when it is printed with %#v.
+func (s Secret) GoString() string {
+	return `"` + s.String() + `"`
+}
+
+// MarshalJSON redacts s when it is encoded as JSON.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// MarshalYAML redacts s when it is encoded as YAML.
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// Redact replaces each of the secrets in msg.
+func Redact(msg string, secrets ...Secret) string {
+	for _, s := range secrets {
+		if s != "" {
+			msg = strings.Replace(msg, string(s), redacted, -1)
+		}
+	}
+	return msg
+}
+
+// Credentials are the username and password used to log in to an IaaS.
+type Credentials struct {
+	Username string
+	Password Secret
+}
+
+// CredentialProvider supplies the credentials for an IaaS.  An IaaS asks
+// for credentials each time it starts a session, so that credentials that
+// are rotated while magnet is running are picked up by the next session.
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// StaticCredentials is a CredentialProvider whose credentials never change.
+type StaticCredentials Credentials
+
+// Credentials returns c.
+func (c StaticCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	return Credentials(c), nil
+}
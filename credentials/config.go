@@ -0,0 +1,84 @@
+package credentials
+
+import (
+	"errors"
+	"os"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// Config selects and configures one of the providers in this package.
+type Config struct {
+	File    string   `yaml:"file"`
+	Exec    []string `yaml:"exec"`
+	CredHub *CredHub `yaml:"credhub"`
+	Vault   *Vault   `yaml:"vault"`
+}
+
+// Validate returns every problem with c.
+func (c *Config) Validate() []error {
+	var errs []error
+	sources := 0
+	if c.File != "" {
+		sources++
+	}
+	if len(c.Exec) > 0 {
+		sources++
+	}
+	if c.CredHub != nil {
+		sources++
+		if c.CredHub.Name == "" {
+			errs = append(errs, errors.New("credhub: name is required"))
+		}
+		if c.CredHub.URL == "" && os.Getenv("CREDHUB_SERVER") == "" {
+			errs = append(errs, errors.New("credhub: url is required (or set CREDHUB_SERVER)"))
+		}
+	}
+	if c.Vault != nil {
+		sources++
+		if c.Vault.Path == "" {
+			errs = append(errs, errors.New("vault: path is required"))
+		}
+		if c.Vault.URL == "" && os.Getenv("VAULT_ADDR") == "" {
+			errs = append(errs, errors.New("vault: url is required (or set VAULT_ADDR)"))
+		}
+	}
+	if sources != 1 {
+		errs = append(errs, errors.New("exactly one of file, exec, credhub or vault is required"))
+	}
+	return errs
+}
+
+// Provider creates the configured provider.  username is used if the
+// source only supplies a password.  The CredHub and Vault URLs and
+// tokens default to the CREDHUB_SERVER, CREDHUB_TOKEN, VAULT_ADDR and
+// VAULT_TOKEN environment variables.
+func (c *Config) Provider(username string) (magnet.CredentialProvider, error) {
+	if errs := c.Validate(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	switch {
+	case c.File != "":
+		return &File{Path: c.File, Username: username}, nil
+	case len(c.Exec) > 0:
+		return &Exec{Command: c.Exec, Username: username}, nil
+	case c.CredHub != nil:
+		p := *c.CredHub
+		setDefault(&p.URL, os.Getenv("CREDHUB_SERVER"))
+		setDefault((*string)(&p.Token), os.Getenv("CREDHUB_TOKEN"))
+		setDefault(&p.Username, username)
+		return &p, nil
+	default:
+		p := *c.Vault
+		setDefault(&p.URL, os.Getenv("VAULT_ADDR"))
+		setDefault((*string)(&p.Token), os.Getenv("VAULT_TOKEN"))
+		setDefault(&p.Username, username)
+		return &p, nil
+	}
+}
+
+func setDefault(s *string, v string) {
+	if *s == "" {
+		*s = v
+	}
+}
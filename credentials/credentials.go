@@ -0,0 +1,119 @@
+// Package credentials contains implementations of magnet.CredentialProvider.
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// userPassword is the JSON encoding of a username and password
+// used by files, commands and secret stores.
+type userPassword struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (up userPassword) credentials(username string) (magnet.Credentials, error) {
+	if up.Username != "" {
+		username = up.Username
+	}
+	if up.Password == "" {
+		return magnet.Credentials{}, errors.New("no password")
+	}
+	return magnet.Credentials{Username: username, Password: magnet.Secret(up.Password)}, nil
+}
+
+// Env is a CredentialProvider that reads the username and password
+// from environment variables each time it is asked for them, so that
+// a reloaded env file is picked up.  If UsernameVar isn't set, Username
+// is used.
+type Env struct {
+	UsernameVar string
+	PasswordVar string
+	Username    string
+}
+
+// Credentials reads the environment variables.
+func (e *Env) Credentials(ctx context.Context) (magnet.Credentials, error) {
+	password := os.Getenv(e.PasswordVar)
+	if password == "" {
+		return magnet.Credentials{}, fmt.Errorf("credentials: %s is not set", e.PasswordVar)
+	}
+	username := e.Username
+	if v := os.Getenv(e.UsernameVar); v != "" {
+		username = v
+	}
+	return magnet.Credentials{Username: username, Password: magnet.Secret(password)}, nil
+}
+
+// File is a CredentialProvider that reads a file, such as a mounted
+// secret, each time it is asked for credentials.  The file holds either
+// a JSON object with username and password fields, or just the password,
+// in which case Username is used.
+type File struct {
+	Path     string
+	Username string
+}
+
+// Credentials reads the file.
+func (f *File) Credentials(ctx context.Context) (magnet.Credentials, error) {
+	b, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return magnet.Credentials{}, fmt.Errorf("credentials: %v", err)
+	}
+	content := strings.TrimSpace(string(b))
+	up := userPassword{Password: content}
+	if strings.HasPrefix(content, "{") {
+		up = userPassword{}
+		if err = json.Unmarshal(b, &up); err != nil {
+			return magnet.Credentials{}, fmt.Errorf("credentials: %s is not valid JSON", f.Path)
+		}
+	}
+	c, err := up.credentials(f.Username)
+	if err != nil {
+		return c, fmt.Errorf("credentials: %s: %v", f.Path, err)
+	}
+	return c, nil
+}
+
+// Exec is a CredentialProvider that runs a command each time it is
+// asked for credentials.  The command must print a JSON object with
+// username and password fields; if username is omitted, Username is
+// used.
+type Exec struct {
+	Command  []string
+	Username string
+}
+
+// Credentials runs the command.
+func (e *Exec) Credentials(ctx context.Context) (magnet.Credentials, error) {
+	if len(e.Command) == 0 {
+		return magnet.Credentials{}, errors.New("credentials: no command")
+	}
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return magnet.Credentials{}, fmt.Errorf("credentials: %s: %v: %s", e.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	var up userPassword
+	if err = json.Unmarshal(out, &up); err != nil {
+		// don't include the output, it may be the password
+		return magnet.Credentials{}, fmt.Errorf("credentials: %s didn't print a JSON object", e.Command[0])
+	}
+	c, err := up.credentials(e.Username)
+	if err != nil {
+		return c, fmt.Errorf("credentials: %s: %v", e.Command[0], err)
+	}
+	return c, nil
+}
@@ -0,0 +1,195 @@
+package credentials_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/credentials"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Env", func() {
+	AfterEach(func() {
+		os.Unsetenv("MAGNET_TEST_USERNAME")
+		os.Unsetenv("MAGNET_TEST_PASSWORD")
+	})
+
+	It("reads the variables each time", func() {
+		e := &credentials.Env{UsernameVar: "MAGNET_TEST_USERNAME", PasswordVar: "MAGNET_TEST_PASSWORD", Username: "admin"}
+		_, err := e.Credentials(context.Background())
+		Ω(err).Should(MatchError("credentials: MAGNET_TEST_PASSWORD is not set"))
+
+		os.Setenv("MAGNET_TEST_PASSWORD", "secret")
+		c, err := e.Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c).Should(Equal(magnet.Credentials{Username: "admin", Password: "secret"}))
+
+		os.Setenv("MAGNET_TEST_USERNAME", "magnet")
+		c, err = e.Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.Username).Should(Equal("magnet"))
+	})
+})
+
+var _ = Describe("File", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "credentials")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("reads a bare password, re-reading it each time", func() {
+		path := filepath.Join(dir, "password")
+		Ω(ioutil.WriteFile(path, []byte("first\n"), 0600)).Should(Succeed())
+		f := &credentials.File{Path: path, Username: "admin"}
+		c, err := f.Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c).Should(Equal(magnet.Credentials{Username: "admin", Password: "first"}))
+
+		Ω(ioutil.WriteFile(path, []byte("second"), 0600)).Should(Succeed())
+		c, err = f.Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.Password).Should(Equal(magnet.Secret("second")))
+	})
+
+	It("reads a username and password", func() {
+		path := filepath.Join(dir, "credentials.json")
+		Ω(ioutil.WriteFile(path, []byte(`{"username": "magnet", "password": "secret"}`), 0600)).Should(Succeed())
+		c, err := (&credentials.File{Path: path, Username: "admin"}).Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c).Should(Equal(magnet.Credentials{Username: "magnet", Password: "secret"}))
+	})
+
+	It("doesn't print the contents of an invalid file", func() {
+		path := filepath.Join(dir, "credentials.json")
+		Ω(ioutil.WriteFile(path, []byte(`{"password": "secret"`), 0600)).Should(Succeed())
+		_, err := (&credentials.File{Path: path}).Credentials(context.Background())
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).ShouldNot(ContainSubstring("secret"))
+	})
+})
+
+var _ = Describe("Exec", func() {
+	BeforeEach(func() {
+		if runtime.GOOS == "windows" {
+			Skip("uses sh")
+		}
+	})
+
+	It("reads the command's output", func() {
+		e := &credentials.Exec{Command: []string{"sh", "-c", `echo '{"password": "secret"}'`}, Username: "admin"}
+		c, err := e.Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c).Should(Equal(magnet.Credentials{Username: "admin", Password: "secret"}))
+	})
+
+	It("reports the command's errors", func() {
+		e := &credentials.Exec{Command: []string{"sh", "-c", "echo locked >&2; exit 1"}}
+		_, err := e.Credentials(context.Background())
+		Ω(err).Should(MatchError(ContainSubstring("locked")))
+	})
+
+	It("doesn't print output that isn't JSON", func() {
+		e := &credentials.Exec{Command: []string{"echo", "secret"}}
+		_, err := e.Credentials(context.Background())
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).ShouldNot(ContainSubstring("secret"))
+	})
+})
+
+var _ = Describe("CredHub", func() {
+	var server *httptest.Server
+	var response string
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			Ω(r.URL.Path).Should(Equal("/api/v1/data"))
+			Ω(r.URL.Query().Get("name")).Should(Equal("/magnet/vcenter"))
+			w.Write([]byte(response))
+		}))
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("reads a user credential", func() {
+		response = `{"data": [{"type": "user", "value": {"username": "magnet", "password": "secret", "password_hash": "x"}}]}`
+		c, err := (&credentials.CredHub{URL: server.URL, Name: "/magnet/vcenter", Token: "token"}).Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c).Should(Equal(magnet.Credentials{Username: "magnet", Password: "secret"}))
+	})
+
+	It("reads a password credential", func() {
+		response = `{"data": [{"type": "password", "value": "secret"}]}`
+		c, err := (&credentials.CredHub{URL: server.URL, Name: "/magnet/vcenter", Token: "token", Username: "admin"}).Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c).Should(Equal(magnet.Credentials{Username: "admin", Password: "secret"}))
+	})
+
+	It("reports errors", func() {
+		_, err := (&credentials.CredHub{URL: server.URL, Name: "/magnet/vcenter", Token: "wrong"}).Credentials(context.Background())
+		Ω(err).Should(MatchError(ContainSubstring("401")))
+	})
+})
+
+var _ = Describe("Vault", func() {
+	var server *httptest.Server
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Ω(r.Header.Get("X-Vault-Token")).Should(Equal("token"))
+			switch r.URL.Path {
+			case "/v1/secret/data/magnet":
+				w.Write([]byte(`{"data": {"data": {"username": "magnet", "password": "v2"}, "metadata": {}}}`))
+			case "/v1/secret/magnet":
+				w.Write([]byte(`{"data": {"password": "v1"}}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("reads version 2 key/value secrets", func() {
+		c, err := (&credentials.Vault{URL: server.URL, Path: "secret/data/magnet", Token: "token"}).Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c).Should(Equal(magnet.Credentials{Username: "magnet", Password: "v2"}))
+	})
+
+	It("reads version 1 key/value secrets", func() {
+		c, err := (&credentials.Vault{URL: server.URL, Path: "secret/magnet", Token: "token", Username: "admin"}).Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c).Should(Equal(magnet.Credentials{Username: "admin", Password: "v1"}))
+	})
+})
+
+var _ = Describe("Config", func() {
+	It("requires exactly one source", func() {
+		Ω((&credentials.Config{}).Validate()).Should(HaveLen(1))
+		Ω((&credentials.Config{File: "a", Exec: []string{"b"}}).Validate()).Should(HaveLen(1))
+		Ω((&credentials.Config{File: "a"}).Validate()).Should(BeEmpty())
+	})
+
+	It("creates the configured provider", func() {
+		p, err := (&credentials.Config{Vault: &credentials.Vault{URL: "https://vault", Path: "secret/magnet"}}).Provider("admin")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p).Should(BeAssignableToTypeOf(&credentials.Vault{}))
+		Ω(p.(*credentials.Vault).Username).Should(Equal("admin"))
+	})
+})
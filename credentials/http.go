@@ -0,0 +1,130 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// defaultClient is used by providers that aren't given an *http.Client.
+var defaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// CredHub is a CredentialProvider that fetches the current value of a
+// credential from a CredHub-compatible server.  The credential may be a
+// user credential, or a password or value credential, in which case
+// Username is used.
+type CredHub struct {
+	URL      string        `yaml:"url"`
+	Name     string        `yaml:"name"`
+	Token    magnet.Secret `yaml:"token"` // a UAA access token
+	Username string        `yaml:"username"`
+	Client   *http.Client  `yaml:"-"`
+}
+
+// Credentials fetches the credential.
+func (c *CredHub) Credentials(ctx context.Context) (magnet.Credentials, error) {
+	u := strings.TrimSuffix(c.URL, "/") + "/api/v1/data?current=true&name=" + url.QueryEscape(c.Name)
+	var resp struct {
+		Data []struct {
+			Type  string          `json:"type"`
+			Value json.RawMessage `json:"value"`
+		} `json:"data"`
+	}
+	if err := getJSON(ctx, c.Client, u, "Authorization", "Bearer "+string(c.Token), &resp); err != nil {
+		return magnet.Credentials{}, err
+	}
+	if len(resp.Data) == 0 {
+		return magnet.Credentials{}, fmt.Errorf("credentials: credhub has no credential %q", c.Name)
+	}
+
+	up := userPassword{}
+	switch v := resp.Data[0]; v.Type {
+	case "user":
+		err := json.Unmarshal(v.Value, &up)
+		if err != nil {
+			return magnet.Credentials{}, fmt.Errorf("credentials: credhub credential %q: %v", c.Name, err)
+		}
+	case "password", "value":
+		if err := json.Unmarshal(v.Value, &up.Password); err != nil {
+			return magnet.Credentials{}, fmt.Errorf("credentials: credhub credential %q is not a string", c.Name)
+		}
+	default:
+		return magnet.Credentials{}, fmt.Errorf("credentials: credhub credential %q has unsupported type %q", c.Name, v.Type)
+	}
+	creds, err := up.credentials(c.Username)
+	if err != nil {
+		return creds, fmt.Errorf("credentials: credhub credential %q: %v", c.Name, err)
+	}
+	return creds, nil
+}
+
+// Vault is a CredentialProvider that reads a secret with username and
+// password fields from a Vault-compatible server.  Path is the API path
+// of the secret, for example secret/data/magnet for version 2 of the
+// key/value secrets engine or secret/magnet for version 1.
+type Vault struct {
+	URL      string        `yaml:"url"`
+	Path     string        `yaml:"path"`
+	Token    magnet.Secret `yaml:"token"`
+	Username string        `yaml:"username"`
+	Client   *http.Client  `yaml:"-"`
+}
+
+// Credentials reads the secret.
+func (v *Vault) Credentials(ctx context.Context) (magnet.Credentials, error) {
+	u := strings.TrimSuffix(v.URL, "/") + "/v1/" + strings.TrimPrefix(v.Path, "/")
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := getJSON(ctx, v.Client, u, "X-Vault-Token", string(v.Token), &resp); err != nil {
+		return magnet.Credentials{}, err
+	}
+
+	// version 2 of the key/value engine nests the secret in data.data
+	var kv2 struct {
+		Data *userPassword `json:"data"`
+	}
+	var up userPassword
+	if err := json.Unmarshal(resp.Data, &kv2); err == nil && kv2.Data != nil {
+		up = *kv2.Data
+	} else if err = json.Unmarshal(resp.Data, &up); err != nil {
+		return magnet.Credentials{}, fmt.Errorf("credentials: vault secret %q has no username and password", v.Path)
+	}
+	creds, err := up.credentials(v.Username)
+	if err != nil {
+		return creds, fmt.Errorf("credentials: vault secret %q: %v", v.Path, err)
+	}
+	return creds, nil
+}
+
+// getJSON GETs u with an authentication header, and decodes the
+// response into v.
+func getJSON(ctx context.Context, client *http.Client, u, header, value string, v interface{}) error {
+	if client == nil {
+		client = defaultClient
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(header, value)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("credentials: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("credentials: GET %s: %s", req.URL.Path, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("credentials: GET %s: %v", req.URL.Path, err)
+	}
+	return nil
+}
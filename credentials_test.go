@@ -0,0 +1,46 @@
+package magnet_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pivotalservices/magnet"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Secret", func() {
+	type config struct {
+		Username string
+		Password magnet.Secret
+	}
+	c := config{Username: "admin", Password: "hunter2"}
+
+	It("is redacted when printed", func() {
+		for _, format := range []string{"%s", "%v", "%+v", "%#v"} {
+			Ω(fmt.Sprintf(format, c)).ShouldNot(ContainSubstring("hunter2"), format)
+		}
+		Ω(fmt.Sprint(magnet.Secret(""))).Should(BeEmpty())
+	})
+
+	It("is redacted when encoded", func() {
+		b, err := json.Marshal(c)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(b)).Should(Equal(`{"Username":"admin","Password":"REDACTED"}`))
+	})
+
+	It("is redacted from messages", func() {
+		Ω(magnet.Redact("login hunter2 failed", "hunter2", "")).Should(Equal("login REDACTED failed"))
+	})
+
+	It("is redacted when logged", func() {
+		buf := &bytes.Buffer{}
+		l, err := magnet.NewLogger(buf, magnet.FormatLogfmt, magnet.LevelInfo)
+		Ω(err).ShouldNot(HaveOccurred())
+		l.Info("logging in", "config", c, "vault_token", "s.abc")
+		Ω(buf.String()).ShouldNot(ContainSubstring("hunter2"))
+		Ω(buf.String()).ShouldNot(ContainSubstring("s.abc"))
+	})
+})
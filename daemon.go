@@ -2,8 +2,10 @@ package magnet
 
 import (
 	"context"
+	"math/rand"
 	"os"
 	"os/signal"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -11,48 +13,457 @@ import (
 // Daemon wraps up the logic for periodically
 // checking and rebalancing a deployment.
 type Daemon struct {
-	IaaS    IaaS
-	Period  int
+	IaaS     IaaS
+	Logger   Logger
+	Notifier Notifier
+
+	// Period is the interval between polls when Schedule is nil.
+	Period time.Duration
+
+	// Schedule, if non-nil, determines when the daemon polls the IaaS.
+	Schedule Schedule
+
+	// ActSchedule, if non-nil, determines when the daemon applies its
+	// recommendations.  Polls between scheduled actions only observe the
+	// deployment: they report and notify but don't change any rules.  A
+	// poll acts if an action was scheduled at or before it, so the action
+	// is taken by the first poll after it is due.  If ActSchedule is nil,
+	// every poll acts.
+	ActSchedule Schedule
+
+	// QuietHours, if non-nil, prevents the daemon from acting during
+	// the minutes it matches.
+	QuietHours *Cron
+
+	// Jobs, if non-nil, restricts the jobs that the daemon manages.
+	Jobs *JobFilter
+
+	// Policies sets the policies of jobs that the IaaS doesn't.
+	Policies Policies
+
+	// Elector, if non-nil, elects a leader among daemons that manage
+	// the same deployment.  Only the leader acts and sends notifications
+	// about the deployment; the others only observe it.
+	Elector Elector
+
+	// Proposals, if non-nil, requires recommendations to be
+	// approved before the daemon applies them.
+	Proposals *ProposalStore
+
+	// Limits, if non-nil, bounds the changes made by each poll.
+	Limits *Limits
+
+	// Timeout bounds how long each poll may take, not counting the
+	// MigrationBudget of an IaaS that is a Migrator.
+	// It defaults to DefaultPollTimeout.
+	Timeout time.Duration
+
+	// MaxBackoff is the longest the daemon will wait between polls
+	// after consecutive failures.  It defaults to DefaultMaxBackoff.
+	MaxBackoff time.Duration
+
+	// FailureThreshold is the number of consecutive failed polls after
+	// which the daemon is no longer ready and an EventPollFailing
+	// notification is sent.  Zero disables the threshold.
+	FailureThreshold int
+
+	// DrainTimeout is how long a shutdown signal waits for an in-flight
+	// poll to finish before cancelling it.  It defaults to
+	// DefaultDrainTimeout.
+	DrainTimeout time.Duration
+
+	// Reload, if non-nil, is called when the process receives a reload
+	// signal (SIGHUP).  The configuration it returns is used for
+	// subsequent polls.  If it returns an error, the daemon keeps its
+	// current configuration.
+	Reload func() (*DaemonConfig, error)
+
 	running int32
+
+	mu      sync.Mutex
+	status  DaemonStatus
+	signals chan os.Signal
+	nextAct time.Time
+}
+
+// DaemonConfig is the part of a Daemon's configuration that Reload
+// replaces.
+type DaemonConfig struct {
+	IaaS     IaaS
+	Jobs     *JobFilter
+	Policies Policies
+
+	// Elector, if non-nil, replaces the daemon's Elector.
+	Elector Elector
+}
+
+// current returns the daemon's configuration, which reload may replace
+// while the daemon runs.
+func (d *Daemon) current() DaemonConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DaemonConfig{IaaS: d.IaaS, Jobs: d.Jobs, Policies: d.Policies, Elector: d.Elector}
+}
+
+// Defaults for the Daemon's optional settings.
+const (
+	DefaultPollTimeout  = 60 * time.Second
+	DefaultMaxBackoff   = time.Hour
+	DefaultDrainTimeout = 30 * time.Second
+)
+
+// DaemonStatus describes the outcome of the daemon's recent polls.
+type DaemonStatus struct {
+	Ready               bool      `json:"ready"`
+	Leader              bool      `json:"leader"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastPoll            time.Time `json:"last_poll"`
+	LastSuccess         time.Time `json:"last_success"`
+}
+
+// Status returns the outcome of the daemon's recent polls.
+func (d *Daemon) Status() DaemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := d.status
+	s.Ready = !s.LastPoll.IsZero() && (d.FailureThreshold <= 0 || s.ConsecutiveFailures < d.FailureThreshold)
+	return s
+}
+
+// record updates the daemon's status with the outcome of a poll, and
+// sends a notification when the failure threshold is crossed in
+// either direction.
+func (d *Daemon) record(ctx context.Context, err error) {
+	d.mu.Lock()
+	now := time.Now().UTC()
+	d.status.LastPoll = now
+	prevFailures := d.status.ConsecutiveFailures
+	if err != nil {
+		d.status.ConsecutiveFailures++
+		d.status.LastError = err.Error()
+	} else {
+		d.status.ConsecutiveFailures = 0
+		d.status.LastError = ""
+		d.status.LastSuccess = now
+	}
+	failures := d.status.ConsecutiveFailures
+	d.mu.Unlock()
+
+	if d.FailureThreshold <= 0 {
+		return
+	}
+	var e *Event
+	switch {
+	case failures == d.FailureThreshold:
+		d.logger().Error("polls are failing", "failures", failures, "err", err)
+		e = &Event{Type: EventPollFailing, Error: err.Error(), Failures: failures}
+	case failures == 0 && prevFailures >= d.FailureThreshold:
+		d.logger().Info("polls have recovered", "failures", prevFailures)
+		e = &Event{Type: EventPollRecovered, Failures: prevFailures}
+	}
+	if e != nil && d.Notifier != nil {
+		e.Time = now
+		if err := d.Notifier.Notify(ctx, e); err != nil {
+			d.logger().Warn("failed to send notification", "event", e.Type, "err", err)
+		}
+	}
+}
+
+// nextDelay is how long to wait before the next poll.  After
+// consecutive failures the period doubles with each failure, up to
+// MaxBackoff, with up to 20% jitter so that several daemons don't
+// retry a struggling IaaS in lockstep.
+func (d *Daemon) nextDelay() time.Duration {
+	now := time.Now()
+	period := d.schedule().Next(now).Sub(now)
+	failures := d.Status().ConsecutiveFailures
+	if failures == 0 {
+		return period
+	}
+
+	max := d.MaxBackoff
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	delay := period
+	for i := 0; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	return delay - jitter
+}
+
+func (d *Daemon) schedule() Schedule {
+	if d.Schedule == nil {
+		return Every(d.Period)
+	}
+	return d.Schedule
+}
+
+// lead reports whether the daemon is the leader, logging any change.
+// A daemon without an Elector is always the leader.
+func (d *Daemon) lead(ctx context.Context) bool {
+	elector := d.current().Elector
+	leader := true
+	if elector != nil {
+		var err error
+		if leader, err = elector.Acquire(ctx); err != nil {
+			d.logger().Error("failed to acquire leadership, only observing", "err", err)
+			leader = false
+		}
+	}
+
+	d.mu.Lock()
+	changed := leader != d.status.Leader
+	d.status.Leader = leader
+	d.mu.Unlock()
+	if changed && elector != nil {
+		if leader {
+			d.logger().Info("became the leader")
+		} else {
+			d.logger().Info("following another daemon, only observing")
+		}
+	}
+	return leader
+}
+
+// resign releases leadership, if the daemon holds it.
+func (d *Daemon) resign() {
+	elector := d.current().Elector
+	if elector == nil || !d.Status().Leader {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := elector.Release(ctx); err != nil {
+		d.logger().Warn("failed to release leadership", "err", err)
+	}
+	d.mu.Lock()
+	d.status.Leader = false
+	d.mu.Unlock()
+}
+
+// shouldAct reports whether a poll at now should apply recommendations.
+func (d *Daemon) shouldAct(now time.Time) bool {
+	if d.QuietHours != nil && d.QuietHours.Matches(now) {
+		d.logger().Debug("in quiet hours, only observing", "quiet_hours", d.QuietHours.String())
+		return false
+	}
+	if d.ActSchedule == nil {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.nextAct.IsZero() {
+		d.nextAct = d.ActSchedule.Next(now)
+	}
+	return !now.Before(d.nextAct)
+}
+
+// acted schedules the next action after a poll at now applied
+// its recommendations.
+func (d *Daemon) acted(now time.Time) {
+	if d.ActSchedule == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextAct = d.ActSchedule.Next(now)
+}
+
+func (d *Daemon) timeout() time.Duration {
+	if d.Timeout <= 0 {
+		return DefaultPollTimeout
+	}
+	return d.Timeout
+}
+
+func (d *Daemon) logger() Logger {
+	if d.Logger == nil {
+		return NopLogger()
+	}
+	return d.Logger
 }
 
 // Run runs the main daemon loop.  It blocks until
 // one of the following conditions are met:
-//  - the context is cancelled
-//  - the process receives a SIGINT
+//   - the context is cancelled
+//   - the process receives a SIGINT or SIGTERM
+//
+// On SIGINT or SIGTERM, a poll that is in progress is given
+// DrainTimeout to finish before it is cancelled.  SIGHUP calls
+// Reload, and SIGUSR1 polls immediately rather than waiting for
+// the next period.
+//
+// When Run returns, the daemon gives up leadership.
 //
 // If the first check fails, Run terminates and returns
-// the error.  If subsequent checks fail, Run will
-// continue to poll the IaaS and will not return.
+// the error, unless the check only exceeded the Limits.  If
+// subsequent checks fail, Run will continue to poll the IaaS,
+// backing off after each consecutive failure, and will not
+// return.
 func (d *Daemon) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	defer d.resign()
 
-	err := d.Poll(ctx)
-	if err != nil {
-		return err
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, append(shutdownSignals, reloadSignal, triggerSignal)...)
+	defer signal.Stop(sigs)
+	d.mu.Lock()
+	d.signals = sigs
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.signals = nil
+		d.mu.Unlock()
+	}()
+
+	// polls run in the background so that signals are handled while
+	// a poll is in progress
+	pollCtx, cancelPoll := context.WithCancel(ctx)
+	defer cancelPoll()
+	done := make(chan error, 1)
+	polling := false
+	poll := func() {
+		polling = true
+		go func() { done <- d.pollWithTimeout(pollCtx) }()
 	}
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
+	var (
+		first        = true
+		reload       bool
+		next, drain  <-chan time.Time
+		shuttingDown bool
+	)
+	poll()
 	for {
 		select {
 		case <-ctx.Done():
-			err = ctx.Err()
+			// don't give up leadership while a poll might still
+			// be changing the deployment
+			if polling {
+				<-done
+			}
+			err := ctx.Err()
 			if err == context.Canceled {
 				return nil
 			}
 			return err
-		case <-time.After(time.Duration(d.Period) * time.Minute):
-			ctx2, cancel2 := context.WithTimeout(ctx, 60*time.Second)
-			defer cancel2()
-			d.Poll(ctx2)
-		case <-c:
-			cancel()
+		case err := <-done:
+			polling = false
+			if first {
+				first = false
+				// a restart mustn't end the wait for the VMs to return
+				if _, limited := err.(*LimitError); err != nil && !limited {
+					return err
+				}
+			}
+			if shuttingDown {
+				return nil
+			}
+			if reload {
+				reload = false
+				d.reload()
+			}
+			next = time.After(d.nextDelay())
+		case <-next:
+			poll()
+		case <-drain:
+			d.logger().Warn("cancelling check in progress", "timeout", d.drainTimeout())
+			cancelPoll()
+			<-done
+			return nil
+		case sig := <-sigs:
+			switch {
+			case sig == reloadSignal:
+				// reload between polls so an in-flight poll keeps a
+				// consistent IaaS
+				if polling {
+					reload = true
+				} else {
+					d.reload()
+				}
+			case sig == triggerSignal:
+				if polling {
+					d.logger().Debug("check already in progress, ignoring trigger")
+					continue
+				}
+				d.logger().Info("received trigger, checking now")
+				next = nil
+				poll()
+			case shuttingDown:
+				// a second shutdown signal doesn't extend the deadline
+			default:
+				d.logger().Info("received shutdown signal", "signal", sig.String())
+				if !polling {
+					return nil
+				}
+				shuttingDown = true
+				next = nil
+				drain = time.After(d.drainTimeout())
+			}
 		}
 	}
 }
 
+// Signal handles sig as if the process had received it, so that
+// a daemon embedded in another program can be shut down, reloaded
+// or triggered.  It has no effect unless Run is running.
+func (d *Daemon) Signal(sig os.Signal) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.signals == nil {
+		return
+	}
+	select {
+	case d.signals <- sig:
+	default:
+	}
+}
+
+// reload replaces the daemon's configuration with the one returned by
+// Reload.
+func (d *Daemon) reload() {
+	if d.Reload == nil {
+		d.logger().Debug("reloading is not configured, ignoring reload signal")
+		return
+	}
+	c, err := d.Reload()
+	if err != nil {
+		d.logger().Error("failed to reload configuration, keeping the current configuration", "err", err)
+		return
+	}
+	d.mu.Lock()
+	d.IaaS, d.Jobs, d.Policies = c.IaaS, c.Jobs, c.Policies
+	if c.Elector != nil {
+		d.Elector = c.Elector
+	}
+	d.mu.Unlock()
+	d.logger().Info("reloaded configuration")
+}
+
+func (d *Daemon) drainTimeout() time.Duration {
+	if d.DrainTimeout <= 0 {
+		return DefaultDrainTimeout
+	}
+	return d.DrainTimeout
+}
+
+func (d *Daemon) pollWithTimeout(ctx context.Context) error {
+	timeout := d.timeout()
+	if m, ok := d.current().IaaS.(Migrator); ok {
+		timeout += m.MigrationBudget()
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return d.Poll(ctx)
+}
+
 func (d *Daemon) startRunning() bool {
 	return atomic.CompareAndSwapInt32(&d.running, 0, 1)
 }
@@ -62,20 +473,39 @@ func (d *Daemon) stopRunning() {
 }
 
 // Poll is a wrapper for Check that ensures that multiple
-// invocations of Check won't run concurrently.
+// invocations of Check won't run concurrently.  The outcome
+// of each check is reflected in the daemon's Status.  Outside
+// of the ActSchedule, during QuietHours, or when another daemon
+// is the leader, Poll only observes.
 func (d *Daemon) Poll(ctx context.Context) error {
 	if !d.startRunning() {
+		d.logger().Debug("check already in progress, skipping poll")
 		return nil
 	}
 
 	defer func() {
 		d.stopRunning()
 	}()
-	err := Check(ctx, d.IaaS)
-	if err != nil {
-		// Need to log this
-		return err
+	now := time.Now()
+	leader := d.lead(ctx)
+	act := leader && d.shouldAct(now)
+	config := d.current()
+	c := &Checker{
+		IaaS:      config.IaaS,
+		Logger:    d.logger(),
+		Proposals: d.Proposals,
+		Limits:    d.Limits,
+		Jobs:      config.Jobs,
+		Policies:  config.Policies,
+		Observe:   !act,
 	}
-
-	return nil
+	if leader {
+		c.Notifier = d.Notifier
+	}
+	err := c.Check(ctx)
+	d.record(ctx, err)
+	if act && err == nil {
+		d.acted(now)
+	}
+	return err
 }
@@ -0,0 +1,118 @@
+//go:build !windows
+// +build !windows
+
+package magnet_test
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/mock"
+)
+
+var _ = Describe("daemon signal handling", func() {
+	var (
+		polls int32
+		d     *magnet.Daemon
+		ran   chan error
+	)
+	BeforeEach(func() {
+		atomic.StoreInt32(&polls, 0)
+		d = &magnet.Daemon{
+			IaaS: &mock.IaaS{StateFn: func(ctx context.Context) (*magnet.State, error) {
+				atomic.AddInt32(&polls, 1)
+				return &magnet.State{}, nil
+			}},
+			Period: time.Hour,
+		}
+		ran = make(chan error, 1)
+	})
+
+	run := func(ctx context.Context) {
+		go func() { ran <- d.Run(ctx) }()
+		Eventually(func() int32 { return atomic.LoadInt32(&polls) }).Should(BeNumerically("==", 1))
+	}
+
+	signal := func(sig syscall.Signal) {
+		Ω(syscall.Kill(syscall.Getpid(), sig)).Should(Succeed())
+	}
+
+	It("checks immediately on SIGUSR1", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		run(ctx)
+
+		signal(syscall.SIGUSR1)
+		Eventually(func() int32 { return atomic.LoadInt32(&polls) }).Should(BeNumerically("==", 2))
+		cancel()
+		Eventually(ran).Should(Receive(BeNil()))
+	})
+
+	It("uses the reloaded IaaS after SIGHUP", func() {
+		reloaded := make(chan struct{})
+		d.Reload = func() (*magnet.DaemonConfig, error) {
+			defer close(reloaded)
+			return &magnet.DaemonConfig{IaaS: &mock.IaaS{StateFn: func(ctx context.Context) (*magnet.State, error) {
+				atomic.AddInt32(&polls, 100)
+				return &magnet.State{}, nil
+			}}}, nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		run(ctx)
+
+		signal(syscall.SIGHUP)
+		Eventually(reloaded).Should(BeClosed())
+		signal(syscall.SIGUSR1)
+		Eventually(func() int32 { return atomic.LoadInt32(&polls) }).Should(BeNumerically("==", 101))
+		cancel()
+		Eventually(ran).Should(Receive(BeNil()))
+	})
+
+	It("lets a check in progress finish on SIGTERM", func() {
+		release := make(chan struct{})
+		var finished int32
+		d.IaaS = &mock.IaaS{StateFn: func(ctx context.Context) (*magnet.State, error) {
+			if atomic.AddInt32(&polls, 1) > 1 {
+				<-release
+				atomic.StoreInt32(&finished, 1)
+			}
+			return &magnet.State{}, nil
+		}}
+		run(context.Background())
+
+		signal(syscall.SIGUSR1)
+		Eventually(func() int32 { return atomic.LoadInt32(&polls) }).Should(BeNumerically("==", 2))
+		// ginkgo handles SIGTERM itself, so don't send it to the process
+		d.Signal(syscall.SIGTERM)
+		Consistently(ran, 100*time.Millisecond).ShouldNot(Receive())
+
+		close(release)
+		Eventually(ran).Should(Receive(BeNil()))
+		Ω(atomic.LoadInt32(&finished)).Should(BeEquivalentTo(1))
+	})
+
+	It("cancels a check that doesn't finish within the drain timeout", func() {
+		d.DrainTimeout = 50 * time.Millisecond
+		d.IaaS = &mock.IaaS{StateFn: func(ctx context.Context) (*magnet.State, error) {
+			if atomic.AddInt32(&polls, 1) > 1 {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return &magnet.State{}, nil
+		}}
+		run(context.Background())
+
+		signal(syscall.SIGUSR1)
+		Eventually(func() int32 { return atomic.LoadInt32(&polls) }).Should(BeNumerically("==", 2))
+		// ginkgo handles SIGTERM itself, so don't send it to the process
+		d.Signal(syscall.SIGTERM)
+		Eventually(ran).Should(Receive(BeNil()))
+	})
+})
@@ -2,7 +2,10 @@ package magnet_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"time"
 
@@ -40,6 +43,27 @@ var _ = Describe("daemon tests", func() {
 			// a timeout is considered an error
 			Ω(err).Should(HaveOccurred())
 		})
+
+		It("keeps running when the first check exceeds the limits", func() {
+			host1 := &magnet.Host{ID: "host1"}
+			state := &magnet.State{
+				Hosts: []*magnet.Host{host1, {ID: "host2"}},
+				VMs: []*magnet.VM{
+					{Name: "a1", Job: "a", HostUUID: host1.ID},
+					{Name: "a2", Job: "a", HostUUID: host1.ID},
+					{Name: "b1", Job: "b", HostUUID: host1.ID},
+					{Name: "b2", Job: "b", HostUUID: host1.ID},
+				},
+			}
+			i.StateFn = func(ctx context.Context) (*magnet.State, error) {
+				return state, nil
+			}
+			d.Limits = &magnet.Limits{MaxAdded: 1}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			Ω(d.Run(ctx)).Should(MatchError(context.DeadlineExceeded))
+			Ω(d.Status().LastError).Should(ContainSubstring("rules would be added"))
+		})
 	})
 
 	Context("when Poll()ing a daemon", func() {
@@ -66,5 +90,200 @@ var _ = Describe("daemon tests", func() {
 			finished.Wait()
 			Ω(count).Should(Equal(1))
 		})
+
+		It("bounds each poll by the timeout", func() {
+			d.Timeout = 50 * time.Millisecond
+			i.StateFn = func(ctx context.Context) (*magnet.State, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			Ω(d.Run(context.Background())).Should(MatchError(context.DeadlineExceeded))
+		})
+
+		It("allows for an IaaS's migrations on top of the timeout", func() {
+			d.IaaS = migrator{i, time.Second}
+			d.Timeout = 50 * time.Millisecond
+			i.StateFn = func(ctx context.Context) (*magnet.State, error) {
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(100 * time.Millisecond):
+					return nil, errors.New("state unavailable")
+				}
+			}
+			Ω(d.Run(context.Background())).Should(MatchError("state unavailable"))
+		})
+	})
+
+	Context("when scheduling actions", func() {
+		var converged int
+		BeforeEach(func() {
+			converged = 0
+			host1 := &magnet.Host{ID: "host1"}
+			host2 := &magnet.Host{ID: "host2"}
+			state := &magnet.State{
+				Hosts: []*magnet.Host{host1, host2},
+				VMs: []*magnet.VM{
+					{Name: "vm1", Job: "job", HostUUID: host1.ID},
+					{Name: "vm2", Job: "job", HostUUID: host1.ID},
+				},
+			}
+			i.StateFn = func(ctx context.Context) (*magnet.State, error) {
+				return state, nil
+			}
+			i.ConvergeFn = func(ctx context.Context, s *magnet.State, rec *magnet.RuleRecommendation) error {
+				converged++
+				return nil
+			}
+		})
+
+		It("acts on every poll without an action schedule", func() {
+			Ω(d.Poll(context.Background())).Should(Succeed())
+			Ω(d.Poll(context.Background())).Should(Succeed())
+			Ω(converged).Should(Equal(2))
+		})
+
+		It("only observes until an action is due", func() {
+			d.ActSchedule = magnet.Every(50 * time.Millisecond)
+			Ω(d.Poll(context.Background())).Should(Succeed())
+			Ω(d.Poll(context.Background())).Should(Succeed())
+			Ω(converged).Should(Equal(0))
+
+			time.Sleep(50 * time.Millisecond)
+			Ω(d.Poll(context.Background())).Should(Succeed())
+			Ω(converged).Should(Equal(1))
+			Ω(d.Poll(context.Background())).Should(Succeed())
+			Ω(converged).Should(Equal(1))
+		})
+
+		It("only observes and stays quiet when following another daemon", func() {
+			leader := false
+			notified := 0
+			d.Elector = &mock.Elector{AcquireFn: func(ctx context.Context) (bool, error) {
+				return leader, nil
+			}}
+			d.Notifier = &mock.Notifier{NotifyFn: func(ctx context.Context, e *magnet.Event) error {
+				notified++
+				return nil
+			}}
+			Ω(d.Poll(context.Background())).Should(Succeed())
+			Ω(converged).Should(Equal(0))
+			Ω(notified).Should(Equal(0))
+			Ω(d.Status().Leader).Should(BeFalse())
+
+			leader = true
+			Ω(d.Poll(context.Background())).Should(Succeed())
+			Ω(converged).Should(Equal(1))
+			Ω(notified).ShouldNot(BeZero())
+			Ω(d.Status().Leader).Should(BeTrue())
+		})
+
+		It("only observes when leadership can't be determined", func() {
+			d.Elector = &mock.Elector{AcquireFn: func(ctx context.Context) (bool, error) {
+				return false, errors.New("vcenter is down")
+			}}
+			Ω(d.Poll(context.Background())).Should(Succeed())
+			Ω(converged).Should(Equal(0))
+		})
+
+		It("only observes during quiet hours", func() {
+			var err error
+			d.QuietHours, err = magnet.ParseCron("* * * * *")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(d.Poll(context.Background())).Should(Succeed())
+			Ω(converged).Should(Equal(0))
+		})
+	})
+
+	Context("when tracking the daemon's status", func() {
+		var (
+			fail   bool
+			events []*magnet.Event
+		)
+		BeforeEach(func() {
+			fail = true
+			events = nil
+			i.StateFn = func(ctx context.Context) (*magnet.State, error) {
+				if fail {
+					return nil, errors.New("vcenter is down")
+				}
+				return &magnet.State{}, nil
+			}
+			d.FailureThreshold = 2
+			d.Notifier = &mock.Notifier{NotifyFn: func(ctx context.Context, e *magnet.Event) error {
+				events = append(events, e)
+				return nil
+			}}
+		})
+
+		It("is not ready before the first poll", func() {
+			Ω(d.Status().Ready).Should(BeFalse())
+		})
+
+		It("counts consecutive failures and records the last error", func() {
+			d.Poll(context.Background())
+			s := d.Status()
+			Ω(s.ConsecutiveFailures).Should(Equal(1))
+			Ω(s.LastError).Should(Equal("vcenter is down"))
+			Ω(s.LastSuccess.IsZero()).Should(BeTrue())
+			Ω(s.Ready).Should(BeTrue())
+			Ω(events).Should(BeEmpty())
+		})
+
+		It("becomes unready and notifies once the threshold is reached", func() {
+			for j := 0; j < 3; j++ {
+				d.Poll(context.Background())
+			}
+			s := d.Status()
+			Ω(s.ConsecutiveFailures).Should(Equal(3))
+			Ω(s.Ready).Should(BeFalse())
+			Ω(events).Should(HaveLen(1))
+			Ω(events[0].Type).Should(Equal(magnet.EventPollFailing))
+			Ω(events[0].Failures).Should(Equal(2))
+			Ω(events[0].Error).Should(Equal("vcenter is down"))
+		})
+
+		It("recovers after a successful poll", func() {
+			d.Poll(context.Background())
+			d.Poll(context.Background())
+			fail = false
+			Ω(d.Poll(context.Background())).Should(Succeed())
+
+			s := d.Status()
+			Ω(s.ConsecutiveFailures).Should(Equal(0))
+			Ω(s.LastError).Should(BeEmpty())
+			Ω(s.LastSuccess.IsZero()).Should(BeFalse())
+			Ω(s.Ready).Should(BeTrue())
+			Ω(events).Should(HaveLen(2))
+			Ω(events[1].Type).Should(Equal(magnet.EventPollRecovered))
+		})
+
+		It("serves readiness over HTTP", func() {
+			server := httptest.NewServer(&magnet.Server{Daemon: d})
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + "/readyz")
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusServiceUnavailable))
+
+			fail = false
+			d.Poll(context.Background())
+			resp, err = http.Get(server.URL + "/readyz")
+			Ω(err).ShouldNot(HaveOccurred())
+			var status magnet.DaemonStatus
+			Ω(json.NewDecoder(resp.Body).Decode(&status)).Should(Succeed())
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusOK))
+			Ω(status.Ready).Should(BeTrue())
+		})
 	})
 })
+
+// migrator is an IaaS whose Converge waits up to budget for migrations.
+type migrator struct {
+	*mock.IaaS
+	budget time.Duration
+}
+
+func (m migrator) MigrationBudget() time.Duration { return m.budget }
@@ -0,0 +1,86 @@
+package magnet
+
+import (
+	"fmt"
+	"path"
+)
+
+// JobFilter restricts the jobs that magnet manages.  Patterns are
+// matched against job names with path.Match, so * matches any run of
+// characters.  A job is managed if it matches any Include pattern, or
+// there are none, and doesn't match any Exclude pattern.
+type JobFilter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// Validate returns an error for each malformed pattern.
+func (f *JobFilter) Validate() []error {
+	var errs []error
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("malformed job pattern %q", pattern))
+		}
+	}
+	return errs
+}
+
+// Match reports whether job is managed.  A nil JobFilter
+// matches every job.
+func (f *JobFilter) Match(job string) bool {
+	if f == nil {
+		return true
+	}
+	included := len(f.Include) == 0
+	for _, pattern := range f.Include {
+		if ok, _ := path.Match(pattern, job); ok {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, job); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// apply removes the VMs and rules of unmanaged jobs from s.
+func (f *JobFilter) apply(s *State) {
+	if f == nil {
+		return
+	}
+	var vms []*VM
+	for _, vm := range s.VMs {
+		if f.Match(vm.Job) {
+			vms = append(vms, vm)
+		}
+	}
+	s.VMs = vms
+
+	var rules []*Rule
+	for _, r := range s.Rules {
+		if f.Match(r.Name) || f.matchMembers(r) {
+			rules = append(rules, r)
+		}
+	}
+	s.Rules = rules
+}
+
+// matchMembers reports whether every member of r belongs to a managed
+// job, as the members of the rules of groups and pairs of jobs do.
+func (f *JobFilter) matchMembers(r *Rule) bool {
+	if len(r.VMs) == 0 {
+		return false
+	}
+	for _, vm := range r.VMs {
+		if vm == nil || vm.Job == "" || !f.Match(vm.Job) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package magnet_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/mock"
+)
+
+var _ = Describe("JobFilter", func() {
+	It("matches every job when it is nil or empty", func() {
+		var f *magnet.JobFilter
+		Ω(f.Match("router")).Should(BeTrue())
+		Ω((&magnet.JobFilter{}).Match("router")).Should(BeTrue())
+	})
+
+	It("matches included jobs that aren't excluded", func() {
+		f := &magnet.JobFilter{Include: []string{"diego_cell*", "router"}, Exclude: []string{"*-canary"}}
+		Ω(f.Match("diego_cell")).Should(BeTrue())
+		Ω(f.Match("diego_cell-az2")).Should(BeTrue())
+		Ω(f.Match("router")).Should(BeTrue())
+		Ω(f.Match("diego_cell-canary")).Should(BeFalse())
+		Ω(f.Match("nats")).Should(BeFalse())
+	})
+
+	It("reports malformed patterns", func() {
+		f := &magnet.JobFilter{Include: []string{"[router"}, Exclude: []string{"ok", "\\"}}
+		Ω(f.Validate()).Should(HaveLen(2))
+	})
+
+	It("only checks the jobs it matches", func() {
+		host1 := &magnet.Host{ID: "host1"}
+		host2 := &magnet.Host{ID: "host2"}
+		router1 := &magnet.VM{Name: "router1", Job: "router", HostUUID: host1.ID}
+		router2 := &magnet.VM{Name: "router2", Job: "router", HostUUID: host1.ID}
+		nats1 := &magnet.VM{Name: "nats1", Job: "nats", HostUUID: host1.ID}
+		nats2 := &magnet.VM{Name: "nats2", Job: "nats", HostUUID: host1.ID}
+		i := &mock.IaaS{StateFn: func(ctx context.Context) (*magnet.State, error) {
+			return &magnet.State{
+				Hosts: []*magnet.Host{host1, host2},
+				VMs:   []*magnet.VM{router1, router2, nats1, nats2},
+				Rules: []*magnet.Rule{{Name: "nats", VMs: []*magnet.VM{nats1}}},
+			}, nil
+		}}
+		var rec *magnet.RuleRecommendation
+		i.ConvergeFn = func(ctx context.Context, s *magnet.State, r *magnet.RuleRecommendation) error {
+			rec = r
+			return nil
+		}
+		c := &magnet.Checker{IaaS: i, Jobs: &magnet.JobFilter{Exclude: []string{"nats"}}}
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(rec.Stale).Should(BeEmpty())
+		Ω(rec.Missing).Should(HaveLen(1))
+		Ω(rec.Missing[0].Name).Should(Equal("router"))
+	})
+
+	It("keeps the rules of groups of the jobs it matches", func() {
+		router1 := &magnet.VM{Name: "router1", Job: "router"}
+		tcp1 := &magnet.VM{Name: "tcp1", Job: "tcp_router"}
+		nats1 := &magnet.VM{Name: "nats1", Job: "nats"}
+		i := &mock.IaaS{StateFn: func(ctx context.Context) (*magnet.State, error) {
+			return &magnet.State{
+				VMs: []*magnet.VM{router1, tcp1, nats1},
+				Rules: []*magnet.Rule{
+					{Name: "routers", VMs: []*magnet.VM{router1, tcp1}},
+					{Name: "messaging", VMs: []*magnet.VM{router1, nats1}},
+				},
+			}, nil
+		}}
+		c := &magnet.Checker{IaaS: i, Jobs: &magnet.JobFilter{Include: []string{"*router"}}}
+		s, err := c.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s.Rules).Should(HaveLen(1))
+		Ω(s.Rules[0].Name).Should(Equal("routers"))
+	})
+})
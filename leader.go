@@ -0,0 +1,69 @@
+package magnet
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Elector decides which of several daemons managing the same deployment
+// is the leader.  Only the leader changes the deployment; the others
+// only observe it.
+type Elector interface {
+	// Acquire acquires or renews leadership, and reports
+	// whether the caller is the leader.
+	Acquire(ctx context.Context) (bool, error)
+
+	// Release gives up leadership, if the caller holds it.
+	Release(ctx context.Context) error
+}
+
+// FileLock is an Elector for daemons that run on the same host.  The
+// leader holds an exclusive lock on the file at Path until it is
+// released or the process exits.
+type FileLock struct {
+	Path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Acquire tries to lock the file without blocking.
+func (l *FileLock) Acquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		return true, nil
+	}
+
+	f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return false, err
+	}
+	locked, err := lockFile(f)
+	if err != nil || !locked {
+		f.Close()
+		return false, err
+	}
+	// record the leader, for whoever is wondering which process it is
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	l.f = f
+	return true, nil
+}
+
+// Release unlocks the file.
+func (l *FileLock) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := unlockFile(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
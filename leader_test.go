@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package magnet_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pivotalservices/magnet"
+)
+
+var _ = Describe("FileLock", func() {
+	var (
+		dir  string
+		a, b *magnet.FileLock
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "magnet-lock")
+		Ω(err).ShouldNot(HaveOccurred())
+		path := filepath.Join(dir, "magnet.lock")
+		a = &magnet.FileLock{Path: path}
+		b = &magnet.FileLock{Path: path}
+	})
+	AfterEach(func() {
+		a.Release(context.Background())
+		b.Release(context.Background())
+		os.RemoveAll(dir)
+	})
+
+	It("elects one leader", func() {
+		Ω(a.Acquire(context.Background())).Should(BeTrue())
+		Ω(b.Acquire(context.Background())).Should(BeFalse())
+		Ω(a.Acquire(context.Background())).Should(BeTrue())
+	})
+
+	It("hands over leadership when it is released", func() {
+		Ω(a.Acquire(context.Background())).Should(BeTrue())
+		Ω(a.Release(context.Background())).Should(Succeed())
+		Ω(b.Acquire(context.Background())).Should(BeTrue())
+		Ω(a.Acquire(context.Background())).Should(BeFalse())
+	})
+})
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package magnet
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile tries to take an exclusive lock on f without
+// blocking, and reports whether it succeeded.
+func lockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,16 @@
+package magnet
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoFileLocks = errors.New("file locks are not supported on windows")
+
+func lockFile(f *os.File) (bool, error) {
+	return false, errNoFileLocks
+}
+
+func unlockFile(f *os.File) error {
+	return errNoFileLocks
+}
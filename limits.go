@@ -0,0 +1,156 @@
+package magnet
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Limits bound the changes that a single check may make, so that a bad
+// read of the IaaS's state can't remove every rule at once.  Zero-valued
+// limits are not enforced.  When a limit is exceeded, Check applies none
+// of the recommendations and returns a *LimitError.
+//
+// A stale rule that a missing rule of the same name replaces, as when
+// BOSH recreates a job's VMs, is neither added nor removed, and nor are
+// the rules whose changes the last check left to an operator.
+//
+// Limits remembers the number of VMs seen by the previous check, so the
+// same Limits should be used for every check of a deployment.  A drop
+// is refused until the VMs return, or until AcceptVMDropAfter
+// consecutive checks have seen the same lower count.
+type Limits struct {
+	MaxAdded   int // rules added per check
+	MaxRemoved int // rules removed per check
+
+	// MaxRemovedFraction is the largest fraction (0-1) of the
+	// existing rules that may be removed in a single check.
+	MaxRemovedFraction float64
+
+	// MaxVMDrop is the largest fraction (0-1) by which the number
+	// of VMs may drop between consecutive checks.
+	MaxVMDrop float64
+
+	// AcceptVMDropAfter is the number of consecutive checks that must
+	// see the same dropped VM count before it is accepted as the new
+	// count, as after a deliberate scale-down.  If zero, a drop is
+	// refused until the VMs return.
+	AcceptVMDropAfter int
+
+	mu      sync.Mutex
+	lastVMs int
+	dropped int // the dropped VM count being refused
+	seen    int // the consecutive checks that have seen dropped
+
+	// the rules whose changes await an operator, by name
+	pending map[string]bool
+}
+
+// LimitError is returned by Check when converging would exceed Limits.
+type LimitError struct {
+	Violations []string
+}
+
+func (e *LimitError) Error() string {
+	return "refusing to converge: " + strings.Join(e.Violations, "; ")
+}
+
+// checkVMs returns an error if the number of VMs in s dropped too much
+// since the last check.  The count is only remembered if it is within
+// the limit, or once AcceptVMDropAfter consecutive checks have seen
+// it, in which case accepted is true.
+func (l *Limits) checkVMs(s *State) (accepted bool, err error) {
+	if l == nil {
+		return false, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := len(s.VMs)
+	if l.MaxVMDrop > 0 && l.lastVMs > 0 {
+		drop := float64(l.lastVMs-count) / float64(l.lastVMs)
+		if drop > l.MaxVMDrop {
+			if count != l.dropped {
+				l.dropped, l.seen = count, 0
+			}
+			l.seen++
+			if l.AcceptVMDropAfter == 0 || l.seen < l.AcceptVMDropAfter {
+				return false, &LimitError{Violations: []string{
+					fmt.Sprintf("VM count dropped from %d to %d (%.0f%%, limit %.0f%%)", l.lastVMs, count, drop*100, l.MaxVMDrop*100),
+				}}
+			}
+			accepted = true
+		}
+	}
+	l.lastVMs = count
+	l.dropped, l.seen = 0, 0
+	return accepted, nil
+}
+
+// checkChanges returns an error if applying rec to s would change
+// more rules than allowed.
+func (l *Limits) checkChanges(s *State, rec *RuleRecommendation) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	added := unreplaced(rec.Missing, rec.Stale, l.pending)
+	removed := unreplaced(rec.Stale, rec.Missing, l.pending)
+	var violations []string
+	if l.MaxAdded > 0 && added > l.MaxAdded {
+		violations = append(violations, fmt.Sprintf("%d rules would be added (limit %d)", added, l.MaxAdded))
+	}
+	if l.MaxRemoved > 0 && removed > l.MaxRemoved {
+		violations = append(violations, fmt.Sprintf("%d rules would be removed (limit %d)", removed, l.MaxRemoved))
+	}
+	if l.MaxRemovedFraction > 0 && len(s.Rules) > 0 {
+		fraction := float64(removed) / float64(len(s.Rules))
+		if fraction > l.MaxRemovedFraction {
+			violations = append(violations, fmt.Sprintf("%d of %d existing rules would be removed (%.0f%%, limit %.0f%%)",
+				removed, len(s.Rules), fraction*100, l.MaxRemovedFraction*100))
+		}
+	}
+	if len(violations) > 0 {
+		return &LimitError{Violations: violations}
+	}
+	return nil
+}
+
+// waiting remembers the rules changed by rec, which await an operator,
+// or forgets them if rec is nil.
+func (l *Limits) waiting(rec *RuleRecommendation) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pending = nil
+	if rec == nil {
+		return
+	}
+	l.pending = make(map[string]bool)
+	for _, rules := range [][]Rule{rec.Missing, rec.Stale} {
+		for i := range rules {
+			l.pending[rules[i].Name] = true
+		}
+	}
+}
+
+// unreplaced counts the rules that have no rule of the same name in
+// others, and aren't pending.
+func unreplaced(rules, others []Rule, pending map[string]bool) int {
+	names := make(map[string]bool, len(others))
+	for i := range others {
+		names[others[i].Name] = true
+	}
+	n := 0
+	for i := range rules {
+		if !names[rules[i].Name] && !pending[rules[i].Name] {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,209 @@
+package magnet_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/mock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limits", func() {
+	var (
+		i         *mock.IaaS
+		c         *magnet.Checker
+		state     *magnet.State
+		converged bool
+		events    []*magnet.Event
+	)
+
+	// newState creates a state with jobs jobs, each with two VMs
+	// crammed onto the first host and a matching, valid rule.
+	newState := func(jobs int) *magnet.State {
+		host1 := &magnet.Host{ID: "host1"}
+		host2 := &magnet.Host{ID: "host2"}
+		s := &magnet.State{Hosts: []*magnet.Host{host1, host2}}
+		for j := 0; j < jobs; j++ {
+			job := fmt.Sprintf("job%d", j)
+			vm1 := &magnet.VM{Name: job + "-1", Job: job, HostUUID: host1.ID}
+			vm2 := &magnet.VM{Name: job + "-2", Job: job, HostUUID: host1.ID}
+			s.VMs = append(s.VMs, vm1, vm2)
+			s.Rules = append(s.Rules, &magnet.Rule{Name: job, VMs: []*magnet.VM{vm1, vm2}})
+		}
+		return s
+	}
+
+	BeforeEach(func() {
+		converged = false
+		events = nil
+		state = newState(4)
+		i = &mock.IaaS{
+			StateFn: func(ctx context.Context) (*magnet.State, error) {
+				return state, nil
+			},
+			ConvergeFn: func(ctx context.Context, s *magnet.State, rec *magnet.RuleRecommendation) error {
+				converged = true
+				return nil
+			},
+		}
+		n := &mock.Notifier{
+			NotifyFn: func(ctx context.Context, e *magnet.Event) error {
+				events = append(events, e)
+				return nil
+			},
+		}
+		c = &magnet.Checker{IaaS: i, Notifier: n, Limits: &magnet.Limits{}}
+	})
+
+	It("converges when no limits are set", func() {
+		state.Rules = nil
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(converged).Should(BeTrue())
+	})
+
+	It("refuses to add too many rules", func() {
+		state.Rules = nil
+		c.Limits.MaxAdded = 3
+		err := c.Check(context.Background())
+		Ω(err).Should(BeAssignableToTypeOf(&magnet.LimitError{}))
+		Ω(err.Error()).Should(ContainSubstring("4 rules would be added (limit 3)"))
+		Ω(converged).Should(BeFalse())
+		Ω(events[len(events)-1].Type).Should(Equal(magnet.EventLimitExceeded))
+	})
+
+	It("reports the refusal in machine-readable output", func() {
+		buf := &bytes.Buffer{}
+		magnet.SetOutput(buf)
+		defer magnet.SetOutput(ioutil.Discard)
+		Ω(magnet.SetFormat(magnet.OutputJSON)).Should(Succeed())
+		defer magnet.SetFormat(magnet.OutputText)
+
+		state.Rules = nil
+		c.Limits.MaxAdded = 3
+		Ω(c.Check(context.Background())).ShouldNot(Succeed())
+		var r magnet.Report
+		Ω(json.Unmarshal(buf.Bytes(), &r)).Should(Succeed())
+		Ω(r.LimitExceeded).Should(ContainSubstring("4 rules would be added (limit 3)"))
+		Ω(r.Recommendations.Missing).Should(HaveLen(4))
+	})
+
+	It("refuses to remove too many rules", func() {
+		// drop the job attribute from every VM, so every rule looks stale
+		for _, vm := range state.VMs {
+			vm.Job = "job0"
+		}
+		c.Limits.MaxRemoved = 2
+		err := c.Check(context.Background())
+		Ω(err).Should(BeAssignableToTypeOf(&magnet.LimitError{}))
+		Ω(err.Error()).Should(ContainSubstring("rules would be removed (limit 2)"))
+		Ω(converged).Should(BeFalse())
+	})
+
+	It("refuses to remove too large a fraction of the existing rules", func() {
+		for _, vm := range state.VMs {
+			vm.Job = "job0"
+		}
+		c.Limits.MaxRemovedFraction = 0.5
+		err := c.Check(context.Background())
+		Ω(err).Should(BeAssignableToTypeOf(&magnet.LimitError{}))
+		Ω(err.Error()).Should(ContainSubstring("of 4 existing rules would be removed"))
+		Ω(converged).Should(BeFalse())
+	})
+
+	It("doesn't count the rules of recreated VMs as removed", func() {
+		// BOSH recreated every VM, so every rule is replaced by a new one
+		state = newState(4)
+		for _, vm := range state.VMs {
+			vm.Name += "-new"
+		}
+		for _, r := range state.Rules {
+			r.VMs = []*magnet.VM{{Name: r.Name + "-1"}, {Name: r.Name + "-2"}}
+		}
+		c.Limits.MaxAdded = 1
+		c.Limits.MaxRemoved = 1
+		c.Limits.MaxRemovedFraction = 0.5
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(converged).Should(BeTrue())
+	})
+
+	It("reports the actions left to an operator without counting them again", func() {
+		for _, vm := range state.VMs {
+			vm.Job = "job0"
+		}
+		i.ConvergeFn = func(ctx context.Context, s *magnet.State, rec *magnet.RuleRecommendation) error {
+			converged = true
+			return pendingError{"recreate job0-2"}
+		}
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(converged).Should(BeTrue())
+		e := events[len(events)-1]
+		Ω(e.Type).Should(Equal(magnet.EventActionsPending))
+		Ω(e.Actions).Should(Equal([]string{"recreate job0-2"}))
+		for _, e := range events {
+			Ω(e.Type).ShouldNot(Equal(magnet.EventConvergeFailed))
+		}
+
+		// the rules are still stale until the operator acts
+		converged = false
+		c.Limits.MaxRemoved = 2
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(converged).Should(BeTrue())
+	})
+
+	It("refuses to converge when the VM count drops sharply", func() {
+		c.Limits.MaxVMDrop = 0.25
+		Ω(c.Check(context.Background())).Should(Succeed())
+		converged = false
+
+		state = newState(2)
+		state.Rules = nil
+		err := c.Check(context.Background())
+		Ω(err).Should(BeAssignableToTypeOf(&magnet.LimitError{}))
+		Ω(err.Error()).Should(ContainSubstring("VM count dropped from 8 to 4"))
+		Ω(converged).Should(BeFalse())
+
+		// the drop is refused until the VMs come back
+		Ω(c.Check(context.Background())).ShouldNot(Succeed())
+		state = newState(4)
+		Ω(c.Check(context.Background())).Should(Succeed())
+	})
+
+	It("accepts a VM count drop that persists", func() {
+		c.Limits.MaxVMDrop = 0.25
+		c.Limits.AcceptVMDropAfter = 3
+		Ω(c.Check(context.Background())).Should(Succeed())
+
+		state = newState(2)
+		Ω(c.Check(context.Background())).ShouldNot(Succeed())
+		// a different count starts counting again
+		state = newState(1)
+		Ω(c.Check(context.Background())).ShouldNot(Succeed())
+		Ω(c.Check(context.Background())).ShouldNot(Succeed())
+		Ω(c.Check(context.Background())).Should(Succeed())
+
+		// 2 is the new count
+		state = newState(0)
+		Ω(c.Check(context.Background())).ShouldNot(Succeed())
+	})
+
+	It("doesn't check the VM count when only observing", func() {
+		c.Limits.MaxVMDrop = 0.25
+		Ω(c.Check(context.Background())).Should(Succeed())
+		state = newState(2)
+		c.Observe = true
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(events[len(events)-1].Type).ShouldNot(Equal(magnet.EventLimitExceeded))
+	})
+})
+
+type pendingError []string
+
+func (e pendingError) Error() string     { return "pending: " + strings.Join(e, ", ") }
+func (e pendingError) Pending() []string { return e }
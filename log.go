@@ -0,0 +1,212 @@
+package magnet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// Log levels, from most to least verbose.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel converts a level name (debug, info, warn or error) to a Level.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Supported log formats.
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Logger is a leveled, structured logger.  Each method takes a message
+// followed by alternating keys and values, for example:
+//
+//	l.Info("rule added", "cluster", "domain-c7", "rule", "router")
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+
+	// With returns a Logger that includes keyvals in every entry.
+	With(keyvals ...interface{}) Logger
+}
+
+// NewLogger creates a Logger that writes entries at or above level to w
+// in the specified format (FormatJSON or FormatLogfmt).  Secret values,
+// and the values of keys that mention a password, secret or token, are
+// redacted.
+func NewLogger(w io.Writer, format string, level Level) (Logger, error) {
+	var enc func(buf *bytes.Buffer, keyvals []interface{})
+	switch format {
+	case FormatJSON:
+		enc = encodeJSON
+	case FormatLogfmt:
+		enc = encodeLogfmt
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return &logger{
+		out:   &syncWriter{w: w},
+		enc:   enc,
+		level: level,
+	}, nil
+}
+
+// NopLogger returns a Logger that discards everything.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+func (n nopLogger) With(...interface{}) Logger { return n }
+
+// syncWriter serializes writes so that entries from concurrent
+// goroutines are never interleaved.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+type logger struct {
+	out    io.Writer
+	enc    func(buf *bytes.Buffer, keyvals []interface{})
+	level  Level
+	fields []interface{}
+}
+
+func (l *logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *logger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *logger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+func (l *logger) With(keyvals ...interface{}) Logger {
+	l2 := *l
+	l2.fields = append(append([]interface{}{}, l.fields...), keyvals...)
+	return &l2
+}
+
+func (l *logger) log(level Level, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+	all := make([]interface{}, 0, 6+len(l.fields)+len(keyvals))
+	all = append(all, "ts", time.Now().UTC().Format(time.RFC3339), "level", level.String(), "msg", msg)
+	all = append(all, l.fields...)
+	all = append(all, keyvals...)
+	if len(all)%2 != 0 {
+		all = append(all, "(MISSING)")
+	}
+	for i := 6; i < len(all); i += 2 {
+		if sensitive(fmt.Sprint(all[i])) {
+			all[i+1] = Secret(fmt.Sprint(all[i+1]))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	l.enc(buf, all)
+	buf.WriteByte('\n')
+	l.out.Write(buf.Bytes())
+}
+
+// sensitive reports whether values logged with key are secret.
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"password", "secret", "token"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeJSON(buf *bytes.Buffer, keyvals []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(fmt.Sprint(keyvals[i]))
+		buf.Write(k)
+		buf.WriteByte(':')
+		v := keyvals[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprint(v))
+		}
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+}
+
+func encodeLogfmt(buf *bytes.Buffer, keyvals []interface{}) {
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(logfmtValue(fmt.Sprint(keyvals[i])))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(fmt.Sprint(keyvals[i+1])))
+	}
+}
+
+// logfmtValue quotes s if it would otherwise be ambiguous in logfmt.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,83 @@
+package magnet_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/mock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logger", func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+	})
+
+	It("parses level names", func() {
+		l, err := magnet.ParseLevel("WARN")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(l).Should(Equal(magnet.LevelWarn))
+
+		_, err = magnet.ParseLevel("loud")
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("rejects unknown formats", func() {
+		_, err := magnet.NewLogger(buf, "xml", magnet.LevelInfo)
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("writes JSON entries with fields", func() {
+		l, err := magnet.NewLogger(buf, magnet.FormatJSON, magnet.LevelInfo)
+		Ω(err).ShouldNot(HaveOccurred())
+		l.With("cluster", "domain-c7").Info("rule added", "rule", "router", "err", errors.New("boom"))
+
+		var entry map[string]interface{}
+		Ω(json.Unmarshal(buf.Bytes(), &entry)).Should(Succeed())
+		Ω(entry).Should(HaveKeyWithValue("level", "info"))
+		Ω(entry).Should(HaveKeyWithValue("msg", "rule added"))
+		Ω(entry).Should(HaveKeyWithValue("cluster", "domain-c7"))
+		Ω(entry).Should(HaveKeyWithValue("rule", "router"))
+		Ω(entry).Should(HaveKeyWithValue("err", "boom"))
+		Ω(entry).Should(HaveKey("ts"))
+	})
+
+	It("writes logfmt entries, quoting values where necessary", func() {
+		l, err := magnet.NewLogger(buf, magnet.FormatLogfmt, magnet.LevelInfo)
+		Ω(err).ShouldNot(HaveOccurred())
+		l.Warn("job is unbalanced", "job", "diego_cell")
+
+		line := buf.String()
+		Ω(line).Should(ContainSubstring(`level=warn msg="job is unbalanced" job=diego_cell`))
+		Ω(strings.Count(line, "\n")).Should(Equal(1))
+	})
+
+	It("drops entries below the configured level", func() {
+		l, err := magnet.NewLogger(buf, magnet.FormatLogfmt, magnet.LevelWarn)
+		Ω(err).ShouldNot(HaveOccurred())
+		l.Debug("debug")
+		l.Info("info")
+		Ω(buf.Len()).Should(BeZero())
+		l.Error("error")
+		Ω(buf.String()).Should(ContainSubstring("level=error"))
+	})
+
+	It("logs Check errors", func() {
+		l, err := magnet.NewLogger(buf, magnet.FormatLogfmt, magnet.LevelInfo)
+		Ω(err).ShouldNot(HaveOccurred())
+		i := &mock.IaaS{
+			StateFn: func(ctx context.Context) (*magnet.State, error) {
+				return nil, errors.New("couldn't get state")
+			},
+		}
+		Ω(magnet.Check(context.Background(), i, l)).ShouldNot(Succeed())
+		Ω(buf.String()).Should(ContainSubstring(`level=error msg="failed to get state" err="couldn't get state"`))
+	})
+})
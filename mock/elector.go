@@ -0,0 +1,27 @@
+package mock
+
+import "context"
+
+// Elector is a mock Elector whose functions can be replaced.
+type Elector struct {
+	AcquireFn func(ctx context.Context) (bool, error)
+	ReleaseFn func(ctx context.Context) error
+}
+
+// Acquire runs the Elector's supplied AcquireFn.
+// If no acquire function was provided, the caller is always the leader.
+func (m *Elector) Acquire(ctx context.Context) (bool, error) {
+	if m.AcquireFn != nil {
+		return m.AcquireFn(ctx)
+	}
+	return true, nil
+}
+
+// Release runs the Elector's supplied ReleaseFn.
+// If no release function was provided it returns a nil error.
+func (m *Elector) Release(ctx context.Context) error {
+	if m.ReleaseFn != nil {
+		return m.ReleaseFn(ctx)
+	}
+	return nil
+}
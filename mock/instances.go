@@ -0,0 +1,16 @@
+package mock
+
+import (
+	"context"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// Instances is a mock InstanceSource that lists a fixed set of
+// instances.
+type Instances []magnet.Instance
+
+// Instances returns the instances in m, and a nil error.
+func (m Instances) Instances(ctx context.Context) ([]magnet.Instance, error) {
+	return m, nil
+}
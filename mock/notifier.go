@@ -0,0 +1,21 @@
+package mock
+
+import (
+	"context"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// Notifier is a mock Notifier whose Notify function can be replaced.
+type Notifier struct {
+	NotifyFn func(ctx context.Context, e *magnet.Event) error
+}
+
+// Notify runs the Notifier's supplied NotifyFn.
+// If no notify function was provided it returns a nil error.
+func (m *Notifier) Notify(ctx context.Context, e *magnet.Event) error {
+	if m.NotifyFn != nil {
+		return m.NotifyFn(ctx, e)
+	}
+	return nil
+}
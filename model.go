@@ -1,6 +1,9 @@
 package magnet
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // IaaS is an abstraction for a particular IaaS.
 type IaaS interface {
@@ -8,6 +11,59 @@ type IaaS interface {
 	Converge(ctx context.Context, state *State, rec *RuleRecommendation) error
 }
 
+// Migrator is implemented by the IaaSes whose Converge waits for VMs to
+// migrate.  The daemon allows each poll MigrationBudget on top of its
+// Timeout, so that the migrations get the time they are configured with.
+type Migrator interface {
+	MigrationBudget() time.Duration
+}
+
+// PendingError is implemented by the errors that an IaaS's Converge
+// returns when it has made the changes it can, but an operator must
+// still act, such as by recreating VMs, before the rules are satisfied.
+// Check doesn't treat them as failures, but sends an
+// EventActionsPending.
+type PendingError interface {
+	error
+
+	// Pending describes each action that the operator must take.
+	Pending() []string
+}
+
+// Instance is an instance of a BOSH deployment, as its director
+// describes it.
+type Instance struct {
+	Deployment string
+	Job        string // the instance group
+	Index      string
+	AZ         string
+	ID         string
+	CID        string // the IaaS's name for the instance's VM
+}
+
+// InstanceSource lists the instances of the deployments that magnet
+// manages, so that an IaaS needn't rely on the VMs' metadata alone.
+type InstanceSource interface {
+	Instances(ctx context.Context) ([]Instance, error)
+}
+
+// InstancesByCID returns the instances that src lists, by CID, so that
+// an IaaS can join them to its VMs.  It returns nil if src is nil.
+func InstancesByCID(ctx context.Context, src InstanceSource) (map[string]Instance, error) {
+	if src == nil {
+		return nil, nil
+	}
+	list, err := src.Instances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byCID := make(map[string]Instance, len(list))
+	for _, in := range list {
+		byCID[in.CID] = in
+	}
+	return byCID, nil
+}
+
 // State represents the resources in a Cloud Foundry deployment.
 type State struct {
 	RuleContainer string
@@ -15,6 +71,15 @@ type State struct {
 	Hosts         []*Host
 	VMs           []*VM
 	Rules         []*Rule
+
+	// Policies are the policies of jobs set by the IaaS or a Checker.
+	// Jobs that aren't listed have the zero JobPolicy.
+	Policies map[string]JobPolicy
+}
+
+// policy returns the policy of job.
+func (s *State) policy(job string) JobPolicy {
+	return s.Policies[job]
 }
 
 // VM is a virtual machine in a Cloud Foundry depoyment.
@@ -25,12 +90,23 @@ type VM struct {
 	HostName  string
 	Job       string
 	Reference string
+
+	// Index is the instance index of the VM within its job, if known.
+	Index string
+
+	// Deployment and AZ are the BOSH deployment and availability zone
+	// of the VM, if known.
+	Deployment string
+	AZ         string
 }
 
 // Host is a host in a Cloud Foundry deployment.
 type Host struct {
 	Name string
 	ID   string
+
+	// Attributes are the host's custom attributes, by name.
+	Attributes map[string]string
 }
 
 // Rule can be used to achieve anti-affinity
@@ -41,6 +117,19 @@ type Rule struct {
 	Enabled   bool
 	Mandatory bool
 	VMs       []*VM
+
+	// Affinity is true for rules that keep their VMs together on one
+	// host, rather than on separate hosts.
+	Affinity bool
+
+	// Hosts, if non-nil, makes the rule a VM/Host rule, which runs
+	// its VMs on these hosts.
+	Hosts []*Host
+
+	// Violated is true if the IaaS reports that the rule exists but
+	// isn't satisfied, for example because a host has failed or the
+	// IaaS isn't moving VMs automatically.
+	Violated bool
 }
 
 // RuleRecommendation is a reccomendation for how to achieve anti-affinity
@@ -0,0 +1,100 @@
+package magnet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EventType identifies what happened to a deployment.
+type EventType string
+
+// Events sent to a Notifier by Check.
+const (
+	// EventUnbalanced is sent when one or more jobs are not balanced.
+	EventUnbalanced EventType = "unbalanced"
+
+	// EventConverged is sent after rule recommendations are applied.
+	EventConverged EventType = "converged"
+
+	// EventConvergeFailed is sent when rule recommendations could not be applied.
+	EventConvergeFailed EventType = "converge_failed"
+
+	// EventProposed is sent when rule recommendations are waiting for approval.
+	EventProposed EventType = "proposed"
+
+	// EventActionsPending is sent when rule recommendations were
+	// applied, but an operator must act before they are satisfied.
+	EventActionsPending EventType = "actions_pending"
+
+	// EventLimitExceeded is sent when rule recommendations are not
+	// applied because they would exceed the configured Limits.
+	EventLimitExceeded EventType = "limit_exceeded"
+
+	// EventPollFailing is sent by a Daemon when its polls have
+	// failed Daemon.FailureThreshold times in a row.
+	EventPollFailing EventType = "poll_failing"
+
+	// EventPollRecovered is sent by a Daemon when a poll succeeds
+	// after EventPollFailing was sent.
+	EventPollRecovered EventType = "poll_recovered"
+)
+
+// ParseEventType converts an event name to an EventType.
+func ParseEventType(s string) (EventType, error) {
+	switch t := EventType(strings.TrimSpace(s)); t {
+	case EventUnbalanced, EventConverged, EventConvergeFailed, EventActionsPending, EventProposed,
+		EventLimitExceeded, EventPollFailing, EventPollRecovered:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown event %q", s)
+}
+
+// Event describes something that happened to a deployment.
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Jobs    []string  `json:"jobs,omitempty"`    // unbalanced jobs
+	Added   []string  `json:"added,omitempty"`   // names of rules added
+	Removed []string  `json:"removed,omitempty"` // names of rules removed
+	Error   string    `json:"error,omitempty"`
+
+	// Actions are the actions awaiting an operator.
+	Actions []string `json:"actions,omitempty"`
+
+	// Proposal is the ID of the proposal awaiting approval.
+	Proposal string `json:"proposal,omitempty"`
+
+	// Failures is the number of consecutive failed polls.
+	Failures int `json:"failures,omitempty"`
+}
+
+// Message is a short, human-readable description of the event.
+func (e *Event) Message() string {
+	jobs := strings.Join(e.Jobs, ", ")
+	switch e.Type {
+	case EventUnbalanced:
+		return fmt.Sprintf("magnet: unbalanced jobs: %s", jobs)
+	case EventConverged:
+		return fmt.Sprintf("magnet: rebalanced jobs: %s (added %d rules, removed %d rules)", jobs, len(e.Added), len(e.Removed))
+	case EventConvergeFailed:
+		return fmt.Sprintf("magnet: failed to rebalance jobs: %s: %s", jobs, e.Error)
+	case EventActionsPending:
+		return fmt.Sprintf("magnet: to rebalance jobs %s, an operator must %s", jobs, strings.Join(e.Actions, "; "))
+	case EventPollFailing:
+		return fmt.Sprintf("magnet: %d consecutive checks have failed: %s", e.Failures, e.Error)
+	case EventPollRecovered:
+		return fmt.Sprintf("magnet: checks are succeeding again after %d failures", e.Failures)
+	case EventLimitExceeded:
+		return fmt.Sprintf("magnet: %s", e.Error)
+	case EventProposed:
+		return fmt.Sprintf("magnet: proposal %s to rebalance jobs %s is awaiting approval (add %d rules, remove %d rules)", e.Proposal, jobs, len(e.Added), len(e.Removed))
+	}
+	return fmt.Sprintf("magnet: %s", e.Type)
+}
+
+// Notifier is notified of imbalances and of attempts to fix them.
+type Notifier interface {
+	Notify(ctx context.Context, e *Event) error
+}
@@ -0,0 +1,111 @@
+package notify
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// Filter returns a Notifier that forwards only events of the
+// specified types to n.
+func Filter(n magnet.Notifier, types ...magnet.EventType) magnet.Notifier {
+	f := &filter{n: n, types: make(map[magnet.EventType]bool)}
+	for _, t := range types {
+		f.types[t] = true
+	}
+	return f
+}
+
+type filter struct {
+	n     magnet.Notifier
+	types map[magnet.EventType]bool
+}
+
+func (f *filter) Notify(ctx context.Context, e *magnet.Event) error {
+	if !f.types[e.Type] {
+		return nil
+	}
+	return f.n.Notify(ctx, e)
+}
+
+// Dedup returns a Notifier that suppresses events that are identical
+// to the previous event of the same type, until window has elapsed.
+// Events are identical if they have the same type, jobs, rule changes
+// and error, so a persistent imbalance is reported once per window
+// while a change in which jobs are unbalanced is reported immediately.
+func Dedup(n magnet.Notifier, window time.Duration) magnet.Notifier {
+	return &dedup{
+		n:      n,
+		window: window,
+		last:   make(map[magnet.EventType]sent),
+	}
+}
+
+type sent struct {
+	key  string
+	time time.Time
+}
+
+type dedup struct {
+	n      magnet.Notifier
+	window time.Duration
+
+	mu   sync.Mutex
+	last map[magnet.EventType]sent
+}
+
+func (d *dedup) Notify(ctx context.Context, e *magnet.Event) error {
+	key := dedupKey(e)
+	now := time.Now()
+
+	d.mu.Lock()
+	prev, ok := d.last[e.Type]
+	if ok && prev.key == key && now.Sub(prev.time) < d.window {
+		d.mu.Unlock()
+		return nil
+	}
+	d.mu.Unlock()
+
+	err := d.n.Notify(ctx, e)
+	if err != nil {
+		// try again next time
+		return err
+	}
+
+	d.mu.Lock()
+	d.last[e.Type] = sent{key: key, time: now}
+	d.mu.Unlock()
+	return nil
+}
+
+func dedupKey(e *magnet.Event) string {
+	return strings.Join([]string{
+		strings.Join(e.Jobs, ","),
+		strings.Join(e.Added, ","),
+		strings.Join(e.Removed, ","),
+		e.Error,
+	}, "|")
+}
+
+// Multi returns a Notifier that sends each event to all of ns.
+// Every notifier is tried; the first error encountered is returned.
+// Wrap each of ns, rather than the result, in Dedup, so that an event
+// that one notifier failed to send isn't sent again by the others.
+func Multi(ns ...magnet.Notifier) magnet.Notifier {
+	return multi(ns)
+}
+
+type multi []magnet.Notifier
+
+func (m multi) Notify(ctx context.Context, e *magnet.Event) error {
+	var first error
+	for _, n := range m {
+		if err := n.Notify(ctx, e); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,146 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/mock"
+	"github.com/pivotalservices/magnet/notify"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("notifiers", func() {
+	var (
+		event    *magnet.Event
+		requests []map[string]interface{}
+		status   int
+		server   *httptest.Server
+	)
+	BeforeEach(func() {
+		event = &magnet.Event{Type: magnet.EventUnbalanced, Jobs: []string{"router"}}
+		requests = nil
+		status = http.StatusOK
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Ω(r.Method).Should(Equal(http.MethodPost))
+			Ω(r.Header.Get("Content-Type")).Should(Equal("application/json"))
+			var body map[string]interface{}
+			Ω(json.NewDecoder(r.Body).Decode(&body)).Should(Succeed())
+			requests = append(requests, body)
+			w.WriteHeader(status)
+		}))
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("Webhook", func() {
+		It("posts the event as JSON", func() {
+			w := &notify.Webhook{URL: server.URL}
+			Ω(w.Notify(context.Background(), event)).Should(Succeed())
+			Ω(requests).Should(HaveLen(1))
+			Ω(requests[0]).Should(HaveKeyWithValue("type", "unbalanced"))
+			Ω(requests[0]).Should(HaveKeyWithValue("jobs", ConsistOf("router")))
+		})
+
+		It("fails on a non-2xx response", func() {
+			status = http.StatusInternalServerError
+			w := &notify.Webhook{URL: server.URL}
+			Ω(w.Notify(context.Background(), event)).ShouldNot(Succeed())
+		})
+	})
+
+	Context("Slack", func() {
+		It("posts the event's message as text", func() {
+			s := &notify.Slack{URL: server.URL}
+			Ω(s.Notify(context.Background(), event)).Should(Succeed())
+			Ω(requests).Should(HaveLen(1))
+			Ω(requests[0]).Should(HaveKeyWithValue("text", event.Message()))
+		})
+	})
+})
+
+var _ = Describe("notifier wrappers", func() {
+	var (
+		n     *mock.Notifier
+		count int
+	)
+	BeforeEach(func() {
+		count = 0
+		n = &mock.Notifier{
+			NotifyFn: func(ctx context.Context, e *magnet.Event) error {
+				count++
+				return nil
+			},
+		}
+	})
+
+	It("filters events by type", func() {
+		f := notify.Filter(n, magnet.EventConvergeFailed)
+		Ω(f.Notify(context.Background(), &magnet.Event{Type: magnet.EventUnbalanced})).Should(Succeed())
+		Ω(count).Should(Equal(0))
+		Ω(f.Notify(context.Background(), &magnet.Event{Type: magnet.EventConvergeFailed})).Should(Succeed())
+		Ω(count).Should(Equal(1))
+	})
+
+	It("suppresses repeats of an identical event within the window", func() {
+		d := notify.Dedup(n, time.Hour)
+		e := &magnet.Event{Type: magnet.EventUnbalanced, Jobs: []string{"router"}}
+		Ω(d.Notify(context.Background(), e)).Should(Succeed())
+		Ω(d.Notify(context.Background(), e)).Should(Succeed())
+		Ω(count).Should(Equal(1))
+
+		// a different set of unbalanced jobs is reported right away
+		Ω(d.Notify(context.Background(), &magnet.Event{Type: magnet.EventUnbalanced, Jobs: []string{"router", "uaa"}})).Should(Succeed())
+		Ω(count).Should(Equal(2))
+	})
+
+	It("repeats an identical event once the window has elapsed", func() {
+		d := notify.Dedup(n, 0)
+		e := &magnet.Event{Type: magnet.EventUnbalanced, Jobs: []string{"router"}}
+		Ω(d.Notify(context.Background(), e)).Should(Succeed())
+		Ω(d.Notify(context.Background(), e)).Should(Succeed())
+		Ω(count).Should(Equal(2))
+	})
+
+	It("doesn't suppress an event that failed to send", func() {
+		fail := true
+		n.NotifyFn = func(ctx context.Context, e *magnet.Event) error {
+			count++
+			if fail {
+				return errors.New("no network")
+			}
+			return nil
+		}
+		d := notify.Dedup(n, time.Hour)
+		e := &magnet.Event{Type: magnet.EventUnbalanced, Jobs: []string{"router"}}
+		Ω(d.Notify(context.Background(), e)).ShouldNot(Succeed())
+		fail = false
+		Ω(d.Notify(context.Background(), e)).Should(Succeed())
+		Ω(count).Should(Equal(2))
+	})
+
+	It("sends to every notifier", func() {
+		m := notify.Multi(n, n)
+		Ω(m.Notify(context.Background(), &magnet.Event{Type: magnet.EventConverged})).Should(Succeed())
+		Ω(count).Should(Equal(2))
+	})
+
+	It("deduplicates each notifier separately", func() {
+		failing := &mock.Notifier{NotifyFn: func(ctx context.Context, e *magnet.Event) error {
+			return errors.New("no network")
+		}}
+		m := notify.Multi(notify.Dedup(failing, time.Hour), notify.Dedup(n, time.Hour))
+		e := &magnet.Event{Type: magnet.EventUnbalanced, Jobs: []string{"router"}}
+		Ω(m.Notify(context.Background(), e)).ShouldNot(Succeed())
+		Ω(m.Notify(context.Background(), e)).ShouldNot(Succeed())
+		Ω(count).Should(Equal(1))
+	})
+})
@@ -0,0 +1,24 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// Slack is a Notifier that posts a message for each event to a
+// Slack-compatible incoming webhook.
+type Slack struct {
+	URL    string
+	Client *http.Client
+}
+
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// Notify posts a message describing e to the webhook's URL.
+func (s *Slack) Notify(ctx context.Context, e *magnet.Event) error {
+	return postJSON(ctx, s.Client, s.URL, &slackMessage{Text: e.Message()})
+}
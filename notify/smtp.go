@@ -0,0 +1,69 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// SMTP is a Notifier that emails each event.  If Username is
+// empty, mail is sent without authenticating.
+type SMTP struct {
+	Addr     string // host:port of the mail server
+	From     string
+	To       []string
+	Username string
+	Password magnet.Secret
+}
+
+// Notify emails a message describing e to each of the recipients.
+func (s *SMTP) Notify(ctx context.Context, e *magnet.Event) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, string(s.Password), host)
+	}
+
+	msg, err := s.message(e)
+	if err != nil {
+		return err
+	}
+
+	// net/smtp doesn't support contexts, so give
+	// up waiting (but not sending) when ctx is done
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, s.From, s.To, msg)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SMTP) message(e *magnet.Event) ([]byte, error) {
+	details, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", s.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", e.Message())
+	fmt.Fprintf(buf, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(buf, "\r\n%s\r\n\r\n%s\r\n", e.Message(), details)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,51 @@
+// Package notify contains implementations of magnet.Notifier.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// defaultClient is used by notifiers that aren't given an *http.Client.
+var defaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// Webhook is a Notifier that POSTs each event, encoded as JSON, to a URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify posts e to the webhook's URL.
+func (w *Webhook) Notify(ctx context.Context, e *magnet.Event) error {
+	return postJSON(ctx, w.Client, w.URL, e)
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	if client == nil {
+		client = defaultClient
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notify: %s returned %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package openstack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// novaVersion is the compute API microversion magnet requests.
+// 2.15 added the soft-anti-affinity and soft-affinity policies.
+const novaVersion = "2.15"
+
+// session is an authenticated connection to the compute API.
+type session struct {
+	client  *http.Client
+	token   string
+	project string // the project's ID
+	compute string // the compute API's URL
+}
+
+// login authenticates with Keystone's v3 API, scoped to the configured
+// project, and finds the compute API in the service catalog.
+func (i *IaaS) login(ctx context.Context) (*session, error) {
+	c := i.config
+	var body struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string `json:"methods"`
+				Password struct {
+					User struct {
+						Name     string `json:"name"`
+						Domain   domain `json:"domain"`
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+			Scope struct {
+				Project struct {
+					Name   string `json:"name"`
+					Domain domain `json:"domain"`
+				} `json:"project"`
+			} `json:"scope"`
+		} `json:"auth"`
+	}
+	body.Auth.Identity.Methods = []string{"password"}
+	body.Auth.Identity.Password.User.Name = c.Username
+	body.Auth.Identity.Password.User.Domain.Name = c.UserDomain
+	body.Auth.Identity.Password.User.Password = string(c.Password)
+	body.Auth.Scope.Project.Name = c.Project
+	body.Auth.Scope.Project.Domain.Name = c.ProjectDomain
+
+	u := strings.TrimSuffix(c.AuthURL, "/")
+	if !strings.HasSuffix(u, "/v3") {
+		u += "/v3"
+	}
+	b, _ := json.Marshal(&body)
+	req, err := http.NewRequest(http.MethodPost, u+"/auth/tokens", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := i.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("openstack: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("openstack: logging in as %q: %s", c.Username, resp.Status)
+	}
+
+	var token struct {
+		Token struct {
+			Project struct {
+				ID string `json:"id"`
+			} `json:"project"`
+			Catalog []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					Region    string `json:"region"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("openstack: invalid token: %v", err)
+	}
+	s := &session{client: i.client, token: resp.Header.Get("X-Subject-Token"), project: token.Token.Project.ID}
+	for _, service := range token.Token.Catalog {
+		if service.Type != "compute" {
+			continue
+		}
+		for _, e := range service.Endpoints {
+			if e.Interface == "public" && (c.Region == "" || e.Region == c.Region) {
+				s.compute = strings.TrimSuffix(e.URL, "/")
+				break
+			}
+		}
+	}
+	if s.compute == "" {
+		return nil, fmt.Errorf("openstack: the service catalog has no public compute endpoint in region %q", c.Region)
+	}
+	return s, nil
+}
+
+type domain struct {
+	Name string `json:"name"`
+}
+
+// statusError is the error for an unexpected response.
+type statusError struct {
+	method, path string
+	code         int
+	status       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("openstack: %s %s: %s", e.method, e.path, e.status)
+}
+
+// do sends a request to the compute API, and decodes the response into
+// v if it is non-nil.  path may instead be an absolute URL, such as the
+// next page of a list.
+func (s *session) do(ctx context.Context, method, path string, in, v interface{}) error {
+	u := path
+	if !strings.Contains(path, "://") {
+		u = s.compute + path
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", s.token)
+	req.Header.Set("X-OpenStack-Nova-API-Version", novaVersion)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("openstack: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return &statusError{method: method, path: req.URL.Path, code: resp.StatusCode, status: resp.Status}
+	}
+	if v == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("openstack: %s %s: %v", method, req.URL.Path, err)
+	}
+	return nil
+}
+
+// server is a Nova server.
+type server struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	HostID     string            `json:"hostId"`
+	Hypervisor string            `json:"OS-EXT-SRV-ATTR:hypervisor_hostname"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+// host returns the key of the server's host: its hypervisor's name if
+// the API shows it (by default, only to administrators), and otherwise
+// the project-specific host ID.
+func (s *server) host() string {
+	if s.Hypervisor != "" {
+		return s.Hypervisor
+	}
+	return s.HostID
+}
+
+type link struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+// servers lists every server in the project, following the pages.
+func (s *session) servers(ctx context.Context) ([]server, error) {
+	var all []server
+	path := "/servers/detail"
+	for path != "" {
+		var page struct {
+			Servers []server `json:"servers"`
+			Links   []link   `json:"servers_links"`
+		}
+		if err := s.do(ctx, http.MethodGet, path, nil, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Servers...)
+		path = ""
+		for _, l := range page.Links {
+			if l.Rel == "next" {
+				path = l.Href
+			}
+		}
+	}
+	return all, nil
+}
+
+// hypervisors lists the names of the hypervisors that are up and
+// enabled.  Listing them is usually limited to administrators.
+func (s *session) hypervisors(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Hypervisors []struct {
+			Name   string `json:"hypervisor_hostname"`
+			State  string `json:"state"`
+			Status string `json:"status"`
+		} `json:"hypervisors"`
+	}
+	if err := s.do(ctx, http.MethodGet, "/os-hypervisors/detail", nil, &resp); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, h := range resp.Hypervisors {
+		if h.State == "up" && h.Status == "enabled" {
+			names = append(names, h.Name)
+		}
+	}
+	return names, nil
+}
+
+// serverGroup is a Nova server group.
+type serverGroup struct {
+	ID       string   `json:"id,omitempty"`
+	Name     string   `json:"name"`
+	Policies []string `json:"policies"`
+	Members  []string `json:"members,omitempty"`
+}
+
+// policy returns the group's policy.
+func (g *serverGroup) policy() string {
+	if len(g.Policies) == 0 {
+		return ""
+	}
+	return g.Policies[0]
+}
+
+func (s *session) serverGroups(ctx context.Context) ([]serverGroup, error) {
+	var resp struct {
+		Groups []serverGroup `json:"server_groups"`
+	}
+	if err := s.do(ctx, http.MethodGet, "/os-server-groups", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Groups, nil
+}
+
+func (s *session) createServerGroup(ctx context.Context, name, policy string) (*serverGroup, error) {
+	in := map[string]serverGroup{"server_group": {Name: name, Policies: []string{policy}}}
+	var resp struct {
+		Group serverGroup `json:"server_group"`
+	}
+	if err := s.do(ctx, http.MethodPost, "/os-server-groups", in, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Group, nil
+}
+
+func (s *session) deleteServerGroup(ctx context.Context, id string) error {
+	return s.do(ctx, http.MethodDelete, "/os-server-groups/"+id, nil, nil)
+}
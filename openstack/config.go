@@ -0,0 +1,121 @@
+package openstack
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// DefaultGroupPrefix is the prefix of the server groups magnet manages
+// when the config sets none.
+const DefaultGroupPrefix = "magnet-"
+
+// Config describes an OpenStack project and the BOSH deployments in it
+// that magnet manages.
+type Config struct {
+	AuthURL       string        `yaml:"auth-url"` // the Keystone URL, with or without /v3
+	Username      string        `yaml:"username"`
+	Password      magnet.Secret `yaml:"password"`
+	UserDomain    string        `yaml:"user-domain"` // default "Default"
+	Project       string        `yaml:"project"`
+	ProjectDomain string        `yaml:"project-domain"` // default "Default"
+	Region        string        `yaml:"region"`         // optional if there is one
+	CACert        string        `yaml:"cacert"`         // path of a PEM bundle of CAs to trust
+	GroupPrefix   string        `yaml:"group-prefix"`   // default DefaultGroupPrefix
+	Deployments   []string      `yaml:"deployments"`    // every deployment if empty
+}
+
+// ApplyEnv overrides c with the OS_* environment variables that are
+// set, as the OpenStack CLI reads them.
+func (c *Config) ApplyEnv() {
+	for name, field := range map[string]*string{
+		"OS_AUTH_URL":            &c.AuthURL,
+		"OS_USERNAME":            &c.Username,
+		"OS_PASSWORD":            (*string)(&c.Password),
+		"OS_USER_DOMAIN_NAME":    &c.UserDomain,
+		"OS_PROJECT_NAME":        &c.Project,
+		"OS_PROJECT_DOMAIN_NAME": &c.ProjectDomain,
+		"OS_REGION_NAME":         &c.Region,
+		"OS_CACERT":              &c.CACert,
+	} {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+}
+
+// setDefaults fills in the optional settings that aren't set.
+func (c *Config) setDefaults() {
+	if c.UserDomain == "" {
+		c.UserDomain = "Default"
+	}
+	if c.ProjectDomain == "" {
+		c.ProjectDomain = "Default"
+	}
+	if c.GroupPrefix == "" {
+		c.GroupPrefix = DefaultGroupPrefix
+	}
+}
+
+// Validate returns every problem with c.
+func (c Config) Validate() []error {
+	var errs []error
+	for _, required := range []struct{ name, value string }{
+		{"auth-url", c.AuthURL},
+		{"username", c.Username},
+		{"password", string(c.Password)},
+		{"project", c.Project},
+	} {
+		if required.value == "" {
+			errs = append(errs, errors.New(required.name+" is required"))
+		}
+	}
+	if c.AuthURL != "" {
+		if u, err := url.Parse(c.AuthURL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid auth-url %q", c.AuthURL))
+		}
+	}
+	if c.CACert != "" {
+		if _, err := loadCACert(c.CACert); err != nil {
+			errs = append(errs, fmt.Errorf("cacert: %v", err))
+		}
+	}
+	return errs
+}
+
+// Unverified reports whether magnet connects to OpenStack without
+// verifying its identity, because the auth URL is http.
+func (c Config) Unverified() bool {
+	u, err := url.Parse(c.AuthURL)
+	return err == nil && u.Scheme == "http"
+}
+
+// managed reports whether magnet manages the servers of deployment.
+func (c *Config) managed(deployment string) bool {
+	if len(c.Deployments) == 0 {
+		return true
+	}
+	for _, d := range c.Deployments {
+		if d == deployment {
+			return true
+		}
+	}
+	return false
+}
+
+func loadCACert(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s contains no PEM certificates", path)
+	}
+	return pool, nil
+}
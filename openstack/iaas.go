@@ -0,0 +1,425 @@
+// Package openstack implements magnet.IaaS for Cloud Foundry deployments
+// on OpenStack, using Nova server groups as rules.
+package openstack
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// Server group policies.
+const (
+	PolicyAntiAffinity     = "anti-affinity"
+	PolicySoftAntiAffinity = "soft-anti-affinity"
+	PolicyAffinity         = "affinity"
+	PolicySoftAffinity     = "soft-affinity"
+)
+
+// IaaS is an OpenStack project.  Each server group in the project whose
+// name starts with the configured prefix is a rule, unless all of its
+// members belong to deployments that magnet doesn't manage.  Each server
+// with BOSH metadata is a VM of a job.
+//
+// Nova only places a server in a group when it boots, so Converge can
+// create and delete groups, but not change their members.  Instead, it
+// returns an *ActionsError listing the servers that an operator must
+// recreate in a group (for example with a BOSH VM extension that sets
+// the scheduler hint) or cold-migrate to another host, which Check
+// reports as pending actions rather than a failure.
+//
+// Unlike vsphere.IaaS, it doesn't back up the rules before changing them.
+type IaaS struct {
+	// Instances, if non-nil, identifies the job, index, deployment and
+	// AZ of each server, which is joined to its instance by ID (the VM
+	// CID).  Servers it doesn't describe are identified by their BOSH
+	// metadata, as are all servers if it fails.
+	Instances magnet.InstanceSource
+
+	// Auditor, if non-nil, records every server group change made by
+	// Converge.
+	Auditor magnet.Auditor
+
+	config *Config
+	client *http.Client
+	log    magnet.Logger
+}
+
+// New creates an IaaS configured by the environment variables of the
+// OpenStack CLI:
+//   - OS_AUTH_URL             (required)
+//   - OS_USERNAME             (required)
+//   - OS_PASSWORD             (required)
+//   - OS_USER_DOMAIN_NAME     (default "Default")
+//   - OS_PROJECT_NAME         (required)
+//   - OS_PROJECT_DOMAIN_NAME  (default "Default")
+//   - OS_REGION_NAME          (default "", any region)
+//   - OS_CACERT               (default "", the system's CAs)
+//
+// If l is nil, nothing is logged.
+func New(l magnet.Logger) (*IaaS, error) {
+	var config Config
+	config.ApplyEnv()
+	return NewFromConfig(config, l)
+}
+
+// NewFromConfig creates an IaaS for the project described by config.
+// If l is nil, nothing is logged.
+func NewFromConfig(config Config, l magnet.Logger) (*IaaS, error) {
+	if l == nil {
+		l = magnet.NopLogger()
+	}
+	if errs := config.Validate(); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return nil, fmt.Errorf("openstack: %s", strings.Join(msgs, "; "))
+	}
+	config.setDefaults()
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{}}
+	if config.CACert != "" {
+		roots, err := loadCACert(config.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("openstack: %v", err)
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+	i := &IaaS{
+		config: &config,
+		client: &http.Client{Timeout: time.Minute, Transport: transport},
+		log:    l.With("project", config.Project),
+	}
+	if config.Unverified() {
+		i.log.Warn("the identity of Keystone will not be verified")
+	}
+	return i, nil
+}
+
+// ProjectName is the name of the project that magnet manages.
+func (i *IaaS) ProjectName() string {
+	return i.config.Project
+}
+
+// Unverified reports whether the IaaS connects to OpenStack without
+// verifying its identity.
+func (i *IaaS) Unverified() bool {
+	return i.config.Unverified()
+}
+
+// State lists the project's servers, hosts and server groups.
+func (i *IaaS) State(ctx context.Context) (*magnet.State, error) {
+	s, err := i.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	servers, err := s.servers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.serverGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hypervisors, err := s.hypervisors(ctx)
+	if se, ok := err.(*statusError); ok && se.code == http.StatusForbidden {
+		i.log.Warn("not allowed to list hypervisors, so only counting the hosts that run servers")
+		hypervisors, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return i.toState(ctx, s.project, servers, groups, hypervisors), nil
+}
+
+func (i *IaaS) toState(ctx context.Context, project string, servers []server, groups []serverGroup, hypervisors []string) *magnet.State {
+	state := &magnet.State{
+		RuleContainer: "project:" + project,
+		VMContainer:   "project:" + project,
+	}
+	instances := i.instances(ctx)
+
+	hosts := make(map[string]*magnet.Host)
+	addHost := func(name string) {
+		if _, ok := hosts[name]; !ok && name != "" {
+			hosts[name] = &magnet.Host{ID: name, Name: name}
+			state.Hosts = append(state.Hosts, hosts[name])
+		}
+	}
+	for _, h := range hypervisors {
+		addHost(h)
+	}
+
+	vmLookup := make(map[string]*magnet.VM)
+	for j := range servers {
+		srv := &servers[j]
+		v := &magnet.VM{
+			Name:       srv.Name,
+			ID:         srv.ID,
+			Reference:  srv.ID,
+			HostUUID:   srv.host(),
+			HostName:   srv.Hypervisor,
+			Job:        srv.Metadata["job"],
+			Index:      srv.Metadata["index"],
+			Deployment: srv.Metadata["deployment"],
+		}
+		if v.Job == "" {
+			v.Job = srv.Metadata["instance_group"]
+		}
+		if in, ok := instances[srv.ID]; ok {
+			v.Job, v.Index, v.Deployment, v.AZ = in.Job, in.Index, in.Deployment, in.AZ
+		}
+		vmLookup[srv.ID] = v
+		if v.Job == "" || !i.config.managed(v.Deployment) {
+			continue
+		}
+		if len(hypervisors) == 0 {
+			addHost(v.HostUUID)
+		}
+		state.VMs = append(state.VMs, v)
+	}
+
+	for _, g := range groups {
+		if !strings.HasPrefix(g.Name, i.config.GroupPrefix) {
+			continue
+		}
+		r := &magnet.Rule{
+			Name:    strings.TrimPrefix(g.Name, i.config.GroupPrefix),
+			ID:      g.ID,
+			Enabled: true,
+			VMs:     []*magnet.VM{},
+		}
+		switch g.policy() {
+		case PolicyAntiAffinity:
+			r.Mandatory = true
+		case PolicySoftAntiAffinity:
+		case PolicyAffinity:
+			r.Mandatory, r.Affinity = true, true
+		case PolicySoftAffinity:
+			r.Affinity = true
+		default:
+			continue
+		}
+		unmanaged := 0
+		for _, id := range g.Members {
+			v, ok := vmLookup[id]
+			switch {
+			case !ok:
+			case v.Job == "" || !i.config.managed(v.Deployment):
+				unmanaged++
+			default:
+				r.VMs = append(r.VMs, v)
+			}
+		}
+		// the group of deployments that magnet doesn't manage
+		if len(r.VMs) == 0 && unmanaged > 0 {
+			continue
+		}
+		// Nova doesn't report compliance, but only a hard policy can be violated
+		if r.Mandatory {
+			r.Violated = len(r.Colocated()) > 0 || r.Affinity && len(hostsOf(r.VMs)) > 1
+		}
+		state.Rules = append(state.Rules, r)
+	}
+	return state
+}
+
+// instances returns the instances that i.Instances describes, by CID.
+func (i *IaaS) instances(ctx context.Context) map[string]magnet.Instance {
+	byCID, err := magnet.InstancesByCID(ctx, i.Instances)
+	if err != nil {
+		i.log.Warn("failed to list BOSH instances, using server metadata", "err", err)
+	}
+	return byCID
+}
+
+// policy returns the server group policy for r.
+func policy(r *magnet.Rule) string {
+	switch {
+	case r.Affinity && r.Mandatory:
+		return PolicyAffinity
+	case r.Affinity:
+		return PolicySoftAffinity
+	case r.Mandatory:
+		return PolicyAntiAffinity
+	}
+	return PolicySoftAntiAffinity
+}
+
+// Action is a change to a server that Converge can't make itself.
+type Action struct {
+	Type   string // ActionRecreate or ActionMigrate
+	Server string // the server's name
+	ID     string // the server's ID
+	Group  string // the rule's name, without the group prefix
+	// GroupID is the ID of the group to recreate the server in.
+	GroupID string
+}
+
+// Action types.
+const (
+	// ActionRecreate means that the server must be recreated in the
+	// group, since Nova only adds servers to groups when they boot.
+	ActionRecreate = "recreate"
+
+	// ActionMigrate means that the server shares a host with another
+	// member of its group, and should be cold-migrated, which lets
+	// the scheduler apply the group's policy.
+	ActionMigrate = "migrate"
+)
+
+// ActionsError is the error returned by Converge when servers must be
+// recreated or migrated before the rules are satisfied.  It is a
+// magnet.PendingError, so Check doesn't treat it as a failure.
+type ActionsError struct {
+	Actions []Action
+}
+
+func (e *ActionsError) Error() string {
+	return fmt.Sprintf("openstack: %d servers need to be recreated or migrated: %s",
+		len(e.Actions), strings.Join(e.Pending(), ", "))
+}
+
+// Pending describes each action, such as "recreate router-3 (router)".
+func (e *ActionsError) Pending() []string {
+	pending := make([]string, len(e.Actions))
+	for j, a := range e.Actions {
+		pending[j] = fmt.Sprintf("%s %s (%s)", a.Type, a.Server, a.Group)
+	}
+	return pending
+}
+
+// Converge creates the missing server groups and deletes the stale
+// ones.  A stale group that is replaced by a missing group with the same
+// name and policy is kept, since only its members differ.  If servers
+// must then be recreated or migrated, it returns an *ActionsError.  The
+// migrations that would fix the valid groups are only logged, since
+// their violations are already reported with the state, and failing
+// every poll wouldn't fix them.  If i has an Auditor, Converge records
+// the group changes and their outcome.
+func (i *IaaS) Converge(ctx context.Context, state *magnet.State, rec *magnet.RuleRecommendation) error {
+	var entries []magnet.AuditEntry
+	if i.Auditor != nil {
+		entries = magnet.AuditEntries(i.config.Username, state, rec)
+	}
+	err := i.converge(ctx, state, rec)
+	if auditErr := magnet.RecordAudit(i.Auditor, entries, "", err); auditErr != nil {
+		i.log.With("cluster", state.RuleContainer).Error("failed to write audit log", "err", auditErr)
+		if err == nil {
+			return fmt.Errorf("openstack: failed to write audit log: %v", auditErr)
+		}
+	}
+	return err
+}
+
+// converge makes the changes that Converge records.
+func (i *IaaS) converge(ctx context.Context, state *magnet.State, rec *magnet.RuleRecommendation) error {
+	s, err := i.login(ctx)
+	if err != nil {
+		return err
+	}
+	log := i.log.With("cluster", state.RuleContainer)
+
+	stale := make(map[string]*magnet.Rule)
+	for j := range rec.Stale {
+		stale[rec.Stale[j].Name] = &rec.Stale[j]
+	}
+	var actions []Action
+	kept := make(map[string]bool)
+	for j := range rec.Missing {
+		r := &rec.Missing[j]
+		if r.Hosts != nil {
+			log.Warn("VM/Host rules aren't supported on OpenStack", "rule", r.Name)
+			continue
+		}
+		members := make(map[string]bool)
+		groupID := ""
+		if old, ok := stale[r.Name]; ok && policy(old) == policy(r) {
+			kept[old.ID] = true
+			groupID = old.ID
+			for _, vm := range old.VMs {
+				members[vm.ID] = true
+			}
+			actions = append(actions, migrations(old, len(state.Hosts))...)
+		} else {
+			g, err := s.createServerGroup(ctx, i.config.GroupPrefix+r.Name, policy(r))
+			if err != nil {
+				log.Error("failed to create server group", "rule", r.Name, "err", err)
+				return err
+			}
+			groupID = g.ID
+			log.Info("created server group", "rule", r.Name, "id", g.ID, "policy", policy(r))
+		}
+		for _, vm := range r.VMs {
+			if !members[vm.ID] {
+				actions = append(actions, Action{Type: ActionRecreate, Server: vm.Name, ID: vm.ID, Group: r.Name, GroupID: groupID})
+			}
+		}
+	}
+
+	for _, r := range rec.Stale {
+		if kept[r.ID] {
+			continue
+		}
+		if err = s.deleteServerGroup(ctx, r.ID); err != nil {
+			log.Error("failed to delete server group", "rule", r.Name, "id", r.ID, "err", err)
+			return err
+		}
+		log.Info("deleted server group", "rule", r.Name, "id", r.ID)
+	}
+
+	for j := range rec.Valid {
+		for _, a := range migrations(&rec.Valid[j], len(state.Hosts)) {
+			log.Warn("server should be migrated", "server", a.Server, "id", a.ID, "group", a.Group, "group_id", a.GroupID)
+		}
+	}
+	if len(actions) == 0 {
+		return nil
+	}
+	for _, a := range actions {
+		log.Warn("server needs to be "+a.Type+"d", "server", a.Server, "id", a.ID, "group", a.Group, "group_id", a.GroupID)
+	}
+	return &ActionsError{Actions: actions}
+}
+
+// migrations returns the migrations that would fix the violations
+// of r, an anti-affinity rule: every co-located member but one.  There
+// are none if r has more members than there are hosts, since the
+// scheduler couldn't place them.
+func migrations(r *magnet.Rule, hosts int) []Action {
+	if !r.Violated || !r.Mandatory || len(r.VMs) > hosts {
+		return nil
+	}
+	colocated := r.Colocated()
+	names := make([]string, 0, len(colocated))
+	for host := range colocated {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	var actions []Action
+	for _, host := range names {
+		for _, vm := range colocated[host][1:] {
+			actions = append(actions, Action{Type: ActionMigrate, Server: vm.Name, ID: vm.ID, Group: r.Name, GroupID: r.ID})
+		}
+	}
+	return actions
+}
+
+// hostsOf returns the distinct hosts of vms.
+func hostsOf(vms []*magnet.VM) []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, vm := range vms {
+		if !seen[vm.HostUUID] {
+			seen[vm.HostUUID] = true
+			hosts = append(hosts, vm.HostUUID)
+		}
+	}
+	return hosts
+}
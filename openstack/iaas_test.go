@@ -0,0 +1,375 @@
+package openstack_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/mock"
+	"github.com/pivotalservices/magnet/openstack"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeOpenStack serves the parts of the Keystone and Nova APIs that
+// magnet uses, with three of four hypervisors up.
+type fakeOpenStack struct {
+	*httptest.Server
+	admin   bool // whether the user may see the hypervisors
+	groups  []map[string]interface{}
+	created []string // the names and policies of the created groups
+	deleted []string // the IDs of the deleted groups
+}
+
+var fakeServers = []map[string]interface{}{
+	{"id": "vm-1", "name": "router-1", "hostId": "host-a", "OS-EXT-SRV-ATTR:hypervisor_hostname": "h1",
+		"metadata": map[string]string{"job": "router", "index": "0", "deployment": "cf"}},
+	{"id": "vm-2", "name": "router-2", "hostId": "host-a", "OS-EXT-SRV-ATTR:hypervisor_hostname": "h1",
+		"metadata": map[string]string{"job": "router", "index": "1", "deployment": "cf"}},
+	{"id": "vm-3", "name": "nats-1", "hostId": "host-b", "OS-EXT-SRV-ATTR:hypervisor_hostname": "h2",
+		"metadata": map[string]string{"instance_group": "nats", "index": "0", "deployment": "cf"}},
+	{"id": "vm-4", "name": "nats-2", "hostId": "host-c", "OS-EXT-SRV-ATTR:hypervisor_hostname": "h3",
+		"metadata": map[string]string{"instance_group": "nats", "index": "1", "deployment": "cf"}},
+	{"id": "vm-5", "name": "mysql-1", "hostId": "host-b", "OS-EXT-SRV-ATTR:hypervisor_hostname": "h2",
+		"metadata": map[string]string{"job": "mysql", "index": "0", "deployment": "mysql"}},
+	{"id": "vm-6", "name": "jumpbox", "hostId": "host-c", "OS-EXT-SRV-ATTR:hypervisor_hostname": "h3",
+		"metadata": map[string]string{}},
+}
+
+func newFakeOpenStack(admin bool) *fakeOpenStack {
+	f := &fakeOpenStack{
+		admin: admin,
+		groups: []map[string]interface{}{
+			{"id": "g-1", "name": "magnet-router", "policies": []string{"anti-affinity"}, "members": []string{"vm-1", "vm-2"}},
+			{"id": "g-2", "name": "magnet-old", "policies": []string{"soft-anti-affinity"}, "members": []string{"vm-3"}},
+			{"id": "g-3", "name": "web", "policies": []string{"anti-affinity"}, "members": []string{"vm-6"}},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/identity/v3/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Auth struct {
+				Identity struct {
+					Password struct {
+						User struct {
+							Name     string `json:"name"`
+							Password string `json:"password"`
+						} `json:"user"`
+					} `json:"password"`
+				} `json:"identity"`
+				Scope struct {
+					Project struct {
+						Name string `json:"name"`
+					} `json:"project"`
+				} `json:"scope"`
+			} `json:"auth"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		user := body.Auth.Identity.Password.User
+		if r.Method != http.MethodPost || user.Name != "magnet" || user.Password != "s3cret" || body.Auth.Scope.Project.Name != "cf" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Subject-Token", "token-1")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": {"project": {"id": "p-1"}, "catalog": [
+			{"type": "identity", "endpoints": [{"interface": "public", "region": "r1", "url": "%[1]s/identity"}]},
+			{"type": "compute", "endpoints": [
+				{"interface": "internal", "region": "r1", "url": "http://10.0.0.1/compute"},
+				{"interface": "public", "region": "r1", "url": "%[1]s/compute/v2.1/"}
+			]}
+		]}}`, f.URL)
+	})
+	nova := http.NewServeMux()
+	nova.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+		servers := make([]map[string]interface{}, len(fakeServers))
+		for i, s := range fakeServers {
+			servers[i] = make(map[string]interface{})
+			for k, v := range s {
+				if k != "OS-EXT-SRV-ATTR:hypervisor_hostname" || f.admin {
+					servers[i][k] = v
+				}
+			}
+		}
+		// two pages, to check that magnet follows the link
+		page := map[string]interface{}{
+			"servers":       servers[:3],
+			"servers_links": []map[string]string{{"rel": "next", "href": f.URL + "/compute/v2.1/servers/detail?marker=vm-3"}},
+		}
+		if r.FormValue("marker") == "vm-3" {
+			page = map[string]interface{}{"servers": servers[3:]}
+		}
+		json.NewEncoder(w).Encode(page)
+	})
+	nova.HandleFunc("/os-hypervisors/detail", func(w http.ResponseWriter, r *http.Request) {
+		if !f.admin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"hypervisors": [
+			{"hypervisor_hostname": "h1", "state": "up", "status": "enabled"},
+			{"hypervisor_hostname": "h2", "state": "up", "status": "enabled"},
+			{"hypervisor_hostname": "h3", "state": "up", "status": "enabled"},
+			{"hypervisor_hostname": "h4", "state": "down", "status": "enabled"}
+		]}`)
+	})
+	nova.HandleFunc("/os-server-groups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var body struct {
+				Group struct {
+					Name     string   `json:"name"`
+					Policies []string `json:"policies"`
+				} `json:"server_group"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			f.created = append(f.created, body.Group.Name+":"+strings.Join(body.Group.Policies, ","))
+			fmt.Fprintf(w, `{"server_group": {"id": "g-%d", "name": %q, "policies": %q, "members": []}}`,
+				len(f.groups)+len(f.created), body.Group.Name, body.Group.Policies)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"server_groups": f.groups})
+	})
+	nova.HandleFunc("/os-server-groups/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		f.deleted = append(f.deleted, strings.TrimPrefix(r.URL.Path, "/os-server-groups/"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.Handle("/compute/v2.1/", http.StripPrefix("/compute/v2.1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Auth-Token") != "token-1" || r.Header.Get("X-OpenStack-Nova-API-Version") != "2.15" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		nova.ServeHTTP(w, r)
+	})))
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeOpenStack) config() openstack.Config {
+	return openstack.Config{AuthURL: f.URL + "/identity", Username: "magnet", Password: "s3cret", Project: "cf", Region: "r1"}
+}
+
+// auditor keeps the entries it records.
+type auditor struct {
+	entries []magnet.AuditEntry
+}
+
+func (a *auditor) Record(entries ...magnet.AuditEntry) error {
+	a.entries = append(a.entries, entries...)
+	return nil
+}
+
+func vmNames(vms []*magnet.VM) []string {
+	names := make([]string, len(vms))
+	for i, vm := range vms {
+		names[i] = vm.Name
+	}
+	return names
+}
+
+var _ = Describe("IaaS", func() {
+	var fake *fakeOpenStack
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	It("lists the servers of BOSH jobs, the hypervisors and the server groups", func() {
+		fake = newFakeOpenStack(true)
+		i, err := openstack.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(i.Unverified()).Should(BeTrue())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(state.RuleContainer).Should(Equal("project:p-1"))
+		Ω(vmNames(state.VMs)).Should(Equal([]string{"router-1", "router-2", "nats-1", "nats-2", "mysql-1"}))
+		Ω(*state.VMs[2]).Should(Equal(magnet.VM{
+			Name: "nats-1", ID: "vm-3", Reference: "vm-3", HostUUID: "h2", HostName: "h2",
+			Job: "nats", Index: "0", Deployment: "cf",
+		}))
+		Ω(state.Hosts).Should(HaveLen(3))
+		Ω(state.Rules).Should(HaveLen(2))
+		router := state.Rules[0]
+		Ω(router.Name).Should(Equal("router"))
+		Ω(router.ID).Should(Equal("g-1"))
+		Ω(router.Mandatory).Should(BeTrue())
+		Ω(router.Violated).Should(BeTrue())
+		Ω(vmNames(router.VMs)).Should(Equal([]string{"router-1", "router-2"}))
+		Ω(state.Rules[1].Name).Should(Equal("old"))
+		Ω(state.Rules[1].Mandatory).Should(BeFalse())
+		Ω(state.Rules[1].Violated).Should(BeFalse())
+	})
+
+	It("ignores the server groups of other deployments", func() {
+		fake = newFakeOpenStack(true)
+		c := fake.config()
+		c.Deployments = []string{"mysql"}
+		i, err := openstack.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(state.Rules).Should(BeEmpty())
+		Ω(magnet.RuleRecommendations(state).Stale).Should(BeEmpty())
+	})
+
+	It("only lists the configured deployments, identifying servers with the BOSH director", func() {
+		fake = newFakeOpenStack(true)
+		c := fake.config()
+		c.Deployments = []string{"mysql"}
+		i, err := openstack.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		i.Instances = mock.Instances{{Deployment: "mysql", Job: "mysql", Index: "1", AZ: "z2", CID: "vm-6"}}
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(vmNames(state.VMs)).Should(Equal([]string{"mysql-1", "jumpbox"}))
+		Ω(state.VMs[1].AZ).Should(Equal("z2"))
+	})
+
+	It("counts the hosts of the servers if it can't list the hypervisors", func() {
+		fake = newFakeOpenStack(false)
+		i, err := openstack.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(state.Hosts).Should(Equal([]*magnet.Host{
+			{ID: "host-a", Name: "host-a"},
+			{ID: "host-b", Name: "host-b"},
+			{ID: "host-c", Name: "host-c"},
+		}))
+		Ω(state.VMs[0].HostUUID).Should(Equal("host-a"))
+		Ω(state.Rules[0].Violated).Should(BeTrue())
+	})
+
+	It("creates and deletes server groups, and reports the servers to recreate or migrate", func() {
+		fake = newFakeOpenStack(true)
+		i, err := openstack.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// the router group's members are unchanged, but it has a third VM
+		router := *state.Rules[0]
+		missing := router
+		missing.ID = ""
+		missing.VMs = append([]*magnet.VM{}, router.VMs...)
+		missing.VMs = append(missing.VMs, &magnet.VM{Name: "router-3", ID: "vm-7"})
+		nats := magnet.Rule{Name: "nats", Enabled: true, VMs: state.VMs[2:4]}
+		rec := &magnet.RuleRecommendation{
+			Stale:   []magnet.Rule{router, *state.Rules[1]},
+			Missing: []magnet.Rule{missing, nats},
+		}
+		err = i.Converge(context.Background(), state, rec)
+		Ω(fake.created).Should(Equal([]string{"magnet-nats:soft-anti-affinity"}))
+		Ω(fake.deleted).Should(Equal([]string{"g-2"}))
+
+		Ω(err).Should(BeAssignableToTypeOf(&openstack.ActionsError{}))
+		Ω(err.(*openstack.ActionsError).Actions).Should(Equal([]openstack.Action{
+			{Type: openstack.ActionMigrate, Server: "router-2", ID: "vm-2", Group: "router", GroupID: "g-1"},
+			{Type: openstack.ActionRecreate, Server: "router-3", ID: "vm-7", Group: "router", GroupID: "g-1"},
+			{Type: openstack.ActionRecreate, Server: "nats-1", ID: "vm-3", Group: "nats", GroupID: "g-4"},
+			{Type: openstack.ActionRecreate, Server: "nats-2", ID: "vm-4", Group: "nats", GroupID: "g-4"},
+		}))
+	})
+
+	It("replaces a server group whose policy changed", func() {
+		fake = newFakeOpenStack(true)
+		i, err := openstack.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		old := *state.Rules[1]
+		soft := *state.Rules[0]
+		soft.ID, soft.Mandatory = "", false
+		rec := &magnet.RuleRecommendation{
+			Valid:   []magnet.Rule{old},
+			Stale:   []magnet.Rule{*state.Rules[0]},
+			Missing: []magnet.Rule{soft},
+		}
+		err = i.Converge(context.Background(), state, rec)
+		Ω(fake.created).Should(Equal([]string{"magnet-router:soft-anti-affinity"}))
+		Ω(fake.deleted).Should(Equal([]string{"g-1"}))
+		Ω(err).Should(MatchError(ContainSubstring("recreate router-1 (router), recreate router-2 (router)")))
+	})
+
+	It("audits the server group changes", func() {
+		fake = newFakeOpenStack(true)
+		i, err := openstack.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		a := &auditor{}
+		i.Auditor = a
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		rec := &magnet.RuleRecommendation{Stale: []magnet.Rule{*state.Rules[1]}}
+		Ω(i.Converge(context.Background(), state, rec)).Should(Succeed())
+		Ω(fake.deleted).Should(Equal([]string{"g-2"}))
+		Ω(a.entries).Should(HaveLen(1))
+		Ω(a.entries[0].User).Should(Equal("magnet"))
+		Ω(a.entries[0].Action).Should(Equal(magnet.AuditRemove))
+		Ω(a.entries[0].Rule).Should(Equal("old"))
+		Ω(a.entries[0].VMsBefore).Should(Equal([]string{"nats-1"}))
+		Ω(a.entries[0].Result).Should(Equal(magnet.AuditSuccess))
+	})
+
+	It("doesn't fail because a valid server group is violated", func() {
+		fake = newFakeOpenStack(true)
+		i, err := openstack.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(state.Rules[0].Violated).Should(BeTrue())
+
+		rec := &magnet.RuleRecommendation{Valid: []magnet.Rule{*state.Rules[0], *state.Rules[1]}}
+		Ω(i.Converge(context.Background(), state, rec)).Should(Succeed())
+		Ω(fake.created).Should(BeEmpty())
+		Ω(fake.deleted).Should(BeEmpty())
+	})
+
+	It("reports bad credentials", func() {
+		fake = newFakeOpenStack(true)
+		c := fake.config()
+		c.Password = "wrong"
+		i, err := openstack.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = i.State(context.Background())
+		Ω(err).Should(MatchError(ContainSubstring("401")))
+	})
+})
+
+var _ = Describe("Config", func() {
+	It("reads the OpenStack CLI's environment variables", func() {
+		for name, value := range map[string]string{
+			"OS_AUTH_URL":     "https://keystone.example.com:5000/v3",
+			"OS_USERNAME":     "magnet",
+			"OS_PASSWORD":     "s3cret",
+			"OS_PROJECT_NAME": "cf",
+			"OS_REGION_NAME":  "RegionOne",
+		} {
+			os.Setenv(name, value)
+			defer os.Unsetenv(name)
+		}
+		var c openstack.Config
+		c.ApplyEnv()
+		Ω(c).Should(Equal(openstack.Config{
+			AuthURL: "https://keystone.example.com:5000/v3", Username: "magnet", Password: "s3cret",
+			Project: "cf", Region: "RegionOne",
+		}))
+		Ω(c.Validate()).Should(BeEmpty())
+		Ω(c.Unverified()).Should(BeFalse())
+	})
+
+	It("validates the settings", func() {
+		c := openstack.Config{AuthURL: "keystone", CACert: "/does/not/exist"}
+		Ω(c.Validate()).Should(HaveLen(5))
+	})
+})
@@ -1,6 +1,7 @@
 package magnet
 
 import (
+	"fmt"
 	"io"
 	"os"
 
@@ -12,6 +13,9 @@ var (
 	// output is the writer that magnet writes its output to
 	output io.Writer = os.Stdout
 
+	// format is the format that magnet writes its output in
+	format = OutputText
+
 	redSprintf   = color.New(color.FgRed).SprintfFunc()
 	greenSprintf = color.New(color.FgGreen).SprintfFunc()
 )
@@ -29,3 +33,53 @@ func SetOutput(w io.Writer) {
 		color.NoColor = true
 	}
 }
+
+// Supported output formats.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputYAML = "yaml"
+)
+
+// SetFormat can be used to customize the format magnet writes its output in.
+// Text is written by default.  JSON and YAML output follow the Report schema.
+func SetFormat(f string) error {
+	switch f {
+	case OutputText, OutputJSON, OutputYAML:
+		format = f
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q", f)
+}
+
+// PrintState writes the jobs of s, and rec if it is non-nil,
+// to the output in the configured format.
+func PrintState(s *State, rec *RuleRecommendation) error {
+	return printState(s, rec, nil)
+}
+
+// printState is PrintState, which also reports that limitErr, if
+// non-nil, stopped the check from converging.
+func printState(s *State, rec *RuleRecommendation, limitErr error) error {
+	if format != OutputText {
+		r := NewReport(s, rec)
+		if limitErr != nil {
+			r.LimitExceeded = limitErr.Error()
+		}
+		return r.Write(output, format)
+	}
+	PrintJobs(s)
+	if rec != nil {
+		rec.PrintReport()
+	} else {
+		rules := make([]Rule, len(s.Rules))
+		for i := range s.Rules {
+			rules[i] = *s.Rules[i]
+		}
+		printViolations(rules)
+	}
+	if limitErr != nil {
+		fmt.Fprintln(output, redSprintf("NOT CONVERGING: %s", limitErr))
+	}
+	return nil
+}
@@ -0,0 +1,451 @@
+package magnet
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule strengths.
+const (
+	RulePreferred = "preferred"
+	RuleMandatory = "mandatory"
+)
+
+// JobPolicy describes how magnet treats the VMs of a job.  The zero
+// JobPolicy spreads the VMs as evenly as possible across the hosts,
+// with a preferred anti-affinity rule.
+type JobPolicy struct {
+	// Jobs are the names of the jobs the policy applies to, or patterns
+	// matched with path.Match.  They are only used in a Policies list.
+	Jobs []string `yaml:"jobs"`
+
+	// Ignore leaves the job alone: it is never unbalanced and has no rule.
+	Ignore bool `yaml:"ignore"`
+
+	// Strength is RulePreferred or RuleMandatory.  If empty, new rules
+	// are preferred and the strength of existing rules is left alone.
+	Strength string `yaml:"rule"`
+
+	// MinHosts, if positive, is the fewest distinct hosts the VMs must
+	// run on (or all of them, if there are fewer hosts or VMs).
+	MinHosts int `yaml:"min-hosts"`
+
+	// MaxPerHost, if positive, is the most VMs of the job on any host.
+	MaxPerHost int `yaml:"max-per-host"`
+
+	// Slack is how many more VMs than an even spread a host may run.
+	Slack int `yaml:"slack"`
+
+	// Group, if set, spreads the VMs of every job with the same Group
+	// across the hosts together, as if they were the VMs of one job
+	// named Group, with a single rule.  The group takes the policy of
+	// its first job by name.
+	Group string `yaml:"group"`
+
+	// With are the jobs to keep each VM of the job on the same host as,
+	// pairwise by instance index: VM 0 of the job with VM 0 of each of
+	// them, and so on.  Each pair gets its own affinity rule.
+	With []string `yaml:"with"`
+
+	// Hosts, if non-nil, pins the VMs of the job to the hosts it selects
+	// with a VM/Host rule, which is a "must run" rule if Strength is
+	// RuleMandatory and a "should run" rule otherwise.  The VMs are
+	// spread across the selected hosts only.
+	Hosts *HostSelector `yaml:"hosts"`
+}
+
+// HostSelector selects hosts by name or custom attribute.  A host is
+// selected if it matches any of Names, Pattern or Attribute.
+type HostSelector struct {
+	// Names are host names, or patterns matched with path.Match.
+	Names []string `yaml:"names"`
+
+	// Pattern is a regular expression that matches host names.
+	Pattern string `yaml:"pattern"`
+
+	// Attribute selects hosts with a custom attribute, as name=value.
+	Attribute string `yaml:"attribute"`
+}
+
+// Validate returns every problem with h.
+func (h *HostSelector) Validate() []error {
+	var errs []error
+	if len(h.Names) == 0 && h.Pattern == "" && h.Attribute == "" {
+		errs = append(errs, fmt.Errorf("hosts must have names, a pattern or an attribute"))
+	}
+	for _, pattern := range h.Names {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("malformed host pattern %q", pattern))
+		}
+	}
+	if _, err := regexp.Compile(h.Pattern); err != nil {
+		errs = append(errs, fmt.Errorf("malformed host pattern %q: %v", h.Pattern, err))
+	}
+	if h.Attribute != "" && !strings.Contains(h.Attribute, "=") {
+		errs = append(errs, fmt.Errorf("host attribute %q must be name=value", h.Attribute))
+	}
+	return errs
+}
+
+// Select returns the hosts that h selects.
+func (h *HostSelector) Select(hosts []*Host) []*Host {
+	var re *regexp.Regexp
+	if h.Pattern != "" {
+		re, _ = regexp.Compile(h.Pattern)
+	}
+	attr := strings.SplitN(h.Attribute, "=", 2)
+
+	var selected []*Host
+	for _, host := range hosts {
+		match := re != nil && re.MatchString(host.Name)
+		for _, pattern := range h.Names {
+			if ok, _ := path.Match(pattern, host.Name); ok {
+				match = true
+			}
+		}
+		if len(attr) == 2 {
+			if v, ok := host.Attributes[attr[0]]; ok && v == attr[1] {
+				match = true
+			}
+		}
+		if match {
+			selected = append(selected, host)
+		}
+	}
+	return selected
+}
+
+// ParseJobPolicy parses a policy written as comma-separated settings,
+// such as "mandatory,min-hosts=3,max-per-host=1,slack=0", "group=quorum",
+// "with=sidecar", "hosts=esx-gpu-*", "host-attribute=gpu=true" or "ignore".
+func ParseJobPolicy(s string) (JobPolicy, error) {
+	var p JobPolicy
+	for _, setting := range strings.Split(s, ",") {
+		setting = strings.TrimSpace(setting)
+		parts := strings.SplitN(setting, "=", 2)
+		switch parts[0] {
+		case "":
+			continue
+		case "group":
+			if len(parts) != 2 || parts[1] == "" {
+				return p, fmt.Errorf("policy setting %q needs a value", parts[0])
+			}
+			p.Group = parts[1]
+			continue
+		case "with":
+			if len(parts) != 2 || parts[1] == "" {
+				return p, fmt.Errorf("policy setting %q needs a value", parts[0])
+			}
+			p.With = append(p.With, parts[1])
+			continue
+		case "hosts", "host-attribute":
+			if len(parts) != 2 || parts[1] == "" {
+				return p, fmt.Errorf("policy setting %q needs a value", parts[0])
+			}
+			if p.Hosts == nil {
+				p.Hosts = &HostSelector{}
+			}
+			if parts[0] == "hosts" {
+				p.Hosts.Names = append(p.Hosts.Names, parts[1])
+			} else {
+				p.Hosts.Attribute = parts[1]
+			}
+			continue
+		case "ignore":
+			p.Ignore = true
+			continue
+		case RulePreferred, RuleMandatory:
+			p.Strength = parts[0]
+			continue
+		}
+
+		var n *int
+		switch parts[0] {
+		case "min-hosts":
+			n = &p.MinHosts
+		case "max-per-host":
+			n = &p.MaxPerHost
+		case "slack":
+			n = &p.Slack
+		default:
+			return p, fmt.Errorf("unknown policy setting %q", setting)
+		}
+		if len(parts) != 2 {
+			return p, fmt.Errorf("policy setting %q needs a value", parts[0])
+		}
+		v, err := strconv.Atoi(parts[1])
+		if err != nil || v < 0 {
+			return p, fmt.Errorf("invalid value for policy setting %q", setting)
+		}
+		*n = v
+	}
+	return p, nil
+}
+
+// Validate returns every problem with p.
+func (p *JobPolicy) Validate() []error {
+	var errs []error
+	for _, pattern := range p.Jobs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("malformed job pattern %q", pattern))
+		}
+	}
+	for _, job := range p.With {
+		if job == "" {
+			errs = append(errs, fmt.Errorf("with must not include an empty job"))
+		}
+	}
+	if p.Hosts != nil {
+		errs = append(errs, p.Hosts.Validate()...)
+	}
+	switch p.Strength {
+	case "", RulePreferred, RuleMandatory:
+	default:
+		errs = append(errs, fmt.Errorf("rule must be %s or %s, not %q", RulePreferred, RuleMandatory, p.Strength))
+	}
+	for _, n := range []struct {
+		name  string
+		value int
+	}{{"min-hosts", p.MinHosts}, {"max-per-host", p.MaxPerHost}, {"slack", p.Slack}} {
+		if n.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", n.name))
+		}
+	}
+	return errs
+}
+
+// group is the VMs that are spread across the hosts together: those
+// of a single job, or of every job with the same JobPolicy Group.
+type group struct {
+	Name   string
+	Jobs   []string // sorted
+	VMs    []*VM
+	Policy JobPolicy
+}
+
+// groupOf returns the name of the group that job belongs to.
+func (s *State) groupOf(job string) string {
+	if p := s.policy(job); p.Group != "" {
+		return p.Group
+	}
+	return job
+}
+
+// groups returns the groups of the VMs of s, by name.
+func (s *State) groups() map[string]*group {
+	groups := make(map[string]*group)
+	jobs := make(map[string]bool)
+	for _, vm := range s.VMs {
+		name := s.groupOf(vm.Job)
+		g, ok := groups[name]
+		if !ok {
+			g = &group{Name: name}
+			groups[name] = g
+		}
+		g.VMs = append(g.VMs, vm)
+		if !jobs[vm.Job] {
+			jobs[vm.Job] = true
+			g.Jobs = append(g.Jobs, vm.Job)
+		}
+	}
+	for _, g := range groups {
+		sort.Strings(g.Jobs)
+		g.Policy = s.policy(g.Jobs[0])
+	}
+	return groups
+}
+
+// affinityRuleName returns the name of the rule that keeps the VMs
+// of job and with that have the given index together.
+func affinityRuleName(job, with, index string) string {
+	return job + "+" + with + "-" + index
+}
+
+// isAffinityRuleName reports whether name has the form of the names
+// that affinityRuleName returns.  Affinity rules with other names
+// were made by someone else, and are left alone.
+func isAffinityRuleName(name string) bool {
+	return strings.Contains(name, "+")
+}
+
+// affinityRules returns the affinity rules that the policies of s
+// call for, by name.
+func (s *State) affinityRules() map[string]Rule {
+	byIndex := make(map[string]map[string]*VM)
+	for _, vm := range s.VMs {
+		if vm.Index == "" {
+			continue
+		}
+		if byIndex[vm.Job] == nil {
+			byIndex[vm.Job] = make(map[string]*VM)
+		}
+		if _, ok := byIndex[vm.Job][vm.Index]; !ok {
+			byIndex[vm.Job][vm.Index] = vm
+		}
+	}
+
+	rules := make(map[string]Rule)
+	for job, vms := range byIndex {
+		p := s.policy(job)
+		if p.Ignore {
+			continue
+		}
+		for _, with := range p.With {
+			for index, vm := range vms {
+				other, ok := byIndex[with][index]
+				if !ok || with == job {
+					continue
+				}
+				name := affinityRuleName(job, with, index)
+				rules[name] = Rule{
+					Name:      name,
+					Enabled:   true,
+					Mandatory: p.Strength == RuleMandatory,
+					VMs:       []*VM{vm, other},
+					Affinity:  true,
+				}
+			}
+		}
+	}
+	return rules
+}
+
+// hostCount returns the number of hosts that VMs with policy p may
+// run on: those that its Hosts select, if any, or every host.
+func (s *State) hostCount(p JobPolicy) int {
+	if p.Hosts != nil {
+		if n := len(p.Hosts.Select(s.Hosts)); n > 0 {
+			return n
+		}
+	}
+	return len(s.Hosts)
+}
+
+// hostRuleName returns the name of the VM/Host rule of job.
+func hostRuleName(job string) string {
+	return job + "@hosts"
+}
+
+// isHostRuleName reports whether name has the form of the names
+// that hostRuleName returns.  VM/Host rules with other names were
+// made by someone else, and are left alone.
+func isHostRuleName(name string) bool {
+	return strings.HasSuffix(name, "@hosts")
+}
+
+// hostRules returns the VM/Host rules that the policies of s call
+// for, by name.  Jobs whose Hosts select no hosts get no rule.
+func (s *State) hostRules() map[string]Rule {
+	vmsForJob := make(map[string][]*VM)
+	for _, vm := range s.VMs {
+		vmsForJob[vm.Job] = append(vmsForJob[vm.Job], vm)
+	}
+	rules := make(map[string]Rule)
+	for job, vms := range vmsForJob {
+		p := s.policy(job)
+		if p.Ignore || p.Hosts == nil {
+			continue
+		}
+		hosts := p.Hosts.Select(s.Hosts)
+		if len(hosts) == 0 {
+			continue
+		}
+		name := hostRuleName(job)
+		rules[name] = Rule{
+			Name:      name,
+			Enabled:   true,
+			Mandatory: p.Strength == RuleMandatory,
+			VMs:       vms,
+			Hosts:     hosts,
+		}
+	}
+	return rules
+}
+
+// balanced reports whether the VMs of g satisfy its policy in s.
+func (g *group) balanced(s *State) bool {
+	hosts := make(hostList, len(g.VMs))
+	for i, vm := range g.VMs {
+		hosts[i] = vm.HostUUID
+	}
+	return g.Policy.balanced(hosts, s.hostCount(g.Policy))
+}
+
+// balanced reports whether VMs of a job running on hosts (one
+// entry per VM) satisfy p on a deployment with hostCount hosts.
+func (p *JobPolicy) balanced(hosts hostList, hostCount int) bool {
+	if p.Ignore || len(hosts) == 0 || hostCount == 0 {
+		return true
+	}
+	limit := int(math.Ceil(float64(len(hosts))/float64(hostCount))) + p.Slack
+	if p.MaxPerHost > 0 && p.MaxPerHost < limit {
+		limit = p.MaxPerHost
+	}
+
+	counts := make(map[string]int)
+	for _, host := range hosts {
+		counts[host]++
+		if counts[host] > limit {
+			return false
+		}
+	}
+
+	need := p.MinHosts
+	if need > hostCount {
+		need = hostCount
+	}
+	if need > len(hosts) {
+		need = len(hosts)
+	}
+	return len(counts) >= need
+}
+
+// Policies is a list of job policies.  A job gets the first policy
+// whose Jobs match it.
+type Policies []JobPolicy
+
+// Validate returns every problem with the policies.
+func (ps Policies) Validate() []error {
+	var errs []error
+	for i := range ps {
+		if len(ps[i].Jobs) == 0 {
+			errs = append(errs, fmt.Errorf("policy %d: jobs is required", i+1))
+		}
+		for _, err := range ps[i].Validate() {
+			errs = append(errs, fmt.Errorf("policy %d: %v", i+1, err))
+		}
+	}
+	return errs
+}
+
+// For returns the policy for job, and whether one matched.
+func (ps Policies) For(job string) (JobPolicy, bool) {
+	for _, p := range ps {
+		for _, pattern := range p.Jobs {
+			if ok, _ := path.Match(pattern, job); ok {
+				return p, true
+			}
+		}
+	}
+	return JobPolicy{}, false
+}
+
+// apply sets the policy of each job of s that the IaaS hasn't set.
+func (ps Policies) apply(s *State) {
+	for _, vm := range s.VMs {
+		if _, ok := s.Policies[vm.Job]; ok {
+			continue
+		}
+		if p, ok := ps.For(vm.Job); ok {
+			if s.Policies == nil {
+				s.Policies = make(map[string]JobPolicy)
+			}
+			s.Policies[vm.Job] = p
+		}
+	}
+}
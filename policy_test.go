@@ -0,0 +1,322 @@
+package magnet_test
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/mock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JobPolicy", func() {
+	It("parses comma-separated settings", func() {
+		p, err := magnet.ParseJobPolicy("mandatory, min-hosts=3,max-per-host=1,slack=2")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p).Should(Equal(magnet.JobPolicy{Strength: magnet.RuleMandatory, MinHosts: 3, MaxPerHost: 1, Slack: 2}))
+
+		p, err = magnet.ParseJobPolicy("ignore")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.Ignore).Should(BeTrue())
+
+		p, err = magnet.ParseJobPolicy("with=sidecar,with=agent")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.With).Should(Equal([]string{"sidecar", "agent"}))
+
+		p, err = magnet.ParseJobPolicy("hosts=esx-gpu-*,host-attribute=gpu=true")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.Hosts).Should(Equal(&magnet.HostSelector{Names: []string{"esx-gpu-*"}, Attribute: "gpu=true"}))
+
+		p, err = magnet.ParseJobPolicy("group=quorum,mandatory")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p).Should(Equal(magnet.JobPolicy{Group: "quorum", Strength: magnet.RuleMandatory}))
+
+		for _, bad := range []string{"loud", "slack", "slack=-1", "min-hosts=many", "group=", "with"} {
+			_, err = magnet.ParseJobPolicy(bad)
+			Ω(err).Should(HaveOccurred(), bad)
+		}
+	})
+
+	It("validates policies", func() {
+		ps := magnet.Policies{{Strength: "strong", Slack: -1}, {Jobs: []string{"["}}}
+		Ω(ps.Validate()).Should(HaveLen(4))
+
+		ps = magnet.Policies{
+			{Jobs: []string{"a"}, Hosts: &magnet.HostSelector{}},
+			{Jobs: []string{"b"}, Hosts: &magnet.HostSelector{Names: []string{"["}, Pattern: "(", Attribute: "gpu"}},
+		}
+		Ω(ps.Validate()).Should(HaveLen(4))
+	})
+
+	It("selects hosts by name, pattern or attribute", func() {
+		hosts := []*magnet.Host{
+			{Name: "esx-01"},
+			{Name: "esx-02", Attributes: map[string]string{"gpu": "true"}},
+			{Name: "win-01"},
+		}
+		Ω((&magnet.HostSelector{Names: []string{"win-*"}}).Select(hosts)).Should(Equal(hosts[2:]))
+		Ω((&magnet.HostSelector{Pattern: "^esx-0[2-9]$"}).Select(hosts)).Should(Equal(hosts[1:2]))
+		Ω((&magnet.HostSelector{Attribute: "gpu=true"}).Select(hosts)).Should(Equal(hosts[1:2]))
+		Ω((&magnet.HostSelector{Attribute: "gpu=false"}).Select(hosts)).Should(BeEmpty())
+	})
+
+	It("chooses the first matching policy", func() {
+		ps := magnet.Policies{
+			{Jobs: []string{"router"}, MinHosts: 3},
+			{Jobs: []string{"*"}, Slack: 1},
+		}
+		p, ok := ps.For("router")
+		Ω(ok).Should(BeTrue())
+		Ω(p.MinHosts).Should(Equal(3))
+		p, ok = ps.For("diego_cell")
+		Ω(ok).Should(BeTrue())
+		Ω(p.Slack).Should(Equal(1))
+		_, ok = magnet.Policies{}.For("router")
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("lets policies set by the IaaS take precedence", func() {
+		iaas := &mock.IaaS{StateFn: func(context.Context) (*magnet.State, error) {
+			return &magnet.State{
+				VMs: []*magnet.VM{{Job: "router"}, {Job: "diego_cell"}},
+				Policies: map[string]magnet.JobPolicy{
+					"router": {MinHosts: 2},
+				},
+			}, nil
+		}}
+		c := &magnet.Checker{IaaS: iaas, Policies: magnet.Policies{{Jobs: []string{"*"}, Slack: 1}}}
+		s, err := c.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s.Policies).Should(Equal(map[string]magnet.JobPolicy{
+			"router":     {MinHosts: 2},
+			"diego_cell": {Jobs: []string{"*"}, Slack: 1},
+		}))
+	})
+
+	Context("with three hosts", func() {
+		var state *magnet.State
+		BeforeEach(func() {
+			state = &magnet.State{
+				Hosts: []*magnet.Host{{ID: "host1"}, {ID: "host2"}, {ID: "host3"}},
+				VMs: []*magnet.VM{
+					{Name: "router-1", Job: "router", HostUUID: "host1"},
+					{Name: "router-2", Job: "router", HostUUID: "host1"},
+					{Name: "router-3", Job: "router", HostUUID: "host2"},
+				},
+			}
+		})
+
+		It("tolerates slack", func() {
+			Ω(magnet.IsBalanced(state)).Should(BeFalse())
+			state.Policies = map[string]magnet.JobPolicy{"router": {Slack: 1}}
+			Ω(magnet.IsBalanced(state)).Should(BeTrue())
+		})
+
+		It("limits the VMs per host", func() {
+			state.Policies = map[string]magnet.JobPolicy{"router": {Slack: 1, MaxPerHost: 1}}
+			Ω(magnet.UnbalancedJobs(state)).Should(Equal([]string{"router"}))
+		})
+
+		It("requires a minimum number of hosts", func() {
+			state.VMs[1].HostUUID = "host2"
+			Ω(magnet.IsBalanced(state)).Should(BeFalse())
+			state.Policies = map[string]magnet.JobPolicy{"router": {Slack: 2, MinHosts: 2}}
+			Ω(magnet.IsBalanced(state)).Should(BeTrue())
+			state.Policies = map[string]magnet.JobPolicy{"router": {Slack: 2, MinHosts: 3}}
+			Ω(magnet.IsBalanced(state)).Should(BeFalse())
+		})
+
+		It("ignores jobs and their rules", func() {
+			state.Rules = []*magnet.Rule{{Name: "router", Key: 1}}
+			state.Policies = map[string]magnet.JobPolicy{"router": {Ignore: true}}
+			Ω(magnet.IsBalanced(state)).Should(BeTrue())
+			rec := magnet.RuleRecommendations(state)
+			Ω(rec.Missing).Should(BeEmpty())
+			Ω(rec.Stale).Should(BeEmpty())
+			Ω(magnet.NewReport(state, nil).Jobs[0].Ignored).Should(BeTrue())
+		})
+
+		Context("when jobs are grouped", func() {
+			BeforeEach(func() {
+				state.VMs = []*magnet.VM{
+					{Name: "router-1", Job: "router", HostUUID: "host1"},
+					{Name: "router-2", Job: "router", HostUUID: "host2"},
+					{Name: "etcd-1", Job: "etcd", HostUUID: "host1"},
+				}
+				quorum := magnet.JobPolicy{Group: "quorum"}
+				state.Policies = map[string]magnet.JobPolicy{"router": quorum, "etcd": quorum}
+			})
+
+			It("spreads the jobs together", func() {
+				Ω(magnet.UnbalancedJobs(state)).Should(Equal([]string{"quorum"}))
+				state.Policies["etcd"] = magnet.JobPolicy{}
+				Ω(magnet.IsBalanced(state)).Should(BeTrue())
+			})
+
+			It("recommends one rule for the group", func() {
+				state.Rules = []*magnet.Rule{{Name: "router", Key: 1, VMs: state.VMs[:2]}}
+				rec := magnet.RuleRecommendations(state)
+				Ω(rec.Stale).Should(HaveLen(1))
+				Ω(rec.Missing).Should(HaveLen(1))
+				Ω(rec.Missing[0].Name).Should(Equal("quorum"))
+				Ω(rec.Missing[0].VMs).Should(ConsistOf(state.VMs))
+			})
+
+			It("reports the group of each job", func() {
+				r := magnet.NewReport(state, nil)
+				Ω(r.Jobs).Should(HaveLen(2))
+				for _, j := range r.Jobs {
+					Ω(j.Group).Should(Equal("quorum"))
+					Ω(j.Balanced).Should(BeFalse())
+				}
+			})
+		})
+
+		Context("when jobs are kept together", func() {
+			BeforeEach(func() {
+				for i, vm := range state.VMs {
+					vm.Index = strconv.Itoa(i)
+				}
+				state.VMs = append(state.VMs,
+					&magnet.VM{Name: "agent-0", Job: "agent", Index: "0", HostUUID: "host1"},
+					&magnet.VM{Name: "agent-1", Job: "agent", Index: "1", HostUUID: "host2"},
+				)
+				state.Policies = map[string]magnet.JobPolicy{"router": {Slack: 1, With: []string{"agent"}}}
+			})
+
+			It("recommends an affinity rule for each pair", func() {
+				rec := magnet.RuleRecommendations(state)
+				var names []string
+				for _, r := range rec.Missing {
+					if r.Affinity {
+						names = append(names, r.Name)
+						Ω(r.VMs).Should(HaveLen(2))
+					}
+				}
+				Ω(names).Should(Equal([]string{"router+agent-0", "router+agent-1"}))
+			})
+
+			It("keeps affinity rules that match, and leaves others alone", func() {
+				state.Rules = []*magnet.Rule{
+					{Name: "router+agent-0", Affinity: true, VMs: []*magnet.VM{state.VMs[0], state.VMs[3]}},
+					{Name: "router+agent-1", Affinity: true, VMs: []*magnet.VM{state.VMs[2], state.VMs[4]}},
+					{Name: "db-backup", Affinity: true, VMs: []*magnet.VM{state.VMs[2], state.VMs[4]}},
+				}
+				rec := magnet.RuleRecommendations(state)
+				Ω(rec.Valid).Should(HaveLen(1))
+				Ω(rec.Valid[0].Name).Should(Equal("router+agent-0"))
+				Ω(rec.Stale).Should(HaveLen(1))
+				Ω(rec.Stale[0].Name).Should(Equal("router+agent-1"))
+				Ω(rulesNamed(rec.Missing, "router+agent-1")).Should(HaveLen(1))
+				Ω(rulesNamed(rec.Stale, "db-backup")).Should(BeEmpty())
+			})
+
+			It("creates the affinity rules when the jobs are balanced", func() {
+				Ω(magnet.IsBalanced(state)).Should(BeTrue())
+				rec := checkedRecommendation(state)
+				Ω(rec).ShouldNot(BeNil())
+				Ω(rulesNamed(rec.Missing, "router+agent-0")).Should(HaveLen(1))
+				Ω(rulesNamed(rec.Missing, "router+agent-1")).Should(HaveLen(1))
+			})
+
+			It("leaves anti-affinity rules alone when the jobs are balanced", func() {
+				state.Rules = []*magnet.Rule{{Name: "licensing", VMs: []*magnet.VM{state.VMs[0], state.VMs[3]}}}
+				Ω(rulesNamed(magnet.RuleRecommendations(state).Stale, "licensing")).Should(HaveLen(1))
+				rec := checkedRecommendation(state)
+				Ω(rec).ShouldNot(BeNil())
+				Ω(rec.Stale).Should(BeEmpty())
+				Ω(rec.Missing).Should(HaveLen(2))
+			})
+		})
+
+		Context("when a job is pinned to some of the hosts", func() {
+			BeforeEach(func() {
+				state.Hosts[1].Name = "win-1"
+				state.Hosts[2].Name = "win-2"
+				state.VMs[0].HostUUID = "host2"
+				state.VMs[1].HostUUID = "host3"
+				state.Policies = map[string]magnet.JobPolicy{
+					"router": {Slack: 1, Hosts: &magnet.HostSelector{Names: []string{"win-*"}}},
+				}
+			})
+
+			It("spreads the job across those hosts", func() {
+				Ω(magnet.IsBalanced(state)).Should(BeTrue())
+				state.Policies["router"] = magnet.JobPolicy{Hosts: &magnet.HostSelector{Names: []string{"win-*"}}}
+				Ω(magnet.IsBalanced(state)).Should(BeTrue())
+				state.Policies["router"] = magnet.JobPolicy{}
+				Ω(magnet.IsBalanced(state)).Should(BeFalse())
+			})
+
+			It("recommends a VM/Host rule", func() {
+				rec := magnet.RuleRecommendations(state)
+				hostRules := rulesNamed(rec.Missing, "router@hosts")
+				Ω(hostRules).Should(HaveLen(1))
+				Ω(hostRules[0].VMs).Should(HaveLen(3))
+				Ω(hostRules[0].Hosts).Should(Equal(state.Hosts[1:]))
+				Ω(hostRules[0].Mandatory).Should(BeFalse())
+			})
+
+			It("replaces the rule when the hosts change", func() {
+				state.Rules = []*magnet.Rule{{Name: "router@hosts", VMs: state.VMs, Hosts: state.Hosts[1:]}}
+				Ω(rulesNamed(magnet.RuleRecommendations(state).Valid, "router@hosts")).Should(HaveLen(1))
+
+				state.Rules[0].Hosts = state.Hosts[2:]
+				rec := magnet.RuleRecommendations(state)
+				Ω(rulesNamed(rec.Stale, "router@hosts")).Should(HaveLen(1))
+				Ω(rulesNamed(rec.Missing, "router@hosts")).Should(HaveLen(1))
+			})
+
+			It("creates the VM/Host rule when a VM runs outside the hosts", func() {
+				state.VMs[2].HostUUID = "host1"
+				Ω(magnet.IsBalanced(state)).Should(BeTrue())
+				rec := checkedRecommendation(state)
+				Ω(rec).ShouldNot(BeNil())
+				Ω(rulesNamed(rec.Missing, "router@hosts")).Should(HaveLen(1))
+			})
+
+			It("leaves VM/Host rules that it didn't make alone", func() {
+				state.Rules = []*magnet.Rule{{Name: "licensing", VMs: state.VMs, Hosts: state.Hosts[1:]}}
+				Ω(magnet.RuleRecommendations(state).Stale).Should(BeEmpty())
+			})
+		})
+
+		It("replaces rules of the wrong strength", func() {
+			state.Rules = []*magnet.Rule{{Name: "router", Key: 1, VMs: state.VMs}}
+			Ω(magnet.RuleRecommendations(state).Valid).Should(HaveLen(1))
+
+			state.Policies = map[string]magnet.JobPolicy{"router": {Strength: magnet.RuleMandatory}}
+			rec := magnet.RuleRecommendations(state)
+			Ω(rec.Stale).Should(HaveLen(1))
+			Ω(rec.Missing).Should(HaveLen(1))
+			Ω(rec.Missing[0].Mandatory).Should(BeTrue())
+		})
+	})
+})
+
+func rulesNamed(rules []magnet.Rule, name string) []magnet.Rule {
+	var named []magnet.Rule
+	for _, r := range rules {
+		if r.Name == name {
+			named = append(named, r)
+		}
+	}
+	return named
+}
+
+// checkedRecommendation checks state with a Checker, and returns the
+// recommendation that it converged, or nil if it didn't converge.
+func checkedRecommendation(state *magnet.State) *magnet.RuleRecommendation {
+	var converged *magnet.RuleRecommendation
+	i := &mock.IaaS{
+		StateFn: func(context.Context) (*magnet.State, error) { return state, nil },
+		ConvergeFn: func(ctx context.Context, s *magnet.State, rec *magnet.RuleRecommendation) error {
+			converged = rec
+			return nil
+		},
+	}
+	Ω((&magnet.Checker{IaaS: i}).Check(context.Background())).Should(Succeed())
+	return converged
+}
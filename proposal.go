@@ -0,0 +1,277 @@
+package magnet
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProposalStatus is the lifecycle status of a Proposal.
+type ProposalStatus string
+
+// Proposal statuses.  Only pending proposals can be approved.
+const (
+	ProposalPending    ProposalStatus = "pending"
+	ProposalApplied    ProposalStatus = "applied"
+	ProposalFailed     ProposalStatus = "failed"
+	ProposalSuperseded ProposalStatus = "superseded"
+	ProposalExpired    ProposalStatus = "expired"
+)
+
+var (
+	// ErrProposalNotFound is returned when a proposal does not exist.
+	ErrProposalNotFound = errors.New("proposal not found")
+
+	// ErrProposalNotPending is returned when approving a proposal that
+	// has already been applied, superseded or has expired.
+	ErrProposalNotPending = errors.New("proposal is no longer pending")
+)
+
+// Proposal is a set of rule recommendations that is waiting for an
+// operator to approve it before it is applied.  A proposal is only
+// applied if the state of the deployment is unchanged since it was
+// proposed.
+type Proposal struct {
+	ID          string         `json:"id"`
+	Status      ProposalStatus `json:"status"`
+	Approved    bool           `json:"approved"`
+	Created     time.Time      `json:"created"`
+	Updated     time.Time      `json:"updated"`
+	Expires     time.Time      `json:"expires"`
+	Fingerprint string         `json:"fingerprint"`
+	Report      *Report        `json:"report"`
+	Error       string         `json:"error,omitempty"`
+}
+
+// ProposalStore persists proposals in a local directory.  Each proposal
+// is stored in its own file, and approvals are recorded in a separate
+// marker file, so that an operator can approve a proposal while the
+// daemon is running.
+type ProposalStore struct {
+	Dir string
+
+	// TTL is how long a proposal may wait for approval.
+	// Proposals don't expire if TTL is zero.
+	TTL time.Duration
+}
+
+func (ps *ProposalStore) path(id string) string {
+	return filepath.Join(ps.Dir, id+".json")
+}
+
+func (ps *ProposalStore) approvalPath(id string) string {
+	return filepath.Join(ps.Dir, id+".approved")
+}
+
+// validID reports whether id could have been generated by newProposalID,
+// which keeps user-supplied IDs from escaping the store's directory.
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Get loads the proposal with the specified ID.
+func (ps *ProposalStore) Get(id string) (*Proposal, error) {
+	if !validID(id) {
+		return nil, ErrProposalNotFound
+	}
+	b, err := ioutil.ReadFile(ps.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrProposalNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p Proposal
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("proposal %s: %v", id, err)
+	}
+	if _, err := os.Stat(ps.approvalPath(id)); err == nil {
+		p.Approved = true
+	}
+	return &p, nil
+}
+
+// List loads every proposal in the store, oldest first.
+func (ps *ProposalStore) List() ([]*Proposal, error) {
+	matches, err := filepath.Glob(filepath.Join(ps.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var result []*Proposal
+	for _, m := range matches {
+		p, err := ps.Get(strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+	return result, nil
+}
+
+// Approve approves the pending proposal with the specified ID.  It will
+// be applied the next time the deployment is checked, provided the
+// state of the deployment hasn't changed.
+func (ps *ProposalStore) Approve(id string) error {
+	p, err := ps.Get(id)
+	if err != nil {
+		return err
+	}
+	if p.Status != ProposalPending || ps.expired(p, time.Now()) {
+		return ErrProposalNotPending
+	}
+	f, err := os.OpenFile(ps.approvalPath(id), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (ps *ProposalStore) expired(p *Proposal, now time.Time) bool {
+	return !p.Expires.IsZero() && now.After(p.Expires)
+}
+
+// propose returns the pending proposal whose fingerprint matches
+// fingerprint, creating one from the report if necessary.  Pending
+// proposals that have expired or have a different fingerprint are
+// marked as such.  created is true if a new proposal was created.
+func (ps *ProposalStore) propose(fingerprint string, r *Report) (p *Proposal, created bool, err error) {
+	proposals, err := ps.List()
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now().UTC()
+	for _, existing := range proposals {
+		if existing.Status != ProposalPending {
+			continue
+		}
+		switch {
+		case ps.expired(existing, now):
+			err = ps.finish(existing, ProposalExpired, nil)
+		case existing.Fingerprint != fingerprint:
+			err = ps.finish(existing, ProposalSuperseded, nil)
+		default:
+			p = existing
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if p != nil {
+		return p, false, nil
+	}
+
+	id, err := newProposalID()
+	if err != nil {
+		return nil, false, err
+	}
+	p = &Proposal{
+		ID:          id,
+		Status:      ProposalPending,
+		Created:     now,
+		Updated:     now,
+		Fingerprint: fingerprint,
+		Report:      r,
+	}
+	if ps.TTL > 0 {
+		p.Expires = now.Add(ps.TTL)
+	}
+	return p, true, ps.save(p)
+}
+
+// finish moves a pending proposal to a final status.
+func (ps *ProposalStore) finish(p *Proposal, status ProposalStatus, err error) error {
+	p.Status = status
+	p.Updated = time.Now().UTC()
+	if err != nil {
+		p.Error = err.Error()
+	}
+	return ps.save(p)
+}
+
+// save atomically writes p to the store.
+func (ps *ProposalStore) save(p *Proposal) error {
+	if err := os.MkdirAll(ps.Dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(ps.Dir, ".proposal")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), ps.path(p.ID))
+}
+
+func newProposalID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Fingerprint summarizes the VMs of s and the rules that rec adds and
+// removes.  Where the VMs run isn't part of it, so a proposal outlives
+// the VMs moving between hosts as long as the recommendations stay the
+// same.
+func Fingerprint(s *State, rec *RuleRecommendation) string {
+	lines := []string{fmt.Sprintf("containers %s %s", s.RuleContainer, s.VMContainer)}
+	for _, vm := range s.VMs {
+		lines = append(lines, fmt.Sprintf("vm %s %s %s", vm.Reference, vm.Name, vm.Job))
+	}
+	rule := func(op string, r *Rule) string {
+		var vms, hosts []string
+		for _, vm := range r.VMs {
+			if vm != nil {
+				vms = append(vms, vm.Reference+"/"+vm.Name)
+			}
+		}
+		for _, h := range r.Hosts {
+			hosts = append(hosts, h.ID)
+		}
+		sort.Strings(vms)
+		sort.Strings(hosts)
+		return fmt.Sprintf("%s %s %d mandatory=%t affinity=%t %s %s",
+			op, r.Name, r.Key, r.Mandatory, r.Affinity, strings.Join(vms, ","), strings.Join(hosts, ","))
+	}
+	for j := range rec.Missing {
+		lines = append(lines, rule("add", &rec.Missing[j]))
+	}
+	for j := range rec.Stale {
+		lines = append(lines, rule("remove", &rec.Stale[j]))
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		fmt.Fprintln(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,203 @@
+package magnet_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/mock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Proposals", func() {
+	var (
+		dir       string
+		store     *magnet.ProposalStore
+		i         *mock.IaaS
+		c         *magnet.Checker
+		converged int
+		routerVM1 *magnet.VM
+		routerVM2 *magnet.VM
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "magnet-proposals")
+		Ω(err).ShouldNot(HaveOccurred())
+		store = &magnet.ProposalStore{Dir: dir, TTL: time.Hour}
+
+		host1 := &magnet.Host{ID: "host1"}
+		host2 := &magnet.Host{ID: "host2"}
+		routerVM1 = &magnet.VM{Name: "router-1", Reference: "vm-1", Job: "router", HostUUID: host1.ID}
+		routerVM2 = &magnet.VM{Name: "router-2", Reference: "vm-2", Job: "router", HostUUID: host1.ID}
+		converged = 0
+		i = &mock.IaaS{
+			StateFn: func(ctx context.Context) (*magnet.State, error) {
+				vm2 := *routerVM2
+				return &magnet.State{
+					Hosts: []*magnet.Host{host1, host2},
+					VMs:   []*magnet.VM{routerVM1, &vm2},
+				}, nil
+			},
+			ConvergeFn: func(ctx context.Context, state *magnet.State, rec *magnet.RuleRecommendation) error {
+				converged++
+				return nil
+			},
+		}
+		c = &magnet.Checker{IaaS: i, Proposals: store}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	pending := func() *magnet.Proposal {
+		ps, err := store.List()
+		Ω(err).ShouldNot(HaveOccurred())
+		var result *magnet.Proposal
+		for _, p := range ps {
+			if p.Status == magnet.ProposalPending {
+				Ω(result).Should(BeNil(), "only one proposal should be pending")
+				result = p
+			}
+		}
+		return result
+	}
+
+	It("parks recommendations until they are approved", func() {
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(converged).Should(Equal(0))
+		p := pending()
+		Ω(p).ShouldNot(BeNil())
+		Ω(p.Report.Recommendations.Missing).Should(HaveLen(1))
+
+		// checking again doesn't create a second proposal
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(converged).Should(Equal(0))
+		Ω(pending().ID).Should(Equal(p.ID))
+
+		Ω(store.Approve(p.ID)).Should(Succeed())
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(converged).Should(Equal(1))
+
+		p, err := store.Get(p.ID)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.Status).Should(Equal(magnet.ProposalApplied))
+		Ω(p.Approved).Should(BeTrue())
+	})
+
+	It("supersedes a proposal when the state changes", func() {
+		Ω(c.Check(context.Background())).Should(Succeed())
+		first := pending()
+		Ω(store.Approve(first.ID)).Should(Succeed())
+
+		routerVM2.Name = "router-2-recreated"
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(converged).Should(Equal(0))
+
+		p, err := store.Get(first.ID)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.Status).Should(Equal(magnet.ProposalSuperseded))
+		Ω(pending().ID).ShouldNot(Equal(first.ID))
+	})
+
+	It("keeps a proposal when the VMs only move between hosts", func() {
+		Ω(c.Check(context.Background())).Should(Succeed())
+		first := pending()
+
+		routerVM1.HostUUID = "host2"
+		routerVM2.HostUUID = "host2"
+		Ω(c.Check(context.Background())).Should(Succeed())
+		Ω(pending().ID).Should(Equal(first.ID))
+	})
+
+	It("expires proposals that wait too long", func() {
+		store.TTL = time.Nanosecond
+		Ω(c.Check(context.Background())).Should(Succeed())
+		first := pending()
+		time.Sleep(time.Millisecond)
+		Ω(store.Approve(first.ID)).Should(Equal(magnet.ErrProposalNotPending))
+
+		Ω(c.Check(context.Background())).Should(Succeed())
+		p, err := store.Get(first.ID)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.Status).Should(Equal(magnet.ProposalExpired))
+	})
+
+	It("rejects unknown proposals", func() {
+		Ω(store.Approve("deadbeef")).Should(Equal(magnet.ErrProposalNotFound))
+		Ω(store.Approve("../etc")).Should(Equal(magnet.ErrProposalNotFound))
+	})
+
+	Context("over HTTP", func() {
+		var server *httptest.Server
+		BeforeEach(func() {
+			server = httptest.NewServer(&magnet.Server{Proposals: store, ApprovalToken: "s3cret"})
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("lists and approves proposals", func() {
+			Ω(c.Check(context.Background())).Should(Succeed())
+			id := pending().ID
+
+			resp, err := http.Get(server.URL + "/proposals")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			var ps []magnet.Proposal
+			Ω(json.NewDecoder(resp.Body).Decode(&ps)).Should(Succeed())
+			Ω(ps).Should(HaveLen(1))
+			Ω(ps[0].ID).Should(Equal(id))
+
+			resp, err = approve(server.URL, id, "s3cret")
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusOK))
+
+			p, err := store.Get(id)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(p.Approved).Should(BeTrue())
+		})
+
+		It("returns 404 for unknown proposals", func() {
+			resp, err := approve(server.URL, "deadbeef", "s3cret")
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusNotFound))
+		})
+
+		It("requires the approval token", func() {
+			Ω(c.Check(context.Background())).Should(Succeed())
+			id := pending().ID
+
+			resp, err := approve(server.URL, id, "wrong")
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusUnauthorized))
+
+			open := httptest.NewServer(&magnet.Server{Proposals: store})
+			defer open.Close()
+			resp, err = approve(open.URL, id, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusForbidden))
+			Ω(pending().Approved).Should(BeFalse())
+		})
+	})
+})
+
+// approve approves the proposal id over HTTP with token.
+func approve(url, id, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url+"/proposals/"+id+"/approve", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
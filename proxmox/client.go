@@ -0,0 +1,273 @@
+package proxmox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// session is an authenticated connection to the API.
+type session struct {
+	client *http.Client
+	base   string // the API's URL, ending in /api2/json
+	// the Authorization header of an API token, or else the ticket
+	// and CSRF token of a login
+	authorization string
+	ticket, csrf  string
+}
+
+// login authenticates with the API token, or with a ticket for the
+// username and password.
+func (i *IaaS) login(ctx context.Context) (*session, error) {
+	c := i.config
+	base, err := c.apiURL()
+	if err != nil {
+		return nil, err
+	}
+	s := &session{client: i.client, base: base}
+	if c.TokenID != "" {
+		s.authorization = "PVEAPIToken=" + c.TokenID + "=" + string(c.TokenSecret)
+		return s, nil
+	}
+	var ticket struct {
+		Ticket string `json:"ticket"`
+		CSRF   string `json:"CSRFPreventionToken"`
+	}
+	form := url.Values{"username": {c.Username}, "password": {string(c.Password)}}
+	if err = s.do(ctx, http.MethodPost, "/access/ticket", form, &ticket); err != nil {
+		return nil, err
+	}
+	s.ticket, s.csrf = ticket.Ticket, ticket.CSRF
+	return s, nil
+}
+
+// statusError is the error for an unexpected response.
+type statusError struct {
+	method, path string
+	status       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("proxmox: %s %s: %s", e.method, e.path, e.status)
+}
+
+// do sends a request to the API, with form as its parameters, and
+// decodes the data of the response into v if it is non-nil.
+func (s *session) do(ctx context.Context, method, path string, form url.Values, v interface{}) error {
+	u := s.base + path
+	var body io.Reader
+	if method == http.MethodGet || method == http.MethodDelete {
+		if len(form) > 0 {
+			u += "?" + form.Encode()
+		}
+	} else {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	switch {
+	case s.authorization != "":
+		req.Header.Set("Authorization", s.authorization)
+	case s.ticket != "":
+		req.AddCookie(&http.Cookie{Name: "PVEAuthCookie", Value: s.ticket})
+		if method != http.MethodGet {
+			req.Header.Set("CSRFPreventionToken", s.csrf)
+		}
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("proxmox: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return &statusError{method: method, path: path, status: resp.Status}
+	}
+	if v == nil {
+		return nil
+	}
+	var data struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return fmt.Errorf("proxmox: %s %s: %v", method, path, err)
+	}
+	if err = json.Unmarshal(data.Data, v); err != nil {
+		return fmt.Errorf("proxmox: %s %s: %v", method, path, err)
+	}
+	return nil
+}
+
+// nodes lists the names of the online nodes.
+func (s *session) nodes(ctx context.Context) ([]string, error) {
+	var nodes []struct {
+		Node   string `json:"node"`
+		Status string `json:"status"`
+	}
+	if err := s.do(ctx, http.MethodGet, "/nodes", nil, &nodes); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, n := range nodes {
+		if n.Status == "online" {
+			names = append(names, n.Node)
+		}
+	}
+	return names, nil
+}
+
+// guest is a QEMU VM or an LXC container.
+type guest struct {
+	VMID     int    `json:"vmid"`
+	Name     string `json:"name"`
+	Node     string `json:"node"`
+	Type     string `json:"type"` // qemu or lxc
+	Status   string `json:"status"`
+	Template int    `json:"template"`
+	Tags     string `json:"tags"` // separated by semicolons
+}
+
+// id returns the guest's VMID as a string.
+func (g *guest) id() string {
+	return strconv.Itoa(g.VMID)
+}
+
+// guests lists the cluster's VMs and containers, except templates.
+func (s *session) guests(ctx context.Context) ([]guest, error) {
+	var all []guest
+	if err := s.do(ctx, http.MethodGet, "/cluster/resources", url.Values{"type": {"vm"}}, &all); err != nil {
+		return nil, err
+	}
+	guests := all[:0]
+	for _, g := range all {
+		if g.Template == 0 {
+			guests = append(guests, g)
+		}
+	}
+	return guests, nil
+}
+
+// description returns the notes of a guest.
+func (s *session) description(ctx context.Context, g *guest) (string, error) {
+	var config struct {
+		Description string `json:"description"`
+	}
+	path := fmt.Sprintf("/nodes/%s/%s/%d/config", g.Node, g.Type, g.VMID)
+	if err := s.do(ctx, http.MethodGet, path, nil, &config); err != nil {
+		return "", err
+	}
+	return config.Description, nil
+}
+
+// haGroup is an HA group: a list of nodes with priorities, the highest
+// of which the HA manager runs the group's resources on.
+type haGroup struct {
+	Group   string `json:"group"`
+	Nodes   string `json:"nodes"` // node[:priority],...
+	Comment string `json:"comment"`
+}
+
+func (s *session) haGroups(ctx context.Context) ([]haGroup, error) {
+	var groups []haGroup
+	if err := s.do(ctx, http.MethodGet, "/cluster/ha/groups", nil, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// putHAGroup creates the group, or updates it if exists.
+func (s *session) putHAGroup(ctx context.Context, g haGroup, exists bool) error {
+	form := url.Values{"nodes": {g.Nodes}, "comment": {g.Comment}}
+	if exists {
+		return s.do(ctx, http.MethodPut, "/cluster/ha/groups/"+g.Group, form, nil)
+	}
+	form.Set("group", g.Group)
+	return s.do(ctx, http.MethodPost, "/cluster/ha/groups", form, nil)
+}
+
+func (s *session) deleteHAGroup(ctx context.Context, group string) error {
+	return s.do(ctx, http.MethodDelete, "/cluster/ha/groups/"+group, nil, nil)
+}
+
+// haResource is a guest managed by the HA manager.
+type haResource struct {
+	SID     string `json:"sid"` // vm:<vmid> or ct:<vmid>
+	Group   string `json:"group"`
+	Comment string `json:"comment"`
+}
+
+func (s *session) haResources(ctx context.Context) ([]haResource, error) {
+	var resources []haResource
+	if err := s.do(ctx, http.MethodGet, "/cluster/ha/resources", nil, &resources); err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// addHAResource makes a guest an HA resource in group, in its current
+// state, so that the HA manager doesn't start or stop it.
+func (s *session) addHAResource(ctx context.Context, sid, group, comment string, running bool) error {
+	state := "stopped"
+	if running {
+		state = "started"
+	}
+	form := url.Values{"sid": {sid}, "group": {group}, "comment": {comment}, "state": {state}}
+	return s.do(ctx, http.MethodPost, "/cluster/ha/resources", form, nil)
+}
+
+// setHAResourceGroup moves an HA resource into group, or out of its
+// group if group is empty.
+func (s *session) setHAResourceGroup(ctx context.Context, sid, group string) error {
+	form := url.Values{"group": {group}}
+	if group == "" {
+		form = url.Values{"delete": {"group"}}
+	}
+	return s.do(ctx, http.MethodPut, "/cluster/ha/resources/"+sid, form, nil)
+}
+
+func (s *session) deleteHAResource(ctx context.Context, sid string) error {
+	return s.do(ctx, http.MethodDelete, "/cluster/ha/resources/"+sid, nil, nil)
+}
+
+// migrate starts migrating a guest to target, live if it's a running
+// VM, and returns the task's ID.
+func (s *session) migrate(ctx context.Context, g *guest, target string) (string, error) {
+	form := url.Values{"target": {target}}
+	switch {
+	case g.Status != "running":
+	case g.Type == "lxc":
+		form.Set("restart", "1")
+	default:
+		form.Set("online", "1")
+	}
+	var upid string
+	path := fmt.Sprintf("/nodes/%s/%s/%d/migrate", g.Node, g.Type, g.VMID)
+	if err := s.do(ctx, http.MethodPost, path, form, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// taskStatus returns whether a task has finished, and its exit status.
+func (s *session) taskStatus(ctx context.Context, node, upid string) (bool, string, error) {
+	var status struct {
+		Status     string `json:"status"`
+		ExitStatus string `json:"exitstatus"`
+	}
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/status", node, url.PathEscape(upid))
+	if err := s.do(ctx, http.MethodGet, path, nil, &status); err != nil {
+		return false, "", err
+	}
+	return status.Status == "stopped", status.ExitStatus, nil
+}
@@ -0,0 +1,168 @@
+package proxmox
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// DefaultPort is the port of the API when the URL has none.
+const DefaultPort = "8006"
+
+// How Converge moves VMs to the nodes their HA groups prefer.
+const (
+	// PlacementHA makes each VM an HA resource in its group, so
+	// that the HA manager migrates it.
+	PlacementHA = "ha"
+
+	// PlacementMigrate leaves the HA resources alone, and live
+	// migrates the VMs itself.
+	PlacementMigrate = "migrate"
+)
+
+// Config describes a Proxmox VE cluster and the BOSH deployments on it
+// that magnet manages.  It authenticates with an API token if TokenID
+// is set, and otherwise with a username and password.
+type Config struct {
+	URL         string        `yaml:"url"`      // the API's URL, such as https://pve1:8006
+	TokenID     string        `yaml:"token-id"` // user@realm!name
+	TokenSecret magnet.Secret `yaml:"token-secret"`
+	Username    string        `yaml:"username"` // user@realm
+	Password    magnet.Secret `yaml:"password"`
+	Insecure    bool          `yaml:"insecure"`    // don't verify the API's certificate
+	CACert      string        `yaml:"cacert"`      // path of a PEM bundle of CAs to trust
+	Placement   string        `yaml:"placement"`   // PlacementHA (the default) or PlacementMigrate
+	Deployments []string      `yaml:"deployments"` // every deployment if empty
+}
+
+// ApplyEnv overrides c with the PROXMOX_* environment variables that
+// are set.
+func (c *Config) ApplyEnv() error {
+	for name, field := range map[string]*string{
+		"PROXMOX_URL":          &c.URL,
+		"PROXMOX_TOKEN_ID":     &c.TokenID,
+		"PROXMOX_TOKEN_SECRET": (*string)(&c.TokenSecret),
+		"PROXMOX_USERNAME":     &c.Username,
+		"PROXMOX_PASSWORD":     (*string)(&c.Password),
+		"PROXMOX_CACERT":       &c.CACert,
+		"PROXMOX_PLACEMENT":    &c.Placement,
+	} {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+	if v, ok := os.LookupEnv("PROXMOX_INSECURE"); ok {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("PROXMOX_INSECURE: invalid boolean %q", v)
+		}
+		c.Insecure = insecure
+	}
+	return nil
+}
+
+// Validate returns every problem with c.
+func (c Config) Validate() []error {
+	var errs []error
+	if c.URL == "" {
+		errs = append(errs, errors.New("url is required"))
+	} else if _, err := c.apiURL(); err != nil {
+		errs = append(errs, err)
+	}
+	switch {
+	case c.TokenID != "":
+		if !strings.Contains(c.TokenID, "!") {
+			errs = append(errs, fmt.Errorf("invalid token-id %q, expected user@realm!name", c.TokenID))
+		}
+		if c.TokenSecret == "" {
+			errs = append(errs, errors.New("token-secret is required with token-id"))
+		}
+	case c.Username == "":
+		errs = append(errs, errors.New("token-id or username is required"))
+	case c.Password == "":
+		errs = append(errs, errors.New("password is required with username"))
+	}
+	if c.Insecure && c.CACert != "" {
+		errs = append(errs, errors.New("insecure and cacert are mutually exclusive"))
+	}
+	if c.CACert != "" {
+		if _, err := loadCACert(c.CACert); err != nil {
+			errs = append(errs, fmt.Errorf("cacert: %v", err))
+		}
+	}
+	switch c.Placement {
+	case "", PlacementHA, PlacementMigrate:
+	default:
+		errs = append(errs, fmt.Errorf("invalid placement %q, expected %s or %s", c.Placement, PlacementHA, PlacementMigrate))
+	}
+	return errs
+}
+
+// Unverified reports whether magnet connects to the API without
+// verifying its identity, because Insecure is set or the URL is http.
+func (c Config) Unverified() bool {
+	return c.Insecure || strings.HasPrefix(c.URL, "http://")
+}
+
+// setDefaults fills in the optional settings that aren't set.
+func (c *Config) setDefaults() {
+	if c.Placement == "" {
+		c.Placement = PlacementHA
+	}
+}
+
+// apiURL returns the base URL of the API, adding the default port
+// and the /api2/json path if they are missing.
+func (c *Config) apiURL() (string, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("invalid url %q", c.URL)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/api2/json")
+	return u.String() + "/api2/json", nil
+}
+
+// user returns the user that magnet authenticates as: the API token's
+// ID if there is one, otherwise the username.
+func (c *Config) user() string {
+	if c.TokenID != "" {
+		return c.TokenID
+	}
+	return c.Username
+}
+
+// managed reports whether magnet manages the VMs of deployment.
+func (c *Config) managed(deployment string) bool {
+	if len(c.Deployments) == 0 {
+		return true
+	}
+	for _, d := range c.Deployments {
+		if d == deployment {
+			return true
+		}
+	}
+	return false
+}
+
+func loadCACert(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s contains no PEM certificates", path)
+	}
+	return pool, nil
+}
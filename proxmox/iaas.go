@@ -0,0 +1,588 @@
+// Package proxmox implements magnet.IaaS for Cloud Foundry deployments
+// on Proxmox VE, spreading jobs across nodes with HA groups.
+package proxmox
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// DefaultMigrationTimeout is how long Converge waits for its migrations
+// when MigrationTimeout is zero.
+const DefaultMigrationTimeout = 10 * time.Minute
+
+// taskPollInterval is how often Converge checks on a migration.
+var taskPollInterval = 2 * time.Second
+
+const (
+	// groupPrefix starts the name of each HA group magnet creates.
+	// The rest of the name is the VMID of the group's VM.
+	groupPrefix = "magnet_"
+
+	// resourceComment is the comment of the HA resources magnet
+	// creates, which it deletes when their rules are removed.
+	resourceComment = "managed by magnet"
+)
+
+// IaaS is a Proxmox VE cluster.  Each online node is a host, and each
+// VM or container with BOSH tags or notes is a VM of a job.
+//
+// Proxmox has no anti-affinity rules, so magnet gives each VM of a
+// rule an HA group of its own, named magnet_<vmid>, which prefers a
+// different node from the other VMs of the rule.  Its comment names the
+// rule.  The HA manager then migrates each VM to its preferred node, or,
+// with PlacementMigrate, magnet live migrates it itself.  The HA groups
+// of VMs in deployments that magnet doesn't manage are ignored.
+//
+// Unlike vsphere.IaaS, it doesn't back up the rules before changing them.
+type IaaS struct {
+	// Instances, if non-nil, identifies the job, index, deployment and
+	// AZ of each VM, which is joined to its instance by VMID (the VM
+	// CID).  VMs it doesn't describe are identified by their tags or
+	// notes, as are all VMs if it fails.
+	Instances magnet.InstanceSource
+
+	// MigrationTimeout is how long Converge waits for all of its
+	// migrations with PlacementMigrate, or DefaultMigrationTimeout if
+	// zero.
+	MigrationTimeout time.Duration
+
+	// Auditor, if non-nil, records every rule change made by Converge.
+	Auditor magnet.Auditor
+
+	config *Config
+	client *http.Client
+	log    magnet.Logger
+}
+
+// New creates an IaaS configured by the following environment
+// variables:
+//   - PROXMOX_URL           (required)
+//   - PROXMOX_TOKEN_ID      (required, or PROXMOX_USERNAME)
+//   - PROXMOX_TOKEN_SECRET  (required with PROXMOX_TOKEN_ID)
+//   - PROXMOX_USERNAME      (default "")
+//   - PROXMOX_PASSWORD      (required with PROXMOX_USERNAME)
+//   - PROXMOX_INSECURE      (default false)
+//   - PROXMOX_CACERT        (default "", the system's CAs)
+//   - PROXMOX_PLACEMENT     (default ha)
+//
+// If l is nil, nothing is logged.
+func New(l magnet.Logger) (*IaaS, error) {
+	var config Config
+	if err := config.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	return NewFromConfig(config, l)
+}
+
+// NewFromConfig creates an IaaS for the cluster described by config.
+// If l is nil, nothing is logged.
+func NewFromConfig(config Config, l magnet.Logger) (*IaaS, error) {
+	if l == nil {
+		l = magnet.NopLogger()
+	}
+	if errs := config.Validate(); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return nil, fmt.Errorf("proxmox: %s", strings.Join(msgs, "; "))
+	}
+	config.setDefaults()
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{InsecureSkipVerify: config.Insecure}}
+	if config.CACert != "" {
+		roots, err := loadCACert(config.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("proxmox: %v", err)
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+	base, _ := config.apiURL()
+	i := &IaaS{
+		config: &config,
+		client: &http.Client{Timeout: time.Minute, Transport: transport},
+		log:    l.With("proxmox", base),
+	}
+	if config.Unverified() {
+		i.log.Warn("the API's certificate will not be verified")
+	}
+	return i, nil
+}
+
+// Unverified reports whether the IaaS connects to the API without
+// verifying its identity.
+func (i *IaaS) Unverified() bool {
+	return i.config.Unverified()
+}
+
+// State lists the cluster's online nodes, its VMs and magnet's HA
+// groups.
+func (i *IaaS) State(ctx context.Context) (*magnet.State, error) {
+	s, err := i.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := s.nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	guests, err := s.guests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.haGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &magnet.State{RuleContainer: "cluster", VMContainer: "cluster"}
+	for _, n := range nodes {
+		state.Hosts = append(state.Hosts, &magnet.Host{ID: n, Name: n})
+	}
+	instances := i.instances(ctx)
+	vmLookup := make(map[string]*magnet.VM)
+	for j := range guests {
+		g := &guests[j]
+		v := &magnet.VM{
+			Name:      g.Name,
+			ID:        g.id(),
+			Reference: g.Type + "/" + g.id(),
+			HostUUID:  g.Node,
+			HostName:  g.Node,
+		}
+		if in, ok := instances[v.ID]; ok {
+			v.Job, v.Index, v.Deployment, v.AZ = in.Job, in.Index, in.Deployment, in.AZ
+		} else {
+			attrs := tagAttributes(g.Tags)
+			if attrs["job"] == "" {
+				desc, err := s.description(ctx, g)
+				if err != nil {
+					return nil, err
+				}
+				attrs = noteAttributes(desc)
+			}
+			v.Job, v.Index, v.Deployment = attrs["job"], attrs["index"], attrs["deployment"]
+		}
+		vmLookup[v.ID] = v
+		if v.Job != "" && i.config.managed(v.Deployment) {
+			state.VMs = append(state.VMs, v)
+		}
+	}
+
+	rules := make(map[string]*magnet.Rule)
+	var all []*magnet.Rule
+	unmanaged := make(map[string]int) // by rule
+	for _, g := range groups {
+		name, strength, ok := parseComment(g)
+		if !ok {
+			continue
+		}
+		r, ok := rules[name]
+		if !ok {
+			r = &magnet.Rule{Name: name, ID: name, Enabled: true, Mandatory: strength == magnet.RuleMandatory, VMs: []*magnet.VM{}}
+			rules[name] = r
+			all = append(all, r)
+		}
+		v, ok := vmLookup[strings.TrimPrefix(g.Group, groupPrefix)]
+		switch {
+		case !ok:
+		case v.Job == "" || !i.config.managed(v.Deployment):
+			unmanaged[name]++
+		default:
+			r.VMs = append(r.VMs, v)
+		}
+	}
+	for _, r := range all {
+		// the rule of deployments that magnet doesn't manage
+		if len(r.VMs) > 0 || unmanaged[r.Name] == 0 {
+			state.Rules = append(state.Rules, r)
+		}
+	}
+	sort.Slice(state.Rules, func(a, b int) bool { return state.Rules[a].Name < state.Rules[b].Name })
+	for _, r := range state.Rules {
+		sort.Slice(r.VMs, func(a, b int) bool { return r.VMs[a].Name < r.VMs[b].Name })
+		r.Violated = len(r.Colocated()) > 0 && len(r.VMs) <= len(state.Hosts)
+	}
+	return state, nil
+}
+
+// instances returns the instances that i.Instances describes, by CID.
+func (i *IaaS) instances(ctx context.Context) map[string]magnet.Instance {
+	byCID, err := magnet.InstancesByCID(ctx, i.Instances)
+	if err != nil {
+		i.log.Warn("failed to list BOSH instances, using VM tags and notes", "err", err)
+	}
+	return byCID
+}
+
+// tagAttributes returns the BOSH attributes in a VM's tags, which are
+// job-<name>, index-<index> and deployment-<name>.
+func tagAttributes(tags string) map[string]string {
+	attrs := make(map[string]string)
+	for _, t := range strings.FieldsFunc(tags, func(r rune) bool { return r == ';' || r == ',' || r == ' ' }) {
+		for _, key := range []string{"job", "index", "deployment"} {
+			if strings.HasPrefix(t, key+"-") {
+				attrs[key] = strings.TrimPrefix(t, key+"-")
+			}
+		}
+	}
+	return attrs
+}
+
+// noteAttributes returns the BOSH attributes in a VM's notes, which are
+// lines such as "job: router".
+func noteAttributes(notes string) map[string]string {
+	attrs := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(notes))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch key := strings.TrimSpace(parts[0]); key {
+		case "job", "index", "deployment":
+			attrs[key] = strings.TrimSpace(parts[1])
+		}
+	}
+	return attrs
+}
+
+// groupName returns the name of the HA group of the VM with vmid.
+func groupName(vmid string) string {
+	return groupPrefix + vmid
+}
+
+// comment returns the comment of the HA groups of r.
+func comment(r *magnet.Rule) string {
+	strength := magnet.RulePreferred
+	if r.Mandatory {
+		strength = magnet.RuleMandatory
+	}
+	return "magnet rule=" + r.Name + " strength=" + strength
+}
+
+// parseComment returns the rule and strength of one of magnet's HA
+// groups, and false for other groups.
+func parseComment(g haGroup) (string, string, bool) {
+	if !strings.HasPrefix(g.Group, groupPrefix) {
+		return "", "", false
+	}
+	var name, strength string
+	for _, f := range strings.Fields(g.Comment) {
+		switch {
+		case strings.HasPrefix(f, "rule="):
+			name = strings.TrimPrefix(f, "rule=")
+		case strings.HasPrefix(f, "strength="):
+			strength = strings.TrimPrefix(f, "strength=")
+		}
+	}
+	return name, strength, name != ""
+}
+
+// nodesSpec returns the nodes of an HA group that prefers preferred to
+// the other nodes.
+func nodesSpec(preferred string, nodes []string) string {
+	spec := []string{preferred + ":2"}
+	for _, n := range nodes {
+		if n != preferred {
+			spec = append(spec, n+":1")
+		}
+	}
+	return strings.Join(spec, ",")
+}
+
+// preferredNode returns the node with the highest priority in an HA
+// group's nodes.
+func preferredNode(spec string) string {
+	best, bestPriority := "", -1
+	for _, n := range strings.Split(spec, ",") {
+		parts := strings.SplitN(n, ":", 2)
+		priority := 0
+		if len(parts) == 2 {
+			priority, _ = strconv.Atoi(parts[1])
+		}
+		if priority > bestPriority {
+			best, bestPriority = parts[0], priority
+		}
+	}
+	return best
+}
+
+// place chooses a node for each of vms, spreading them evenly across
+// nodes while moving as few of them as possible from their current
+// nodes.
+func place(vms []*magnet.VM, nodes []string, current map[string]string) map[string]string {
+	if len(nodes) == 0 {
+		return nil
+	}
+	sorted := append([]*magnet.VM{}, vms...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].Name < sorted[b].Name })
+	online := make(map[string]bool)
+	for _, n := range nodes {
+		online[n] = true
+	}
+
+	placed := make(map[string]string)
+	count := make(map[string]int)
+	keep := len(vms) / len(nodes)
+	if keep == 0 {
+		keep = 1
+	}
+	var rest []*magnet.VM
+	for _, vm := range sorted {
+		if n := current[vm.ID]; online[n] && count[n] < keep {
+			placed[vm.ID] = n
+			count[n]++
+		} else {
+			rest = append(rest, vm)
+		}
+	}
+	for _, vm := range rest {
+		least := nodes[0]
+		for _, n := range nodes {
+			if count[n] < count[least] {
+				least = n
+			}
+		}
+		if n := current[vm.ID]; online[n] && count[n] == count[least] {
+			least = n
+		}
+		placed[vm.ID] = least
+		count[least]++
+	}
+	return placed
+}
+
+// Converge gives each VM of the missing rules an HA group that prefers
+// a node of its own, and removes the HA groups of the VMs of the stale
+// rules.  With PlacementHA, it also makes the VMs HA resources in their
+// groups, removing the resources it created once their VMs have no
+// group; with PlacementMigrate, it migrates the VMs to their preferred
+// nodes itself.  If i has an Auditor, Converge records the rule changes
+// and their outcome.
+func (i *IaaS) Converge(ctx context.Context, state *magnet.State, rec *magnet.RuleRecommendation) error {
+	var entries []magnet.AuditEntry
+	if i.Auditor != nil {
+		entries = magnet.AuditEntries(i.config.user(), state, rec)
+	}
+	err := i.converge(ctx, state, rec)
+	if auditErr := magnet.RecordAudit(i.Auditor, entries, "", err); auditErr != nil {
+		i.log.With("cluster", state.RuleContainer).Error("failed to write audit log", "err", auditErr)
+		if err == nil {
+			return fmt.Errorf("proxmox: failed to write audit log: %v", auditErr)
+		}
+	}
+	return err
+}
+
+// converge makes the changes that Converge records.
+func (i *IaaS) converge(ctx context.Context, state *magnet.State, rec *magnet.RuleRecommendation) error {
+	s, err := i.login(ctx)
+	if err != nil {
+		return err
+	}
+	log := i.log.With("cluster", state.RuleContainer)
+	// VMs move as the HA manager migrates them, so re-read them
+	guests, err := s.guests(ctx)
+	if err != nil {
+		return err
+	}
+	groupList, err := s.haGroups(ctx)
+	if err != nil {
+		return err
+	}
+	resourceList, err := s.haResources(ctx)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*guest)
+	current := make(map[string]string)
+	for j := range guests {
+		byID[guests[j].id()] = &guests[j]
+		current[guests[j].id()] = guests[j].Node
+	}
+	managed := make(map[string]bool)
+	for _, v := range state.VMs {
+		managed[v.ID] = true
+	}
+	groups := make(map[string]haGroup)
+	preferred := make(map[string]string) // of the managed VMs
+	for _, g := range groupList {
+		groups[g.Group] = g
+		id := strings.TrimPrefix(g.Group, groupPrefix)
+		if _, _, ok := parseComment(g); ok && managed[id] {
+			preferred[id] = preferredNode(g.Nodes)
+		}
+	}
+	resources := make(map[string]haResource)
+	for _, r := range resourceList {
+		resources[r.SID] = r
+	}
+	var nodes []string
+	for _, h := range state.Hosts {
+		nodes = append(nodes, h.ID)
+	}
+	sort.Strings(nodes)
+
+	wanted := make(map[string]bool)
+	for j := range rec.Missing {
+		r := &rec.Missing[j]
+		if r.Affinity || r.Hosts != nil {
+			log.Warn("only anti-affinity rules are supported on Proxmox", "rule", r.Name)
+			continue
+		}
+		placed := place(r.VMs, nodes, current)
+		for _, v := range r.VMs {
+			id, node := v.ID, placed[v.ID]
+			if node == "" {
+				continue
+			}
+			g := haGroup{Group: groupName(id), Nodes: nodesSpec(node, nodes), Comment: comment(r)}
+			old, exists := groups[g.Group]
+			if !exists || old.Nodes != g.Nodes || old.Comment != g.Comment {
+				if err = s.putHAGroup(ctx, g, exists); err != nil {
+					log.Error("failed to configure HA group", "rule", r.Name, "group", g.Group, "err", err)
+					return err
+				}
+				log.Info("configured HA group", "rule", r.Name, "group", g.Group, "node", node)
+			}
+			preferred[id] = node
+			wanted[id] = true
+
+			vm, ok := byID[id]
+			if i.config.Placement != PlacementHA || !ok {
+				continue
+			}
+			sid := sid(vm)
+			res, exists := resources[sid]
+			switch {
+			case !exists:
+				err = s.addHAResource(ctx, sid, g.Group, resourceComment, vm.Status == "running")
+			case res.Group != g.Group:
+				err = s.setHAResourceGroup(ctx, sid, g.Group)
+			default:
+				continue
+			}
+			if err != nil {
+				log.Error("failed to add VM to HA group", "rule", r.Name, "vm", sid, "group", g.Group, "err", err)
+				return err
+			}
+			log.Info("added VM to HA group", "rule", r.Name, "vm", sid, "group", g.Group)
+		}
+	}
+
+	for _, r := range rec.Stale {
+		for _, vm := range r.VMs {
+			if wanted[vm.ID] {
+				continue
+			}
+			name := groupName(vm.ID)
+			if g, ok := byID[vm.ID]; ok {
+				if res, ok := resources[sid(g)]; ok && res.Group == name {
+					if res.Comment == resourceComment {
+						err = s.deleteHAResource(ctx, res.SID)
+					} else {
+						err = s.setHAResourceGroup(ctx, res.SID, "")
+					}
+					if err != nil {
+						log.Error("failed to remove VM from HA group", "rule", r.Name, "vm", res.SID, "group", name, "err", err)
+						return err
+					}
+				}
+			}
+			if _, ok := groups[name]; ok {
+				if err = s.deleteHAGroup(ctx, name); err != nil {
+					log.Error("failed to delete HA group", "rule", r.Name, "group", name, "err", err)
+					return err
+				}
+				log.Info("deleted HA group", "rule", r.Name, "group", name)
+			}
+			delete(preferred, vm.ID)
+		}
+	}
+
+	if i.config.Placement != PlacementMigrate {
+		return nil
+	}
+	ids := make([]string, 0, len(preferred))
+	for id := range preferred {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	timeout := i.MigrationBudget()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for _, id := range ids {
+		g, ok := byID[id]
+		if !ok || g.Node == preferred[id] {
+			continue
+		}
+		if err = i.migrate(ctx, s, g, preferred[id], timeout, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sid returns the HA resource ID of a guest.
+func sid(g *guest) string {
+	if g.Type == "lxc" {
+		return "ct:" + g.id()
+	}
+	return "vm:" + g.id()
+}
+
+// MigrationBudget makes the IaaS a magnet.Migrator.  It returns how long
+// Converge may wait for migrations, which is zero unless the placement
+// is PlacementMigrate.
+func (i *IaaS) MigrationBudget() time.Duration {
+	if i.config.Placement != PlacementMigrate {
+		return 0
+	}
+	if i.MigrationTimeout <= 0 {
+		return DefaultMigrationTimeout
+	}
+	return i.MigrationTimeout
+}
+
+// migrate moves a guest to node, and waits for the migration to finish
+// until ctx, which bounds all of Converge's migrations by timeout, is
+// done.
+func (i *IaaS) migrate(ctx context.Context, s *session, g *guest, node string, timeout time.Duration, log magnet.Logger) error {
+	log = log.With("vm", g.Name, "vmid", g.VMID, "from", g.Node, "to", node)
+	upid, err := s.migrate(ctx, g, node)
+	if err != nil {
+		log.Error("failed to migrate VM", "err", err)
+		return err
+	}
+	log.Info("migrating VM")
+	for {
+		done, exit, err := s.taskStatus(ctx, g.Node, upid)
+		if err != nil {
+			return err
+		}
+		if done && exit != "OK" {
+			log.Error("failed to migrate VM", "err", exit)
+			return fmt.Errorf("proxmox: migrating %s to %s: %s", g.Name, node, exit)
+		}
+		if done {
+			log.Info("migrated VM")
+			g.Node = node
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("proxmox: migrating %s to %s didn't complete within the %s allowed for migrations", g.Name, node, timeout)
+		case <-time.After(taskPollInterval):
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package proxmox_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/mock"
+	"github.com/pivotalservices/magnet/proxmox"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeGuest struct {
+	VMID     int    `json:"vmid"`
+	Name     string `json:"name"`
+	Node     string `json:"node"`
+	Type     string `json:"type"`
+	Status   string `json:"status"`
+	Template int    `json:"template"`
+	Tags     string `json:"tags,omitempty"`
+	notes    string
+}
+
+type fakeGroup struct {
+	Group   string `json:"group"`
+	Nodes   string `json:"nodes"`
+	Comment string `json:"comment,omitempty"`
+}
+
+type fakeResource struct {
+	SID     string `json:"sid"`
+	Group   string `json:"group,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// fakePVE serves the parts of the Proxmox VE API that magnet uses.
+type fakePVE struct {
+	*httptest.Server
+	guests    []*fakeGuest
+	groups    map[string]*fakeGroup
+	resources map[string]*fakeResource
+	exit      string   // the exit status of migrations
+	calls     []string // the changes made, such as "migrate 102 pve2 online=1"
+}
+
+func newFakePVE() *fakePVE {
+	f := &fakePVE{
+		guests: []*fakeGuest{
+			{VMID: 101, Name: "router-0", Node: "pve1", Type: "qemu", Status: "running", Tags: "deployment-cf;index-0;job-router"},
+			{VMID: 102, Name: "router-1", Node: "pve1", Type: "qemu", Status: "running", Tags: "deployment-cf;index-1;job-router"},
+			{VMID: 103, Name: "nats-0", Node: "pve2", Type: "lxc", Status: "running", notes: "job: nats\nindex: 0\ndeployment: cf\n"},
+			{VMID: 104, Name: "nats-1", Node: "pve2", Type: "qemu", Status: "stopped", Tags: "deployment-cf job-nats index-1"},
+			{VMID: 105, Name: "mysql-0", Node: "pve3", Type: "qemu", Status: "running", Tags: "deployment-mysql;index-0;job-mysql"},
+			{VMID: 106, Name: "bastion", Node: "pve3", Type: "qemu", Status: "running", notes: "jump box"},
+			{VMID: 900, Name: "stemcell", Node: "pve1", Type: "qemu", Status: "stopped", Template: 1, Tags: "job-stemcell"},
+		},
+		groups: map[string]*fakeGroup{
+			"magnet_101": {Group: "magnet_101", Nodes: "pve1:2,pve2:1,pve3:1", Comment: "magnet rule=router strength=mandatory"},
+			"magnet_102": {Group: "magnet_102", Nodes: "pve1:2,pve2:1,pve3:1", Comment: "magnet rule=router strength=mandatory"},
+			"magnet_105": {Group: "magnet_105", Nodes: "pve3:2,pve1:1,pve2:1", Comment: "magnet rule=old strength=preferred"},
+			"backup":     {Group: "backup", Nodes: "pve1"},
+		},
+		resources: map[string]*fakeResource{
+			"vm:101": {SID: "vm:101", Group: "magnet_101", Comment: "managed by magnet"},
+			"vm:102": {SID: "vm:102", Group: "magnet_102", Comment: "managed by magnet"},
+			"vm:105": {SID: "vm:105", Group: "magnet_105"},
+		},
+		exit: "OK",
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakePVE) authorized(r *http.Request) bool {
+	if r.Header.Get("Authorization") == "PVEAPIToken=root@pam!magnet=s3cret" {
+		return true
+	}
+	c, err := r.Cookie("PVEAuthCookie")
+	return err == nil && c.Value == "ticket-1" && (r.Method == http.MethodGet || r.Header.Get("CSRFPreventionToken") == "csrf-1")
+}
+
+func (f *fakePVE) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/api2/json/"), "/")
+	route := r.Method + " " + strings.Join(path, "/")
+	if route == "POST access/ticket" {
+		if r.FormValue("username") != "root@pam" || r.FormValue("password") != "pa55" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.reply(w, map[string]string{"ticket": "ticket-1", "CSRFPreventionToken": "csrf-1"})
+		return
+	}
+	if !f.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case route == "GET nodes":
+		f.reply(w, []map[string]string{
+			{"node": "pve1", "status": "online"},
+			{"node": "pve2", "status": "online"},
+			{"node": "pve3", "status": "online"},
+			{"node": "pve4", "status": "offline"},
+		})
+	case route == "GET cluster/resources" && r.FormValue("type") == "vm":
+		f.reply(w, f.guests)
+	case r.Method == http.MethodGet && len(path) == 5 && path[4] == "config":
+		for _, g := range f.guests {
+			if fmt.Sprint(g.VMID) == path[3] && g.Node == path[1] && g.Type == path[2] {
+				f.reply(w, map[string]string{"description": g.notes})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	case route == "GET cluster/ha/groups":
+		var groups []*fakeGroup
+		for _, g := range f.groups {
+			groups = append(groups, g)
+		}
+		sort.Slice(groups, func(a, b int) bool { return groups[a].Group < groups[b].Group })
+		f.reply(w, groups)
+	case route == "POST cluster/ha/groups", r.Method == http.MethodPut && len(path) == 4 && path[2] == "groups":
+		g := &fakeGroup{Group: r.FormValue("group"), Nodes: r.FormValue("nodes"), Comment: r.FormValue("comment")}
+		if r.Method == http.MethodPut {
+			g.Group = path[3]
+		}
+		f.groups[g.Group] = g
+		f.calls = append(f.calls, fmt.Sprintf("%s group %s %s %s", strings.ToLower(r.Method), g.Group, g.Nodes, g.Comment))
+		f.reply(w, nil)
+	case r.Method == http.MethodDelete && len(path) == 4 && path[2] == "groups":
+		delete(f.groups, path[3])
+		f.calls = append(f.calls, "delete group "+path[3])
+		f.reply(w, nil)
+	case route == "GET cluster/ha/resources":
+		var resources []*fakeResource
+		for _, res := range f.resources {
+			resources = append(resources, res)
+		}
+		f.reply(w, resources)
+	case route == "POST cluster/ha/resources":
+		res := &fakeResource{SID: r.FormValue("sid"), Group: r.FormValue("group"), Comment: r.FormValue("comment")}
+		f.resources[res.SID] = res
+		f.calls = append(f.calls, fmt.Sprintf("add %s %s %s", res.SID, res.Group, r.FormValue("state")))
+		f.reply(w, nil)
+	case r.Method == http.MethodPut && len(path) == 4 && path[2] == "resources":
+		if r.FormValue("delete") == "group" {
+			f.resources[path[3]].Group = ""
+		} else {
+			f.resources[path[3]].Group = r.FormValue("group")
+		}
+		f.calls = append(f.calls, fmt.Sprintf("set %s %q", path[3], f.resources[path[3]].Group))
+		f.reply(w, nil)
+	case r.Method == http.MethodDelete && len(path) == 4 && path[2] == "resources":
+		delete(f.resources, path[3])
+		f.calls = append(f.calls, "remove "+path[3])
+		f.reply(w, nil)
+	case r.Method == http.MethodPost && len(path) == 5 && path[4] == "migrate":
+		call := fmt.Sprintf("migrate %s %s", path[3], r.FormValue("target"))
+		for _, option := range []string{"online", "restart"} {
+			if r.FormValue(option) != "" {
+				call += " " + option + "=" + r.FormValue(option)
+			}
+		}
+		f.calls = append(f.calls, call)
+		f.reply(w, fmt.Sprintf("UPID:%s:%s:qmigrate", path[1], path[3]))
+	case r.Method == http.MethodGet && len(path) == 5 && path[2] == "tasks" && path[4] == "status":
+		if !strings.HasPrefix(path[3], "UPID:"+path[1]+":") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.reply(w, map[string]string{"status": "stopped", "exitstatus": f.exit})
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakePVE) reply(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func (f *fakePVE) config() proxmox.Config {
+	return proxmox.Config{URL: f.URL, TokenID: "root@pam!magnet", TokenSecret: "s3cret"}
+}
+
+func vmNames(vms []*magnet.VM) []string {
+	names := make([]string, len(vms))
+	for i, vm := range vms {
+		names[i] = vm.Name
+	}
+	return names
+}
+
+func hostIDs(hosts []*magnet.Host) []string {
+	ids := make([]string, len(hosts))
+	for i, h := range hosts {
+		ids[i] = h.ID
+	}
+	return ids
+}
+
+var _ = Describe("IaaS", func() {
+	var fake *fakePVE
+	BeforeEach(func() {
+		fake = newFakePVE()
+	})
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	// recommendation replaces the router rule with a preferred one and
+	// the old rule with a nats rule.
+	recommendation := func(state *magnet.State) *magnet.RuleRecommendation {
+		router := *state.Rules[1]
+		router.ID, router.Mandatory = "", false
+		nats := magnet.Rule{Name: "nats", Enabled: true, VMs: state.VMs[2:4]}
+		return &magnet.RuleRecommendation{
+			Stale:   []magnet.Rule{*state.Rules[0], *state.Rules[1]},
+			Missing: []magnet.Rule{router, nats},
+		}
+	}
+
+	It("lists the online nodes, the VMs of BOSH jobs and magnet's HA groups", func() {
+		i, err := proxmox.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(i.Unverified()).Should(BeTrue())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(state.RuleContainer).Should(Equal("cluster"))
+		Ω(hostIDs(state.Hosts)).Should(Equal([]string{"pve1", "pve2", "pve3"}))
+		Ω(vmNames(state.VMs)).Should(Equal([]string{"router-0", "router-1", "nats-0", "nats-1", "mysql-0"}))
+		Ω(*state.VMs[2]).Should(Equal(magnet.VM{
+			Name: "nats-0", ID: "103", Reference: "lxc/103", HostUUID: "pve2", HostName: "pve2",
+			Job: "nats", Index: "0", Deployment: "cf",
+		}))
+		Ω(state.VMs[3].Index).Should(Equal("1"))
+
+		Ω(state.Rules).Should(HaveLen(2))
+		Ω(state.Rules[0].Name).Should(Equal("old"))
+		Ω(state.Rules[0].Mandatory).Should(BeFalse())
+		Ω(vmNames(state.Rules[0].VMs)).Should(Equal([]string{"mysql-0"}))
+		Ω(state.Rules[1].Name).Should(Equal("router"))
+		Ω(state.Rules[1].ID).Should(Equal("router"))
+		Ω(state.Rules[1].Mandatory).Should(BeTrue())
+		Ω(state.Rules[1].Violated).Should(BeTrue())
+		Ω(vmNames(state.Rules[1].VMs)).Should(Equal([]string{"router-0", "router-1"}))
+		Ω(magnet.IsBalanced(state)).Should(BeFalse())
+	})
+
+	It("identifies VMs with the BOSH director, and logs in with a password", func() {
+		c := fake.config()
+		c.TokenID, c.TokenSecret = "", ""
+		c.Username, c.Password = "root@pam", "pa55"
+		c.Deployments = []string{"cf"}
+		i, err := proxmox.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		i.Instances = mock.Instances{{Deployment: "cf", Job: "jumpbox", Index: "0", AZ: "z1", CID: "106"}}
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(vmNames(state.VMs)).Should(Equal([]string{"router-0", "router-1", "nats-0", "nats-1", "bastion"}))
+		Ω(state.VMs[4].Job).Should(Equal("jumpbox"))
+		Ω(state.VMs[4].AZ).Should(Equal("z1"))
+
+		rec := &magnet.RuleRecommendation{Missing: []magnet.Rule{{Name: "nats", Enabled: true, VMs: state.VMs[2:4]}}}
+		Ω(i.Converge(context.Background(), state, rec)).Should(Succeed())
+		Ω(fake.calls).Should(HaveLen(4))
+	})
+
+	It("gives each VM an HA group that prefers its own node, and makes it an HA resource", func() {
+		i, err := proxmox.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(i.Converge(context.Background(), state, recommendation(state))).Should(Succeed())
+		Ω(fake.calls).Should(Equal([]string{
+			"put group magnet_101 pve1:2,pve2:1,pve3:1 magnet rule=router strength=preferred",
+			"put group magnet_102 pve2:2,pve1:1,pve3:1 magnet rule=router strength=preferred",
+			"post group magnet_103 pve2:2,pve1:1,pve3:1 magnet rule=nats strength=preferred",
+			"add ct:103 magnet_103 started",
+			"post group magnet_104 pve1:2,pve2:1,pve3:1 magnet rule=nats strength=preferred",
+			"add vm:104 magnet_104 stopped",
+			`set vm:105 ""`,
+			"delete group magnet_105",
+		}))
+
+		state, err = i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(state.Rules).Should(HaveLen(2))
+		Ω(state.Rules[0].Name).Should(Equal("nats"))
+		Ω(state.Rules[1].Name).Should(Equal("router"))
+		Ω(state.Rules[1].Mandatory).Should(BeFalse())
+		Ω(i.MigrationBudget()).Should(BeZero())
+	})
+
+	It("removes the HA resources it created with their groups", func() {
+		i, err := proxmox.NewFromConfig(fake.config(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		rec := &magnet.RuleRecommendation{Stale: []magnet.Rule{*state.Rules[1]}}
+		Ω(i.Converge(context.Background(), state, rec)).Should(Succeed())
+		Ω(fake.calls).Should(Equal([]string{
+			"remove vm:101",
+			"delete group magnet_101",
+			"remove vm:102",
+			"delete group magnet_102",
+		}))
+	})
+
+	It("migrates the VMs itself with the migrate placement", func() {
+		c := fake.config()
+		c.Placement = proxmox.PlacementMigrate
+		i, err := proxmox.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(i.Converge(context.Background(), state, recommendation(state))).Should(Succeed())
+		Ω(fake.calls[4:]).Should(Equal([]string{
+			`set vm:105 ""`,
+			"delete group magnet_105",
+			"migrate 102 pve2 online=1",
+			"migrate 104 pve1",
+		}))
+		Ω(i.MigrationBudget()).Should(Equal(proxmox.DefaultMigrationTimeout))
+	})
+
+	It("leaves the HA groups and VMs of other deployments alone", func() {
+		fake.groups["magnet_105"].Nodes = "pve1:2,pve2:1,pve3:1"
+		c := fake.config()
+		c.Placement = proxmox.PlacementMigrate
+		c.Deployments = []string{"cf"}
+		i, err := proxmox.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(state.Rules).Should(HaveLen(1))
+		Ω(state.Rules[0].Name).Should(Equal("router"))
+
+		rec := &magnet.RuleRecommendation{Missing: []magnet.Rule{{Name: "nats", Enabled: true, VMs: state.VMs[2:4]}}}
+		Ω(i.Converge(context.Background(), state, rec)).Should(Succeed())
+		Ω(fake.calls).ShouldNot(ContainElement(ContainSubstring("105")))
+		Ω(fake.groups).Should(HaveKey("magnet_105"))
+	})
+
+	It("reports failed migrations", func() {
+		fake.exit = "migration aborted"
+		c := fake.config()
+		c.Placement = proxmox.PlacementMigrate
+		i, err := proxmox.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		state, err := i.State(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = i.Converge(context.Background(), state, recommendation(state))
+		Ω(err).Should(MatchError("proxmox: migrating router-1 to pve2: migration aborted"))
+	})
+
+	It("reports the errors of the API", func() {
+		c := fake.config()
+		c.TokenID, c.TokenSecret = "", ""
+		c.Username, c.Password = "root@pam", "wrong"
+		i, err := proxmox.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = i.State(context.Background())
+		Ω(err).Should(MatchError("proxmox: POST /access/ticket: 401 Unauthorized"))
+	})
+})
+
+var _ = Describe("Config", func() {
+	It("reads the PROXMOX_* environment variables", func() {
+		for name, value := range map[string]string{
+			"PROXMOX_URL":          "https://pve1",
+			"PROXMOX_TOKEN_ID":     "root@pam!magnet",
+			"PROXMOX_TOKEN_SECRET": "s3cret",
+			"PROXMOX_PLACEMENT":    "migrate",
+			"PROXMOX_INSECURE":     "false",
+		} {
+			os.Setenv(name, value)
+			defer os.Unsetenv(name)
+		}
+		var c proxmox.Config
+		Ω(c.ApplyEnv()).Should(Succeed())
+		Ω(c).Should(Equal(proxmox.Config{URL: "https://pve1", TokenID: "root@pam!magnet", TokenSecret: "s3cret", Placement: "migrate"}))
+		Ω(c.Validate()).Should(BeEmpty())
+		Ω(c.Unverified()).Should(BeFalse())
+
+		os.Setenv("PROXMOX_INSECURE", "maybe")
+		Ω(c.ApplyEnv()).Should(MatchError(`PROXMOX_INSECURE: invalid boolean "maybe"`))
+	})
+
+	It("validates the settings", func() {
+		c := proxmox.Config{URL: "pve1", TokenID: "root@pam", Insecure: true, CACert: "/nonexistent", Placement: "manual"}
+		Ω(c.Validate()).Should(HaveLen(6))
+		c = proxmox.Config{URL: "https://pve1", Username: "root@pam"}
+		Ω(c.Validate()).Should(ConsistOf(MatchError("password is required with username")))
+	})
+})
@@ -0,0 +1,13 @@
+package proxmox_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestProxmox(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Proxmox Suite")
+}
@@ -0,0 +1,180 @@
+package magnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ReportVersion is the version of the Report schema.  It is incremented
+// whenever a field is removed or its meaning changes; new fields may be
+// added without changing the version.
+const ReportVersion = "v1"
+
+// Report is the machine-readable form of the output of a check.
+// All lists are sorted so that reports can be diffed between runs.
+type Report struct {
+	Version         string                `json:"version" yaml:"version"`
+	Balanced        bool                  `json:"balanced" yaml:"balanced"`
+	Jobs            []JobReport           `json:"jobs" yaml:"jobs"`
+	Recommendations *RecommendationReport `json:"recommendations,omitempty" yaml:"recommendations,omitempty"`
+
+	// Violations are the existing rules that aren't satisfied.
+	Violations []RuleReport `json:"violations,omitempty" yaml:"violations,omitempty"`
+
+	// LimitExceeded is why the check refused to converge, if a
+	// safety limit stopped it.
+	LimitExceeded string `json:"limit_exceeded,omitempty" yaml:"limit_exceeded,omitempty"`
+}
+
+// JobReport describes how the VMs of a single job are placed.
+// The jobs of a group are balanced, or not, together.
+type JobReport struct {
+	Name     string     `json:"name" yaml:"name"`
+	Balanced bool       `json:"balanced" yaml:"balanced"`
+	Ignored  bool       `json:"ignored,omitempty" yaml:"ignored,omitempty"`
+	Group    string     `json:"group,omitempty" yaml:"group,omitempty"`
+	VMs      []VMReport `json:"vms" yaml:"vms"`
+}
+
+// VMReport describes a single VM and the host it runs on.
+type VMReport struct {
+	Name string `json:"name" yaml:"name"`
+	Host string `json:"host" yaml:"host"`
+}
+
+// RecommendationReport is the machine-readable form of a RuleRecommendation.
+type RecommendationReport struct {
+	Valid   []RuleReport `json:"valid" yaml:"valid"`
+	Stale   []RuleReport `json:"stale" yaml:"stale"`
+	Missing []RuleReport `json:"missing" yaml:"missing"`
+}
+
+// RuleReport describes a single rule and its member VMs.
+type RuleReport struct {
+	Name string   `json:"name" yaml:"name"`
+	Key  int32    `json:"key,omitempty" yaml:"key,omitempty"`
+	VMs  []string `json:"vms" yaml:"vms"`
+
+	// Affinity rules keep their members together.
+	Affinity bool `json:"affinity,omitempty" yaml:"affinity,omitempty"`
+
+	// Hosts are the hosts that a VM/Host rule runs its members on.
+	Hosts []string `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+
+	// Violated rules list their co-located members by host.
+	Violated  bool                `json:"violated,omitempty" yaml:"violated,omitempty"`
+	Colocated map[string][]string `json:"colocated,omitempty" yaml:"colocated,omitempty"`
+}
+
+// NewReport builds a Report for the state s.  If rec is non-nil,
+// it is included in the report.
+func NewReport(s *State, rec *RuleRecommendation) *Report {
+	r := &Report{
+		Version:  ReportVersion,
+		Balanced: IsBalanced(s),
+		Jobs:     []JobReport{},
+	}
+
+	vmsForJob := make(map[string][]*VM)
+	for _, vm := range s.VMs {
+		vmsForJob[vm.Job] = append(vmsForJob[vm.Job], vm)
+	}
+	groups := s.groups()
+	for job, vms := range vmsForJob {
+		jr := JobReport{Name: job, VMs: []VMReport{}}
+		for _, vm := range vms {
+			host := vm.HostName
+			if host == "" {
+				host = vm.HostUUID
+			}
+			jr.VMs = append(jr.VMs, VMReport{Name: vm.Name, Host: host})
+		}
+		g := groups[s.groupOf(job)]
+		jr.Balanced = g.balanced(s)
+		jr.Ignored = g.Policy.Ignore
+		if g.Name != job {
+			jr.Group = g.Name
+		}
+		sort.Slice(jr.VMs, func(i, j int) bool { return jr.VMs[i].Name < jr.VMs[j].Name })
+		r.Jobs = append(r.Jobs, jr)
+	}
+	sort.Slice(r.Jobs, func(i, j int) bool { return r.Jobs[i].Name < r.Jobs[j].Name })
+
+	if rec != nil {
+		r.Recommendations = &RecommendationReport{
+			Valid:   RuleReports(rec.Valid),
+			Stale:   RuleReports(rec.Stale),
+			Missing: RuleReports(rec.Missing),
+		}
+	}
+	var violated []Rule
+	for _, rule := range s.Rules {
+		if rule.Violated {
+			violated = append(violated, *rule)
+		}
+	}
+	if len(violated) > 0 {
+		r.Violations = RuleReports(violated)
+	}
+	return r
+}
+
+// RuleReports describes each of rules, sorted by name.
+func RuleReports(rules []Rule) []RuleReport {
+	result := make([]RuleReport, 0, len(rules))
+	for _, rule := range rules {
+		rr := RuleReport{Name: rule.Name, Key: rule.Key, VMs: []string{}, Affinity: rule.Affinity}
+		for _, vm := range rule.VMs {
+			if vm == nil {
+				continue
+			}
+			rr.VMs = append(rr.VMs, vm.Name)
+		}
+		sort.Strings(rr.VMs)
+		for _, host := range rule.Hosts {
+			rr.Hosts = append(rr.Hosts, host.Name)
+		}
+		sort.Strings(rr.Hosts)
+		if rule.Violated {
+			rr.Violated = true
+			rr.Colocated = make(map[string][]string)
+			for host, vms := range rule.Colocated() {
+				for _, vm := range vms {
+					rr.Colocated[host] = append(rr.Colocated[host], vm.Name)
+				}
+			}
+		}
+		result = append(result, rr)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// Write encodes the report to w in the specified format (OutputJSON or OutputYAML).
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case OutputYAML:
+		b, err := yaml.Marshal(r)
+		if err != nil {
+			return err
+		}
+		// start each report with a document separator so
+		// that successive reports form a valid YAML stream
+		_, err = fmt.Fprintf(w, "---\n%s", b)
+		return err
+	}
+	return fmt.Errorf("cannot write report as %q", format)
+}
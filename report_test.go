@@ -0,0 +1,115 @@
+package magnet_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/pivotalservices/magnet"
+	yaml "gopkg.in/yaml.v2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Report", func() {
+	var (
+		state *magnet.State
+		rec   *magnet.RuleRecommendation
+	)
+	BeforeEach(func() {
+		host1 := &magnet.Host{ID: "host1", Name: "esx-01"}
+		host2 := &magnet.Host{ID: "host2", Name: "esx-02"}
+
+		routerVM2 := &magnet.VM{Name: "router-2", Job: "router", HostUUID: host1.ID, HostName: host1.Name}
+		routerVM1 := &magnet.VM{Name: "router-1", Job: "router", HostUUID: host1.ID, HostName: host1.Name}
+		cellVM1 := &magnet.VM{Name: "cell-1", Job: "diego_cell", HostUUID: host1.ID}
+		cellVM2 := &magnet.VM{Name: "cell-2", Job: "diego_cell", HostUUID: host2.ID}
+
+		state = &magnet.State{
+			Hosts: []*magnet.Host{host1, host2},
+			VMs:   []*magnet.VM{routerVM2, routerVM1, cellVM2, cellVM1},
+			Rules: []*magnet.Rule{
+				{Name: "bogus", Key: 7, VMs: []*magnet.VM{routerVM1, cellVM1}},
+			},
+		}
+		rec = magnet.RuleRecommendations(state)
+	})
+
+	It("sorts jobs, VMs and rules by name", func() {
+		r := magnet.NewReport(state, rec)
+		Ω(r.Version).Should(Equal(magnet.ReportVersion))
+		Ω(r.Balanced).Should(BeFalse())
+		Ω(r.Jobs).Should(HaveLen(2))
+		Ω(r.Jobs[0].Name).Should(Equal("diego_cell"))
+		Ω(r.Jobs[0].Balanced).Should(BeTrue())
+		Ω(r.Jobs[0].VMs).Should(Equal([]magnet.VMReport{{Name: "cell-1", Host: "host1"}, {Name: "cell-2", Host: "host2"}}))
+		Ω(r.Jobs[1].Name).Should(Equal("router"))
+		Ω(r.Jobs[1].Balanced).Should(BeFalse())
+		Ω(r.Jobs[1].VMs).Should(Equal([]magnet.VMReport{{Name: "router-1", Host: "esx-01"}, {Name: "router-2", Host: "esx-01"}}))
+
+		Ω(r.Recommendations.Valid).Should(BeEmpty())
+		Ω(r.Recommendations.Stale).Should(Equal([]magnet.RuleReport{{Name: "bogus", Key: 7, VMs: []string{"cell-1", "router-1"}}}))
+		Ω(r.Recommendations.Missing).Should(HaveLen(2))
+		Ω(r.Recommendations.Missing[0].Name).Should(Equal("diego_cell"))
+		Ω(r.Recommendations.Missing[1].Name).Should(Equal("router"))
+		Ω(r.Recommendations.Missing[1].VMs).Should(Equal([]string{"router-1", "router-2"}))
+	})
+
+	It("omits recommendations when none are provided", func() {
+		buf := &bytes.Buffer{}
+		Ω(magnet.NewReport(state, nil).Write(buf, magnet.OutputJSON)).Should(Succeed())
+		Ω(buf.String()).ShouldNot(ContainSubstring("recommendations"))
+	})
+
+	It("produces identical output for identical states", func() {
+		buf1, buf2 := &bytes.Buffer{}, &bytes.Buffer{}
+		Ω(magnet.NewReport(state, rec).Write(buf1, magnet.OutputJSON)).Should(Succeed())
+		Ω(magnet.NewReport(state, magnet.RuleRecommendations(state)).Write(buf2, magnet.OutputJSON)).Should(Succeed())
+		Ω(buf1.String()).Should(Equal(buf2.String()))
+	})
+
+	It("round-trips through JSON", func() {
+		buf := &bytes.Buffer{}
+		Ω(magnet.NewReport(state, rec).Write(buf, magnet.OutputJSON)).Should(Succeed())
+		var r magnet.Report
+		Ω(json.Unmarshal(buf.Bytes(), &r)).Should(Succeed())
+		Ω(&r).Should(Equal(magnet.NewReport(state, rec)))
+	})
+
+	It("round-trips through YAML", func() {
+		buf := &bytes.Buffer{}
+		Ω(magnet.NewReport(state, rec).Write(buf, magnet.OutputYAML)).Should(Succeed())
+		Ω(buf.String()).Should(HavePrefix("---\n"))
+		var r magnet.Report
+		Ω(yaml.Unmarshal(buf.Bytes(), &r)).Should(Succeed())
+		Ω(&r).Should(Equal(magnet.NewReport(state, rec)))
+	})
+
+	It("reports rules that aren't satisfied, with their co-located members", func() {
+		state.Rules[0].Violated = true
+		state.Rules[0].VMs = append(state.Rules[0].VMs, state.VMs[0])
+		r := magnet.NewReport(state, magnet.RuleRecommendations(state))
+		Ω(r.Violations).Should(HaveLen(1))
+		Ω(r.Violations[0].Violated).Should(BeTrue())
+		Ω(r.Violations[0].Colocated).Should(Equal(map[string][]string{
+			"esx-01": {"cell-1", "router-1", "router-2"},
+		}))
+		Ω(r.Recommendations.Stale[0].Colocated).Should(Equal(r.Violations[0].Colocated))
+	})
+
+	It("writes violated rules as text", func() {
+		buf := &bytes.Buffer{}
+		magnet.SetOutput(buf)
+		defer magnet.SetOutput(os.Stdout)
+		state.Rules[0].Violated = true
+		Ω(magnet.PrintState(state, nil)).Should(Succeed())
+		Ω(buf.String()).Should(ContainSubstring("--VIOLATED--"))
+		Ω(buf.String()).Should(MatchRegexp(`bogus\s+esx-01: cell-1, router-1`))
+	})
+
+	It("rejects unknown formats", func() {
+		Ω(magnet.SetFormat("xml")).ShouldNot(Succeed())
+		Ω(magnet.NewReport(state, rec).Write(&bytes.Buffer{}, "xml")).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,225 @@
+package magnet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule determines when something should next happen.
+type Schedule interface {
+	// Next returns the first time after t that the schedule fires.
+	Next(t time.Time) time.Time
+}
+
+// Every is a Schedule that fires at a fixed interval.
+type Every time.Duration
+
+// Next returns t plus the interval.
+func (e Every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+func (e Every) String() string {
+	return time.Duration(e).String()
+}
+
+// ParseSchedule parses a schedule in one of the following forms:
+//   - a duration, such as 30s or 2m30s, or @every followed by a duration
+//   - a whole number of minutes, such as 5
+//   - a cron expression (see ParseCron)
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if n, err := strconv.Atoi(spec); err == nil {
+		return checkEvery(spec, time.Duration(n)*time.Minute)
+	}
+	if d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every"))); err == nil {
+		return checkEvery(spec, d)
+	}
+	return ParseCron(spec)
+}
+
+func checkEvery(spec string, d time.Duration) (Schedule, error) {
+	if d <= 0 {
+		return nil, fmt.Errorf("schedule %q: interval must be positive", spec)
+	}
+	return Every(d), nil
+}
+
+// Cron is a Schedule that fires at the minutes matched by a
+// cron expression.
+type Cron struct {
+	spec string
+
+	minute, hour, dom, month, dow uint64
+
+	// domAny and dowAny record whether the day-of-month and day-of-week
+	// fields were *.  If both are restricted, a day matches if either
+	// field matches, as it does in cron.
+	domAny, dowAny bool
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// ParseCron parses a standard five-field cron expression:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Each field may be *, a value, a range (1-5), a list (1,3,5) or any of
+// these with a step (*/15, 0-30/10).  Months and days of the week may be
+// given by their three-letter names, and Sunday is either 0 or 7.  The
+// descriptors @yearly, @monthly, @weekly, @daily and @hourly are also
+// accepted.  Times are matched in the location of the time passed to
+// Next or Matches.
+func ParseCron(spec string) (*Cron, error) {
+	expr := strings.TrimSpace(spec)
+	if d, ok := cronDescriptors[expr]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: expected a duration or 5 cron fields, got %d fields", spec, len(fields))
+	}
+
+	c := &Cron{spec: spec, domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	parsers := []struct {
+		bits     *uint64
+		min, max int
+		names    []string
+	}{
+		{&c.minute, 0, 59, nil},
+		{&c.hour, 0, 23, nil},
+		{&c.dom, 1, 31, nil},
+		{&c.month, 1, 12, monthNames},
+		{&c.dow, 0, 7, dayNames},
+	}
+	for i, p := range parsers {
+		if *p.bits, err = parseCronField(fields[i], p.min, p.max, p.names); err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", spec, err)
+		}
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never fires", spec)
+	}
+	return c, nil
+}
+
+// parseCronField returns a bit set of the values matched by field.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		lo, hi := min, max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = cronValue(bounds[0], min, names); err != nil {
+				return 0, err
+			}
+			if hi, err = cronValue(bounds[1], min, names); err != nil {
+				return 0, err
+			}
+		default:
+			v, err := cronValue(rng, min, names)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = v, v
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, min int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// Matches reports whether the minute containing t is matched by c.
+func (c *Cron) Matches(t time.Time) bool {
+	return c.month&(1<<uint(t.Month())) != 0 &&
+		c.dayMatches(t) &&
+		c.hour&(1<<uint(t.Hour())) != 0 &&
+		c.minute&(1<<uint(t.Minute())) != 0
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the start of the first minute after t that is matched
+// by c, or the zero time if there is none within five years.
+func (c *Cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *Cron) String() string {
+	return c.spec
+}
@@ -0,0 +1,72 @@
+package magnet_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pivotalservices/magnet"
+)
+
+var _ = Describe("Schedules", func() {
+	// a Wednesday
+	start := time.Date(2017, time.March, 15, 10, 17, 30, 0, time.UTC)
+
+	It("parses intervals", func() {
+		for spec, interval := range map[string]time.Duration{
+			"2m30s":     150 * time.Second,
+			"30s":       30 * time.Second,
+			"5":         5 * time.Minute,
+			"@every 1h": time.Hour,
+		} {
+			s, err := magnet.ParseSchedule(spec)
+			Ω(err).ShouldNot(HaveOccurred(), spec)
+			Ω(s.Next(start)).Should(Equal(start.Add(interval)), spec)
+		}
+	})
+
+	It("finds the next time a cron expression fires", func() {
+		for spec, next := range map[string]time.Time{
+			"* * * * *":        time.Date(2017, time.March, 15, 10, 18, 0, 0, time.UTC),
+			"*/15 * * * *":     time.Date(2017, time.March, 15, 10, 30, 0, 0, time.UTC),
+			"0 3,12 * * *":     time.Date(2017, time.March, 15, 12, 0, 0, 0, time.UTC),
+			"0 3 * * *":        time.Date(2017, time.March, 16, 3, 0, 0, 0, time.UTC),
+			"30 2 * * sat,sun": time.Date(2017, time.March, 18, 2, 30, 0, 0, time.UTC),
+			"0 0 * * 7":        time.Date(2017, time.March, 19, 0, 0, 0, 0, time.UTC),
+			"0 0 1 jun *":      time.Date(2017, time.June, 1, 0, 0, 0, 0, time.UTC),
+			"0 0 17 * mon":     time.Date(2017, time.March, 17, 0, 0, 0, 0, time.UTC),
+			"0 0 29 feb *":     time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC),
+			"@daily":           time.Date(2017, time.March, 16, 0, 0, 0, 0, time.UTC),
+		} {
+			s, err := magnet.ParseSchedule(spec)
+			Ω(err).ShouldNot(HaveOccurred(), spec)
+			Ω(s.Next(start)).Should(Equal(next), spec)
+		}
+	})
+
+	It("rejects invalid schedules", func() {
+		for _, spec := range []string{
+			"",
+			"* * *",
+			"0s",
+			"-5m",
+			"60 * * * *",
+			"* 5-1 * * *",
+			"*/0 * * * *",
+			"* * * * funday",
+			"0 0 30 feb *",
+		} {
+			_, err := magnet.ParseSchedule(spec)
+			Ω(err).Should(HaveOccurred(), spec)
+		}
+	})
+
+	It("matches the minutes of quiet hours", func() {
+		c, err := magnet.ParseCron("* 22-23,0-5 * * mon-fri")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.Matches(time.Date(2017, time.March, 15, 23, 59, 0, 0, time.UTC))).Should(BeTrue())
+		Ω(c.Matches(time.Date(2017, time.March, 15, 6, 0, 0, 0, time.UTC))).Should(BeFalse())
+		Ω(c.Matches(time.Date(2017, time.March, 18, 23, 0, 0, 0, time.UTC))).Should(BeFalse())
+	})
+})
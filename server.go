@@ -0,0 +1,128 @@
+package magnet
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Server exposes the daemon's state over HTTP.  It serves:
+//
+//	GET  /healthz                 200 while the process is serving
+//	GET  /readyz                  200 while the daemon's polls succeed
+//	GET  /status                  the daemon's DaemonStatus
+//	GET  /proposals               list proposals
+//	GET  /proposals/{id}          get a proposal
+//	POST /proposals/{id}/approve  approve a pending proposal
+//
+// Approving requires an "Authorization: Bearer <ApprovalToken>" header,
+// and is forbidden if ApprovalToken is empty.
+type Server struct {
+	Daemon        *Daemon
+	Proposals     *ProposalStore
+	ApprovalToken Secret
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "healthz":
+		w.Write([]byte("ok\n"))
+	case len(parts) == 1 && (parts[0] == "readyz" || parts[0] == "status"):
+		srv.serveStatus(w, r, parts[0] == "readyz")
+	case parts[0] == "proposals":
+		srv.serveProposals(w, r, parts[1:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (srv *Server) serveProposals(w http.ResponseWriter, r *http.Request, parts []string) {
+	if srv.Proposals == nil {
+		http.Error(w, "approval is not required", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		proposals, err := srv.Proposals.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if proposals == nil {
+			proposals = []*Proposal{}
+		}
+		writeJSON(w, http.StatusOK, proposals)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		p, err := srv.Proposals.Get(parts[0])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	case len(parts) == 2 && parts[1] == "approve" && r.Method == http.MethodPost:
+		if srv.ApprovalToken == "" {
+			http.Error(w, "approval over HTTP is disabled without a token", http.StatusForbidden)
+			return
+		}
+		if !srv.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if err := srv.Proposals.Approve(parts[0]); err != nil {
+			writeError(w, err)
+			return
+		}
+		p, err := srv.Proposals.Get(parts[0])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	case len(parts) <= 2:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorized reports whether r carries the approval token.
+func (srv *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(srv.ApprovalToken)) == 1
+}
+
+func (srv *Server) serveStatus(w http.ResponseWriter, r *http.Request, readiness bool) {
+	if srv.Daemon == nil {
+		http.NotFound(w, r)
+		return
+	}
+	status := srv.Daemon.Status()
+	code := http.StatusOK
+	if readiness && !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrProposalNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrProposalNotPending:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
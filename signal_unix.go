@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package magnet
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	reloadSignal    = os.Signal(syscall.SIGHUP)
+	triggerSignal   = os.Signal(syscall.SIGUSR1)
+)
@@ -0,0 +1,14 @@
+package magnet
+
+import (
+	"os"
+	"syscall"
+)
+
+// Windows has no SIGUSR1, so a check can't be triggered by a signal.
+// triggerSignal is never delivered.
+var (
+	shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	reloadSignal    = os.Signal(syscall.SIGHUP)
+	triggerSignal   = os.Signal(syscall.Signal(-1))
+)
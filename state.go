@@ -5,8 +5,9 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"math"
+	"sort"
 	"text/tabwriter"
+	"time"
 
 	"github.com/fatih/color"
 )
@@ -14,6 +15,7 @@ import (
 var (
 	balancedIndicator   = "✓"
 	unbalancedIndicator = "✗"
+	ignoredIndicator    = "-"
 
 	red   = color.New(color.FgRed).SprintfFunc()
 	green = color.New(color.FgGreen).SprintfFunc()
@@ -21,59 +23,272 @@ var (
 
 // Check gets the state of the deployment on the specified IaaS,
 // checks whether is it balanced, and attempts to rebalence
+// if necessary.  If l is nil, nothing is logged.
+func Check(ctx context.Context, i IaaS, l Logger) error {
+	c := &Checker{IaaS: i, Logger: l}
+	return c.Check(ctx)
+}
+
+// Checker checks whether a deployment is balanced and rebalances
+// it if necessary.  Only the IaaS is required.
+type Checker struct {
+	IaaS     IaaS
+	Logger   Logger
+	Notifier Notifier
+
+	// Proposals, if non-nil, requires recommendations to be
+	// approved before they are applied.  Instead of converging,
+	// Check records the recommendations as a pending proposal
+	// and applies them once the proposal has been approved.
+	Proposals *ProposalStore
+
+	// Limits, if non-nil, bounds the changes made by each check.
+	Limits *Limits
+
+	// Jobs, if non-nil, restricts the jobs that are checked.
+	Jobs *JobFilter
+
+	// Policies sets the policies of jobs that the IaaS doesn't.
+	Policies Policies
+
+	// Observe, if true, reports and notifies about the state of the
+	// deployment without converging or proposing any changes.
+	Observe bool
+}
+
+// Check gets the state of the deployment on the Checker's IaaS,
+// checks whether is it balanced, and attempts to rebalence
 // if necessary.
-func Check(ctx context.Context, i IaaS) error {
-	s, err := i.State(ctx)
-	_ = s
+func (c *Checker) Check(ctx context.Context) error {
+	l := c.Logger
+	if l == nil {
+		l = NopLogger()
+	}
+	s, err := c.State(ctx)
 	if err != nil {
-		// Need to log this
+		l.Error("failed to get state", "err", err)
 		return err
 	}
-	PrintJobs(s)
-	if !IsBalanced(s) {
-		rec := RuleRecommendations(s)
-		rec.PrintReport()
-		err = i.Converge(ctx, s, rec)
+	l.Debug("got state", "hosts", len(s.Hosts), "vms", len(s.VMs), "rules", len(s.Rules))
+	for _, r := range s.Rules {
+		if r.Violated {
+			l.Warn("rule is not satisfied", "rule", r.Name, "colocated", colocatedNames(r))
+		}
+	}
+	if !c.Observe {
+		accepted, err := c.Limits.checkVMs(s)
 		if err != nil {
-			return err
+			return c.limitExceeded(ctx, l, s, nil, err, nil)
 		}
+		if accepted {
+			l.Warn("accepted dropped VM count", "vms", len(s.VMs))
+		}
+	}
+	rec := Recommendations(s)
+	if rec == nil {
+		return PrintState(s, nil)
+	}
+
+	jobs := UnbalancedJobs(s)
+	for _, job := range jobs {
+		l.Warn("job is unbalanced", "job", job)
+	}
+	if len(jobs) > 0 {
+		c.notify(ctx, l, &Event{Type: EventUnbalanced, Jobs: jobs})
+	}
+	if c.Observe {
+		l.Info("only observing, not converging", "added", len(rec.Missing), "removed", len(rec.Stale))
+		return PrintState(s, rec)
+	}
+	if err = c.Limits.checkChanges(s, rec); err != nil {
+		return c.limitExceeded(ctx, l, s, rec, err, jobs)
+	}
+	if err = PrintState(s, rec); err != nil {
+		return err
+	}
+	if c.Proposals != nil {
+		return c.propose(ctx, l, s, rec, jobs)
+	}
+	return c.converge(ctx, l, s, rec, jobs)
+}
+
+// State gets the state of the deployment on the Checker's IaaS,
+// restricted to the Checker's Jobs and with the Checker's Policies.
+func (c *Checker) State(ctx context.Context) (*State, error) {
+	s, err := c.IaaS.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.Jobs.apply(s)
+	c.Policies.apply(s)
+	return s, nil
+}
+
+func (c *Checker) converge(ctx context.Context, l Logger, s *State, rec *RuleRecommendation, jobs []string) error {
+	err := c.IaaS.Converge(ctx, s, rec)
+	if perr, ok := err.(PendingError); ok {
+		l.Warn("converged, but an operator must act before the rules are satisfied", "err", err)
+		c.Limits.waiting(rec)
+		c.notify(ctx, l, &Event{
+			Type:    EventActionsPending,
+			Jobs:    jobs,
+			Added:   ruleNames(rec.Missing),
+			Removed: ruleNames(rec.Stale),
+			Actions: perr.Pending(),
+		})
+		return nil
+	}
+	c.Limits.waiting(nil)
+	if err != nil {
+		l.Error("failed to converge", "err", err)
+		c.notify(ctx, l, &Event{Type: EventConvergeFailed, Jobs: jobs, Error: err.Error()})
+		return err
 	}
+	l.Info("converged", "added", len(rec.Missing), "removed", len(rec.Stale))
+	c.notify(ctx, l, &Event{
+		Type:    EventConverged,
+		Jobs:    jobs,
+		Added:   ruleNames(rec.Missing),
+		Removed: ruleNames(rec.Stale),
+	})
 	return nil
 }
 
+// propose parks rec as a pending proposal, or applies it if a
+// proposal for the same state has been approved.
+func (c *Checker) propose(ctx context.Context, l Logger, s *State, rec *RuleRecommendation, jobs []string) error {
+	p, created, err := c.Proposals.propose(Fingerprint(s, rec), NewReport(s, rec))
+	if err != nil {
+		l.Error("failed to record proposal", "err", err)
+		return err
+	}
+	l = l.With("proposal", p.ID)
+	if created {
+		l.Info("recommendations are awaiting approval")
+		c.notify(ctx, l, &Event{
+			Type:     EventProposed,
+			Jobs:     jobs,
+			Added:    ruleNames(rec.Missing),
+			Removed:  ruleNames(rec.Stale),
+			Proposal: p.ID,
+		})
+		return nil
+	}
+	if !p.Approved {
+		l.Debug("recommendations are still awaiting approval")
+		return nil
+	}
+
+	l.Info("applying approved proposal")
+	err = c.converge(ctx, l, s, rec, jobs)
+	status := ProposalApplied
+	if err != nil {
+		status = ProposalFailed
+	}
+	if ferr := c.Proposals.finish(p, status, err); ferr != nil {
+		l.Error("failed to update proposal", "err", ferr)
+		if err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// limitExceeded reports that err, a *LimitError, prevented
+// the Checker from converging s, with rec if it is non-nil.
+func (c *Checker) limitExceeded(ctx context.Context, l Logger, s *State, rec *RuleRecommendation, err error, jobs []string) error {
+	l.Error("safety limit exceeded, not converging", "err", err)
+	if perr := printState(s, rec, err); perr != nil {
+		l.Error("failed to print state", "err", perr)
+	}
+	c.notify(ctx, l, &Event{Type: EventLimitExceeded, Jobs: jobs, Error: err.Error()})
+	return err
+}
+
+// notify sends e to the Checker's Notifier, if it has one.
+// Failing to notify does not fail the check.
+func (c *Checker) notify(ctx context.Context, l Logger, e *Event) {
+	if c.Notifier == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	if err := c.Notifier.Notify(ctx, e); err != nil {
+		l.Warn("failed to send notification", "event", e.Type, "err", err)
+	}
+}
+
+func ruleNames(rules []Rule) []string {
+	names := make([]string, 0, len(rules))
+	for i := range rules {
+		names = append(names, rules[i].Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// colocatedNames lists the co-located members of r.
+func colocatedNames(r *Rule) []string {
+	var names []string
+	for _, vms := range r.Colocated() {
+		for _, vm := range vms {
+			names = append(names, vm.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 // IsBalanced determines whether the state of a deployment is balanced.
 // A deployment is balanced jobs are spread across as many hosts as possible.
+// The jobs of a group are spread together, as one job.
 func IsBalanced(s *State) bool {
-	jobHosts := make(map[string]hostList)
-	for _, vm := range s.VMs {
-		jobHosts[vm.Job] = append(jobHosts[vm.Job], vm.HostUUID)
-	}
-
-	hostCount := len(s.Hosts)
-	for _, hosts := range jobHosts {
-		if hosts.exceedsMax(hostCount) {
+	for _, g := range s.groups() {
+		if !g.balanced(s) {
 			return false
 		}
 	}
 	return true
 }
 
+// UnbalancedJobs returns the names of the jobs, or of the groups of
+// jobs, whose VMs are not spread across as many hosts as possible,
+// sorted by name.
+func UnbalancedJobs(s *State) []string {
+	var jobs []string
+	for name, g := range s.groups() {
+		if !g.balanced(s) {
+			jobs = append(jobs, name)
+		}
+	}
+	sort.Strings(jobs)
+	return jobs
+}
+
 // PrintJobs while indicating if each job is balanced
 func PrintJobs(s *State) {
-	jobHosts := make(map[string]hostList)
-	for _, vm := range s.VMs {
-		jobHosts[vm.Job] = append(jobHosts[vm.Job], vm.HostUUID)
+	groups := s.groups()
+	var jobNames []string
+	for _, g := range groups {
+		jobNames = append(jobNames, g.Jobs...)
 	}
+	sort.Strings(jobNames)
 
-	hostCount := len(s.Hosts)
-	for jobName, hosts := range jobHosts {
-		isBalanced := !hosts.exceedsMax(hostCount)
+	for _, jobName := range jobNames {
+		g := groups[s.groupOf(jobName)]
+		if g.Policy.Ignore {
+			fmt.Fprintf(output, "%s  %s (ignored)\n", ignoredIndicator, jobName)
+			continue
+		}
 		var status string
-		if isBalanced {
+		if g.balanced(s) {
 			status = greenSprintf("%s", balancedIndicator)
 		} else {
 			status = redSprintf("%s", unbalancedIndicator)
 		}
+		if g.Name != jobName {
+			fmt.Fprintf(output, "%s  %s (group %s)\n", status, jobName, g.Name)
+			continue
+		}
 		fmt.Fprintf(output, "%s  %s\n", status, jobName)
 	}
 }
@@ -96,7 +311,9 @@ func (r *RuleRecommendation) PrintReport() {
 		for i := range r.Missing {
 			writeRule(tw, &r.Missing[i])
 		}
+		tw.Flush()
 	}
+	printViolations(r.Valid)
 }
 
 func writeRule(w io.Writer, r *Rule) {
@@ -107,27 +324,49 @@ func writeRule(w io.Writer, r *Rule) {
 		}
 		fmt.Fprint(buf, vm.Name)
 	}
+	for i, host := range r.Hosts {
+		if i == 0 {
+			fmt.Fprintf(buf, " on ")
+		} else {
+			fmt.Fprintf(buf, ", ")
+		}
+		fmt.Fprint(buf, host.Name)
+	}
 	fmt.Fprintf(w, "%s\t%s\n", r.Name, buf.String())
 }
 
 // RuleRecommendations looks at the state of the system and makes reccomendations
-// about how to achieve anti-affinity.
+// about how to achieve anti-affinity.  Each job, or group of jobs, with
+// more than one VM gets a rule named after it.  Jobs whose policies keep
+// them with other jobs also get an affinity rule for each pair of VMs,
+// and jobs pinned to some of the hosts get a VM/Host rule.
 func RuleRecommendations(s *State) *RuleRecommendation {
-	vmsForJob := make(map[string][]*VM)
-	for _, vm := range s.VMs {
-		vmsForJob[vm.Job] = append(vmsForJob[vm.Job], vm)
-	}
+	groups := s.groups()
 	expectedRules := make(map[string]Rule)
-	for job, vms := range vmsForJob {
-		if len(vms) <= 1 {
+	for name, g := range groups {
+		if len(g.VMs) <= 1 || g.Policy.Ignore {
 			continue
 		}
-		expectedRules[job] = Rule{
-			Name:      job,
+		expectedRules[name] = Rule{
+			Name:      name,
 			Enabled:   true,
-			Mandatory: true,
-			VMs:       vms,
+			Mandatory: g.Policy.Strength == RuleMandatory,
+			VMs:       g.VMs,
+		}
+	}
+	for name, r := range s.affinityRules() {
+		expectedRules[name] = r
+	}
+	for name, r := range s.hostRules() {
+		expectedRules[name] = r
+	}
+	// the strength of a rule is that of its job's policy, or the policy
+	// of the first job of an affinity or VM/Host rule
+	strength := func(r *Rule) string {
+		if r.Affinity || r.Hosts != nil {
+			return s.policy(r.VMs[0].Job).Strength
 		}
+		return groups[r.Name].Policy.Strength
 	}
 	result := &RuleRecommendation{}
 
@@ -135,10 +374,19 @@ func RuleRecommendations(s *State) *RuleRecommendation {
 
 	// identify each of our currently defined rules as valid or stale
 	for _, currentRule := range s.Rules {
+		if g, ok := groups[currentRule.Name]; ok && g.Policy.Ignore {
+			// leave the rules of ignored jobs alone
+			continue
+		}
+		if currentRule.Affinity && !isAffinityRuleName(currentRule.Name) ||
+			currentRule.Hosts != nil && !isHostRuleName(currentRule.Name) {
+			// leave affinity and VM/Host rules that we didn't make alone
+			continue
+		}
 		exp, exists := expectedRules[currentRule.Name]
 		if exists {
 			existingRules[currentRule.Name] = struct{}{}
-			if rulesEqual(currentRule, &exp) {
+			if rulesEqual(currentRule, &exp) && (strength(&exp) == "" || currentRule.Mandatory == exp.Mandatory) {
 				// we already have a rule that is equivalent to the expected rule -> VALID
 				result.Valid = append(result.Valid, *currentRule)
 			} else {
@@ -160,15 +408,63 @@ func RuleRecommendations(s *State) *RuleRecommendation {
 		result.Missing = append(result.Missing, expectedRule)
 	}
 
+	// expected rules come from a map, so sort them to keep
+	// the recommendations stable between runs
+	sort.Slice(result.Missing, func(i, j int) bool {
+		return result.Missing[i].Name < result.Missing[j].Name
+	})
 	return result
 }
 
+// Recommendations returns the changes that Check makes to s: all of
+// the RuleRecommendations if s is unbalanced, and otherwise only those
+// to affinity and VM/Host rules, leaving the anti-affinity rules,
+// including any that an operator made, alone.  It returns nil if there
+// are no changes to make.
+func Recommendations(s *State) *RuleRecommendation {
+	rec := RuleRecommendations(s)
+	if !IsBalanced(s) {
+		return rec
+	}
+	if rec = rec.pinning(); rec.Empty() {
+		return nil
+	}
+	return rec
+}
+
+// pinning returns the changes that r recommends to affinity and VM/Host
+// rules, treating the other stale rules as valid.
+func (r *RuleRecommendation) pinning() *RuleRecommendation {
+	p := &RuleRecommendation{Valid: append([]Rule(nil), r.Valid...)}
+	for _, rule := range r.Stale {
+		if rule.Affinity || rule.Hosts != nil {
+			p.Stale = append(p.Stale, rule)
+		} else {
+			p.Valid = append(p.Valid, rule)
+		}
+	}
+	for _, rule := range r.Missing {
+		if rule.Affinity || rule.Hosts != nil {
+			p.Missing = append(p.Missing, rule)
+		}
+	}
+	return p
+}
+
+// Empty reports whether r recommends no changes.
+func (r *RuleRecommendation) Empty() bool {
+	return len(r.Missing) == 0 && len(r.Stale) == 0
+}
+
 // rulesEqual determines if two rules are logically equivalent.
-// This means that the rules have the same name and consist of the
-// same VMs.  The ID of the rules or the ordering of their VMs do
-// not impact equivalence.
+// This means that the rules have the same name and type and consist of
+// the same VMs and hosts.  The ID of the rules or the ordering of their
+// VMs and hosts do not impact equivalence.
 func rulesEqual(r0, r1 *Rule) bool {
-	if r0.Name == r1.Name && len(r0.VMs) == len(r1.VMs) {
+	if !hostsEqual(r0.Hosts, r1.Hosts) {
+		return false
+	}
+	if r0.Name == r1.Name && r0.Affinity == r1.Affinity && len(r0.VMs) == len(r1.VMs) {
 		r1VMs := make(map[*VM]bool)
 		for _, vm := range r1.VMs {
 			r1VMs[vm] = true
@@ -184,21 +480,95 @@ func rulesEqual(r0, r1 *Rule) bool {
 	return false
 }
 
-type hostList []string
-
-func (h hostList) exceedsMax(hostCount int) bool {
-	totalJobs := len(h)
-	maxJobsPerHost := int(math.Ceil(float64(totalJobs) / float64(hostCount)))
+// hostsEqual reports whether h0 and h1 are the same hosts, by ID,
+// and both or neither are nil.
+func hostsEqual(h0, h1 []*Host) bool {
+	if (h0 == nil) != (h1 == nil) || len(h0) != len(h1) {
+		return false
+	}
+	ids := make(map[string]bool)
+	for _, h := range h0 {
+		ids[h.ID] = true
+	}
+	for _, h := range h1 {
+		if !ids[h.ID] {
+			return false
+		}
+	}
+	return true
+}
 
-	counts := make(map[string]int)
-	for _, host := range h {
-		counts[host] = counts[host] + 1
+// Colocated returns the member VMs of r that share a host with another
+// member, by host.  These are the VMs that violate an anti-affinity rule.
+// Affinity and VM/Host rules have no co-located members.
+func (r *Rule) Colocated() map[string][]*VM {
+	if r.Affinity || r.Hosts != nil {
+		return nil
+	}
+	byHost := make(map[string][]*VM)
+	names := make(map[string]string)
+	for _, vm := range r.VMs {
+		if vm == nil || vm.HostUUID == "" {
+			continue
+		}
+		byHost[vm.HostUUID] = append(byHost[vm.HostUUID], vm)
+		if vm.HostName != "" {
+			names[vm.HostUUID] = vm.HostName
+		}
 	}
+	colocated := make(map[string][]*VM)
+	for host, vms := range byHost {
+		if len(vms) < 2 {
+			continue
+		}
+		sort.Slice(vms, func(i, j int) bool { return vms[i].Name < vms[j].Name })
+		if name, ok := names[host]; ok {
+			host = name
+		}
+		colocated[host] = vms
+	}
+	return colocated
+}
 
-	for _, v := range counts {
-		if v > maxJobsPerHost {
-			return true
+// printViolations writes the violated rules among rules, and
+// their co-located members, to the output.
+func printViolations(rules []Rule) {
+	var violated []*Rule
+	for i := range rules {
+		if rules[i].Violated {
+			violated = append(violated, &rules[i])
 		}
 	}
-	return false
+	if len(violated) == 0 {
+		return
+	}
+	sort.Slice(violated, func(i, j int) bool { return violated[i].Name < violated[j].Name })
+	fmt.Fprintln(output, redSprintf("--VIOLATED--"))
+	tw := tabwriter.NewWriter(output, 8, 4, 1, ' ', 0)
+	defer tw.Flush()
+	for _, r := range violated {
+		colocated := r.Colocated()
+		hosts := make([]string, 0, len(colocated))
+		for host := range colocated {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		buf := &bytes.Buffer{}
+		for i, host := range hosts {
+			if i > 0 {
+				buf.WriteString("; ")
+			}
+			fmt.Fprintf(buf, "%s: ", host)
+			for j, vm := range colocated[host] {
+				if j > 0 {
+					buf.WriteString(", ")
+				}
+				buf.WriteString(vm.Name)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", r.Name, buf.String())
+	}
 }
+
+// hostList holds the host of each VM of a job.
+type hostList []string
@@ -26,7 +26,7 @@ var _ = Describe("State", func() {
 				gotState = true
 				return &magnet.State{}, nil
 			}
-			magnet.Check(context.Background(), i)
+			magnet.Check(context.Background(), i, nil)
 			Ω(gotState).Should(BeTrue())
 		})
 
@@ -35,7 +35,7 @@ var _ = Describe("State", func() {
 			i.StateFn = func(ctx context.Context) (*magnet.State, error) {
 				return nil, noState
 			}
-			err := magnet.Check(context.Background(), i)
+			err := magnet.Check(context.Background(), i, nil)
 			Ω(err).Should(Equal(noState))
 		})
 
@@ -63,7 +63,7 @@ var _ = Describe("State", func() {
 				return nil
 			}
 
-			Ω(magnet.Check(context.Background(), i)).Should(Succeed())
+			Ω(magnet.Check(context.Background(), i, nil)).Should(Succeed())
 			Ω(calledConverge).Should(BeTrue())
 		})
 
@@ -89,7 +89,69 @@ var _ = Describe("State", func() {
 				return errors.New("couldn't converge")
 			}
 
-			Ω(magnet.Check(context.Background(), i)).ShouldNot(Succeed())
+			Ω(magnet.Check(context.Background(), i, nil)).ShouldNot(Succeed())
+		})
+	})
+
+	Context("when Check()ing with a Notifier", func() {
+		var (
+			n      *mock.Notifier
+			events []*magnet.Event
+		)
+		BeforeEach(func() {
+			events = nil
+			n = &mock.Notifier{
+				NotifyFn: func(ctx context.Context, e *magnet.Event) error {
+					events = append(events, e)
+					return nil
+				},
+			}
+			i.StateFn = func(ctx context.Context) (*magnet.State, error) {
+				host1 := &magnet.Host{ID: "host1"}
+				host2 := &magnet.Host{ID: "host2"}
+				routerVM1 := &magnet.VM{Name: "router-1", Job: "router", HostUUID: host1.ID}
+				routerVM2 := &magnet.VM{Name: "router-2", Job: "router", HostUUID: host1.ID}
+				return &magnet.State{
+					Hosts: []*magnet.Host{host1, host2},
+					VMs:   []*magnet.VM{routerVM1, routerVM2},
+				}, nil
+			}
+		})
+
+		It("notifies of the imbalance and the convergence", func() {
+			c := &magnet.Checker{IaaS: i, Notifier: n}
+			Ω(c.Check(context.Background())).Should(Succeed())
+			Ω(events).Should(HaveLen(2))
+			Ω(events[0].Type).Should(Equal(magnet.EventUnbalanced))
+			Ω(events[0].Jobs).Should(Equal([]string{"router"}))
+			Ω(events[1].Type).Should(Equal(magnet.EventConverged))
+			Ω(events[1].Added).Should(Equal([]string{"router"}))
+		})
+
+		It("notifies when it can't converge", func() {
+			i.ConvergeFn = func(ctx context.Context, state *magnet.State, rec *magnet.RuleRecommendation) error {
+				return errors.New("couldn't converge")
+			}
+			c := &magnet.Checker{IaaS: i, Notifier: n}
+			Ω(c.Check(context.Background())).ShouldNot(Succeed())
+			Ω(events).Should(HaveLen(2))
+			Ω(events[1].Type).Should(Equal(magnet.EventConvergeFailed))
+			Ω(events[1].Error).Should(Equal("couldn't converge"))
+		})
+
+		It("doesn't fail the check when a notification fails", func() {
+			n.NotifyFn = func(ctx context.Context, e *magnet.Event) error {
+				return errors.New("no network")
+			}
+			c := &magnet.Checker{IaaS: i, Notifier: n}
+			Ω(c.Check(context.Background())).Should(Succeed())
+		})
+
+		It("doesn't notify when the deployment is balanced", func() {
+			i.StateFn = nil
+			c := &magnet.Checker{IaaS: i, Notifier: n}
+			Ω(c.Check(context.Background())).Should(Succeed())
+			Ω(events).Should(BeEmpty())
 		})
 	})
 
@@ -241,7 +303,7 @@ var _ = Describe("State", func() {
 			clockGlobalVM := &magnet.VM{Job: "clock_global", HostUUID: host1.ID}
 
 			validRule = &magnet.Rule{Name: "diego_cell", Enabled: true, Mandatory: true, VMs: []*magnet.VM{cellVM1, cellVM2}}
-			missingRule = &magnet.Rule{Name: "router", Enabled: true, Mandatory: true, VMs: []*magnet.VM{routerVM1, routerVM2}}
+			missingRule = &magnet.Rule{Name: "router", Enabled: true, VMs: []*magnet.VM{routerVM1, routerVM2}}
 			bogusRule = &magnet.Rule{Name: "bogus", Enabled: true, Mandatory: true, VMs: []*magnet.VM{routerVM1, clockGlobalVM}}
 
 			state := &magnet.State{
@@ -310,16 +372,14 @@ var _ = Describe("State", func() {
 
 		It("Identifies missing rules", func() {
 			router := magnet.Rule{
-				Name:      "router",
-				Enabled:   true,
-				Mandatory: true,
-				VMs:       []*magnet.VM{routerVM1, routerVM2},
+				Name:    "router",
+				Enabled: true,
+				VMs:     []*magnet.VM{routerVM1, routerVM2},
 			}
 			diegoCell := magnet.Rule{
-				Name:      "diego_cell",
-				Enabled:   true,
-				Mandatory: true,
-				VMs:       []*magnet.VM{cellVM1, cellVM2},
+				Name:    "diego_cell",
+				Enabled: true,
+				VMs:     []*magnet.VM{cellVM1, cellVM2},
 			}
 			Ω(recommendations.Missing).Should(ConsistOf(router, diegoCell))
 		})
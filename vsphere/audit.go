@@ -0,0 +1,28 @@
+package vsphere
+
+import (
+	"fmt"
+
+	"github.com/pivotalservices/magnet"
+)
+
+// auditEntries describes each rule change in rec made as user, if i has
+// an Auditor.
+func (i *IaaS) auditEntries(user string, state *magnet.State, rec *magnet.RuleRecommendation) []magnet.AuditEntry {
+	if i.Auditor == nil {
+		return nil
+	}
+	return magnet.AuditEntries(user, state, rec)
+}
+
+// audit records the outcome of a cluster reconfiguration.  It returns
+// convergeErr if non-nil, otherwise any error writing the audit log.
+func (i *IaaS) audit(log magnet.Logger, entries []magnet.AuditEntry, task string, convergeErr error) error {
+	if err := magnet.RecordAudit(i.Auditor, entries, task, convergeErr); err != nil {
+		log.Error("failed to write audit log", "err", err)
+		if convergeErr == nil {
+			return fmt.Errorf("vsphere: failed to write audit log: %v", err)
+		}
+	}
+	return convergeErr
+}
@@ -0,0 +1,457 @@
+package vsphere
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Snapshot is a copy of every rule in a cluster's configuration, along
+// with the VM and host groups that the rules refer to.
+type Snapshot struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Cluster string    `json:"cluster"` // cluster MoRef
+	Reason  string    `json:"reason"`
+	Rules   []typed   `json:"rules"`
+	Groups  []typed   `json:"groups"`
+
+	// Names maps the MoRef of every VM and host referenced by the
+	// rules and groups to its name, so that they can be found again
+	// after their MoRefs change (e.g. when restoring to a new vCenter).
+	Names map[string]string `json:"names"`
+
+	// ClusterName is the name of the cluster the snapshot was taken from.
+	ClusterName string `json:"cluster_name"`
+}
+
+// typed is a vSphere data object along with its type name,
+// so that it can be decoded as the correct type.
+type typed struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+func encodeTyped(v interface{}) (typed, error) {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	b, err := json.Marshal(v)
+	return typed{Type: t.Name(), Value: b}, err
+}
+
+func (t typed) decode() (interface{}, error) {
+	typ, ok := types.TypeFunc()(t.Type)
+	if !ok {
+		return nil, fmt.Errorf("vsphere: unknown type %q in snapshot", t.Type)
+	}
+	v := reflect.New(typ)
+	if err := json.Unmarshal(t.Value, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+func (s *Snapshot) rules() ([]types.BaseClusterRuleInfo, error) {
+	var result []types.BaseClusterRuleInfo
+	for _, t := range s.Rules {
+		v, err := t.decode()
+		if err != nil {
+			return nil, err
+		}
+		r, ok := v.(types.BaseClusterRuleInfo)
+		if !ok {
+			return nil, fmt.Errorf("vsphere: %s is not a rule", t.Type)
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func (s *Snapshot) groups() ([]types.BaseClusterGroupInfo, error) {
+	var result []types.BaseClusterGroupInfo
+	for _, t := range s.Groups {
+		v, err := t.decode()
+		if err != nil {
+			return nil, err
+		}
+		g, ok := v.(types.BaseClusterGroupInfo)
+		if !ok {
+			return nil, fmt.Errorf("vsphere: %s is not a group", t.Type)
+		}
+		result = append(result, g)
+	}
+	return result, nil
+}
+
+// ErrSnapshotNotFound is returned when a snapshot version does not exist.
+var ErrSnapshotNotFound = errors.New("vsphere: snapshot not found")
+
+// BackupStore keeps numbered snapshots of cluster rules in a local
+// directory, with one subdirectory per cluster name.  Snapshots are
+// never modified once written.
+type BackupStore struct {
+	Dir string
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func (b *BackupStore) clusterDir(cluster string) string {
+	return filepath.Join(b.Dir, unsafeChars.ReplaceAllString(strings.ToLower(cluster), "_"))
+}
+
+func (b *BackupStore) path(cluster string, version int) string {
+	return filepath.Join(b.clusterDir(cluster), fmt.Sprintf("%06d.json", version))
+}
+
+// Save stores s as the next version for its cluster and sets s.Version.
+func (b *BackupStore) Save(s *Snapshot) error {
+	dir := b.clusterDir(s.ClusterName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	versions, err := b.versions(s.ClusterName)
+	if err != nil {
+		return err
+	}
+	s.Version = 1
+	if len(versions) > 0 {
+		s.Version = versions[len(versions)-1] + 1
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	// O_EXCL ensures we never overwrite an existing version
+	f, err := os.OpenFile(b.path(s.ClusterName, s.Version), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (b *BackupStore) versions(cluster string) ([]int, error) {
+	matches, err := filepath.Glob(filepath.Join(b.clusterDir(cluster), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, m := range matches {
+		v, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// Get loads a single version of the snapshots of the named cluster.
+func (b *BackupStore) Get(cluster string, version int) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(b.path(cluster, version))
+	if os.IsNotExist(err) {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("vsphere: snapshot %d: %v", version, err)
+	}
+	return &s, nil
+}
+
+// History loads every snapshot of the named cluster, oldest first.
+func (b *BackupStore) History(cluster string) ([]*Snapshot, error) {
+	versions, err := b.versions(cluster)
+	if err != nil {
+		return nil, err
+	}
+	var result []*Snapshot
+	for _, v := range versions {
+		s, err := b.Get(cluster, v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// Backup snapshots the rules of the configured cluster into i.Backups.
+func (i *IaaS) Backup(ctx context.Context, reason string) (*Snapshot, error) {
+	if i.Backups == nil {
+		return nil, errors.New("vsphere: no backup store configured")
+	}
+	c, _, err := i.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, ref, cfg, err := i.clusterConfig(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return i.backup(ctx, c, ref, cfg, reason)
+}
+
+// clusterConfig finds the configured cluster and retrieves its
+// configuration, along with the rest of the inventory.
+func (i *IaaS) clusterConfig(ctx context.Context, c *govmomi.Client) (*collector, types.ManagedObjectReference, *types.ClusterConfigInfoEx, error) {
+	var ref types.ManagedObjectReference
+	collector, err := collect(ctx, c)
+	if err != nil {
+		return nil, ref, nil, err
+	}
+	cluster := collector.findCluster(i.config.Cluster)
+	if cluster == nil {
+		return nil, ref, nil, fmt.Errorf("vsphere: cannot find cluster %q", i.config.Cluster)
+	}
+	ref = cluster.Reference()
+	var mcluster mo.ClusterComputeResource
+	err = c.RetrieveOne(ctx, ref, []string{"configurationEx"}, &mcluster)
+	if err != nil {
+		return nil, ref, nil, err
+	}
+	cfg, ok := mcluster.ConfigurationEx.(*types.ClusterConfigInfoEx)
+	if !ok {
+		return nil, ref, nil, fmt.Errorf("vsphere: %s has no cluster configuration", ref)
+	}
+	return collector, ref, cfg, nil
+}
+
+// backup saves the rules and groups in cfg to i.Backups.
+func (i *IaaS) backup(ctx context.Context, c *govmomi.Client, ref types.ManagedObjectReference, cfg *types.ClusterConfigInfoEx, reason string) (*Snapshot, error) {
+	s := &Snapshot{
+		Time:        time.Now().UTC(),
+		Cluster:     ref.String(),
+		ClusterName: i.config.Cluster,
+		Reason:      reason,
+		Rules:       []typed{},
+		Groups:      []typed{},
+		Names:       make(map[string]string),
+	}
+
+	var refs []types.ManagedObjectReference
+	for _, r := range cfg.Rule {
+		t, err := encodeTyped(r)
+		if err != nil {
+			return nil, err
+		}
+		s.Rules = append(s.Rules, t)
+		refs = append(refs, ruleVMs(r)...)
+	}
+	for _, g := range cfg.Group {
+		t, err := encodeTyped(g)
+		if err != nil {
+			return nil, err
+		}
+		s.Groups = append(s.Groups, t)
+		refs = append(refs, groupMembers(g)...)
+	}
+
+	if len(refs) > 0 {
+		var entities []mo.ManagedEntity
+		err := c.PropertyCollector().Retrieve(ctx, refs, []string{"name"}, &entities)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entities {
+			s.Names[e.Self.String()] = e.Name
+		}
+	}
+
+	if err := i.Backups.Save(s); err != nil {
+		return nil, err
+	}
+	i.log.Info("backed up cluster rules", "cluster", s.Cluster, "version", s.Version, "rules", len(s.Rules), "groups", len(s.Groups))
+	return s, nil
+}
+
+func ruleVMs(r types.BaseClusterRuleInfo) []types.ManagedObjectReference {
+	switch r := r.(type) {
+	case *types.ClusterAffinityRuleSpec:
+		return r.Vm
+	case *types.ClusterAntiAffinityRuleSpec:
+		return r.Vm
+	}
+	return nil
+}
+
+func groupMembers(g types.BaseClusterGroupInfo) []types.ManagedObjectReference {
+	switch g := g.(type) {
+	case *types.ClusterVmGroup:
+		return g.Vm
+	case *types.ClusterHostGroup:
+		return g.Host
+	}
+	return nil
+}
+
+// Restore replaces every rule in the configured cluster with the rules
+// in s, and adds or updates the groups in s.  Groups that aren't in s
+// are left alone.  VMs and hosts whose MoRefs have changed since the
+// snapshot are found by name.  If i.Backups is set, the current rules
+// are backed up first.
+func (i *IaaS) Restore(ctx context.Context, s *Snapshot) error {
+	rules, err := s.rules()
+	if err != nil {
+		return err
+	}
+	groups, err := s.groups()
+	if err != nil {
+		return err
+	}
+
+	c, _, err := i.connect(ctx)
+	if err != nil {
+		return err
+	}
+	collector, ref, current, err := i.clusterConfig(ctx, c)
+	if err != nil {
+		return err
+	}
+	if i.Backups != nil {
+		if _, err = i.backup(ctx, c, ref, current, fmt.Sprintf("before restoring version %d", s.Version)); err != nil {
+			return err
+		}
+	}
+
+	m := newRemapper(s.Names, collector)
+
+	// groups first, since VM/host rules refer to them by name
+	existingGroups := make(map[string]bool)
+	for _, g := range current.Group {
+		existingGroups[g.GetClusterGroupInfo().Name] = true
+	}
+	var groupSpecs []types.ClusterGroupSpec
+	for _, g := range groups {
+		m.group(g)
+		spec := types.ClusterGroupSpec{Info: g}
+		spec.Operation = types.ArrayUpdateOperationAdd
+		if existingGroups[g.GetClusterGroupInfo().Name] {
+			spec.Operation = types.ArrayUpdateOperationEdit
+		}
+		groupSpecs = append(groupSpecs, spec)
+	}
+
+	var ruleSpecs []types.ClusterRuleSpec
+	for _, r := range current.Rule {
+		spec := types.ClusterRuleSpec{}
+		spec.Operation = types.ArrayUpdateOperationRemove
+		spec.RemoveKey = r.GetClusterRuleInfo().Key
+		ruleSpecs = append(ruleSpecs, spec)
+	}
+	for _, r := range rules {
+		m.rule(r)
+		info := r.GetClusterRuleInfo()
+		info.Key = 0
+		info.RuleUuid = ""
+		info.Status = ""
+		info.InCompliance = nil
+		spec := types.ClusterRuleSpec{Info: r}
+		spec.Operation = types.ArrayUpdateOperationAdd
+		ruleSpecs = append(ruleSpecs, spec)
+	}
+	if len(m.missing) > 0 {
+		return fmt.Errorf("vsphere: cannot restore version %d: cannot find %s", s.Version, strings.Join(m.missing, ", "))
+	}
+
+	log := i.log.With("cluster", ref.String(), "version", s.Version)
+	obj := object.NewClusterComputeResource(c.Client, ref)
+	for _, spec := range []*types.ClusterConfigSpecEx{
+		{GroupSpec: groupSpecs},
+		{RulesSpec: ruleSpecs},
+	} {
+		if len(spec.GroupSpec) == 0 && len(spec.RulesSpec) == 0 {
+			continue
+		}
+		task, err := obj.Reconfigure(ctx, spec, true)
+		if err != nil {
+			return err
+		}
+		log.Info("waiting for cluster reconfig", "task", task.Reference().Value)
+		if err = task.Wait(ctx); err != nil {
+			log.Error("cluster reconfig failed", "task", task.Reference().Value, "err", err)
+			return err
+		}
+	}
+	log.Info("restored cluster rules", "rules", len(rules), "groups", len(groups))
+	return nil
+}
+
+// remapper updates the VM and host MoRefs in rules and groups
+// to match the current inventory.
+type remapper struct {
+	names   map[string]string // snapshot MoRef -> name
+	current map[string]string // current MoRef -> name
+	byName  map[string]types.ManagedObjectReference
+	missing []string
+}
+
+func newRemapper(names map[string]string, c *collector) *remapper {
+	m := &remapper{
+		names:   names,
+		current: make(map[string]string),
+		byName:  make(map[string]types.ManagedObjectReference),
+	}
+	for _, vm := range c.vms {
+		m.add(vm.Self, vm.Name)
+	}
+	for _, h := range c.hosts {
+		m.add(h.Self, h.Name)
+	}
+	return m
+}
+
+func (m *remapper) add(ref types.ManagedObjectReference, name string) {
+	m.current[ref.String()] = name
+	m.byName[ref.Type+"/"+name] = ref
+}
+
+func (m *remapper) refs(refs []types.ManagedObjectReference) {
+	for j, ref := range refs {
+		name, known := m.names[ref.String()]
+		if current, ok := m.current[ref.String()]; ok && (!known || current == name) {
+			continue
+		}
+		if newRef, ok := m.byName[ref.Type+"/"+name]; known && ok {
+			refs[j] = newRef
+			continue
+		}
+		if !known {
+			name = ref.String()
+		}
+		m.missing = append(m.missing, name)
+	}
+}
+
+func (m *remapper) rule(r types.BaseClusterRuleInfo) {
+	m.refs(ruleVMs(r))
+}
+
+func (m *remapper) group(g types.BaseClusterGroupInfo) {
+	m.refs(groupMembers(g))
+}
@@ -0,0 +1,63 @@
+package vsphere_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pivotalservices/magnet/vsphere"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BackupStore", func() {
+	var (
+		dir   string
+		store *vsphere.BackupStore
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "magnet-backups")
+		Ω(err).ShouldNot(HaveOccurred())
+		store = &vsphere.BackupStore{Dir: dir}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("numbers snapshots per cluster", func() {
+		for _, cluster := range []string{"Cluster", "Cluster", "Other Cluster"} {
+			Ω(store.Save(&vsphere.Snapshot{ClusterName: cluster, Reason: "manual"})).Should(Succeed())
+		}
+
+		history, err := store.History("Cluster")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(history).Should(HaveLen(2))
+		Ω(history[0].Version).Should(Equal(1))
+		Ω(history[1].Version).Should(Equal(2))
+
+		history, err = store.History("Other Cluster")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(history).Should(HaveLen(1))
+		Ω(history[0].Version).Should(Equal(1))
+	})
+
+	It("treats cluster names case-insensitively, like vSphere", func() {
+		Ω(store.Save(&vsphere.Snapshot{ClusterName: "Cluster"})).Should(Succeed())
+		s, err := store.Get("CLUSTER", 1)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s.ClusterName).Should(Equal("Cluster"))
+	})
+
+	It("returns ErrSnapshotNotFound for missing versions", func() {
+		_, err := store.Get("Cluster", 7)
+		Ω(err).Should(Equal(vsphere.ErrSnapshotNotFound))
+	})
+
+	It("keeps cluster names from escaping the store", func() {
+		Ω(store.Save(&vsphere.Snapshot{ClusterName: "../../etc"})).Should(Succeed())
+		entries, err := ioutil.ReadDir(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(HaveLen(1))
+	})
+})
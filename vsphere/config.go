@@ -1,19 +1,191 @@
 package vsphere
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
 
-type vsphereconfig struct {
-	Scheme       string `default:"https"`
-	Hostname     string `required:"true"`
-	Port         string `default:"443"`
-	Username     string `required:"true"`
-	Password     string `required:"true"`
-	Insecure     bool   `default:"false"`
-	Cluster      string `required:"true"`
-	ResourcePool string `default:""`
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/credentials"
+)
+
+// Config describes a vCenter and the cluster that magnet manages.
+type Config struct {
+	Scheme       string        `yaml:"scheme"`
+	Hostname     string        `yaml:"hostname"`
+	Port         string        `yaml:"port"`
+	Username     string        `yaml:"username"`
+	Password     magnet.Secret `yaml:"password"`
+	Insecure     bool          `yaml:"insecure"`
+	CACerts      string        `yaml:"cacerts"`    // path of a PEM bundle of CAs to trust
+	Thumbprint   string        `yaml:"thumbprint"` // SHA-1 or SHA-256 certificate thumbprint to pin
+	Cluster      string        `yaml:"cluster"`
+	ResourcePool string        `yaml:"resourcepool"`
+
+	// Credentials, if set, supplies the password (and optionally the
+	// username) each time magnet logs in, instead of Password.
+	Credentials *credentials.Config `yaml:"credentials"`
+
+	// passwordFromEnv is true if VSPHERE_PASSWORD set Password, in
+	// which case it is re-read each time magnet logs in.
+	passwordFromEnv bool
+}
+
+// ApplyEnv overrides c with the VSPHERE_* environment variables
+// that are set (see New).
+func (c *Config) ApplyEnv() error {
+	for name, field := range map[string]*string{
+		"VSPHERE_SCHEME":       &c.Scheme,
+		"VSPHERE_HOSTNAME":     &c.Hostname,
+		"VSPHERE_PORT":         &c.Port,
+		"VSPHERE_USERNAME":     &c.Username,
+		"VSPHERE_PASSWORD":     (*string)(&c.Password),
+		"VSPHERE_CLUSTER":      &c.Cluster,
+		"VSPHERE_RESOURCEPOOL": &c.ResourcePool,
+		"VSPHERE_CACERTS":      &c.CACerts,
+		"VSPHERE_THUMBPRINT":   &c.Thumbprint,
+	} {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+	_, c.passwordFromEnv = os.LookupEnv("VSPHERE_PASSWORD")
+	if err := c.applyCredentialsEnv(); err != nil {
+		return err
+	}
+	if v, ok := os.LookupEnv("VSPHERE_INSECURE"); ok {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("VSPHERE_INSECURE: invalid boolean %q", v)
+		}
+		c.Insecure = insecure
+	}
+	return nil
+}
+
+// applyCredentialsEnv replaces the credential source with the one set
+// by an environment variable, if any.  The CredHub or Vault settings of
+// the current source are kept if the variable selects the same store.
+func (c *Config) applyCredentialsEnv() error {
+	var set []string
+	for _, name := range []string{"VSPHERE_PASSWORD_FILE", "VSPHERE_CREDENTIALS_COMMAND", "VSPHERE_CREDHUB_NAME", "VSPHERE_VAULT_PATH"} {
+		if _, ok := os.LookupEnv(name); ok {
+			set = append(set, name)
+		}
+	}
+	switch len(set) {
+	case 0:
+		return nil
+	case 1:
+	default:
+		return fmt.Errorf("only one of %s may be set", strings.Join(set, ", "))
+	}
+
+	old := c.Credentials
+	if old == nil {
+		old = &credentials.Config{}
+	}
+	v := os.Getenv(set[0])
+	creds := &credentials.Config{}
+	switch set[0] {
+	case "VSPHERE_PASSWORD_FILE":
+		creds.File = v
+	case "VSPHERE_CREDENTIALS_COMMAND":
+		creds.Exec = strings.Fields(v)
+	case "VSPHERE_CREDHUB_NAME":
+		creds.CredHub = &credentials.CredHub{}
+		if old.CredHub != nil {
+			*creds.CredHub = *old.CredHub
+		}
+		creds.CredHub.Name = v
+	case "VSPHERE_VAULT_PATH":
+		creds.Vault = &credentials.Vault{}
+		if old.Vault != nil {
+			*creds.Vault = *old.Vault
+		}
+		creds.Vault.Path = v
+	}
+	c.Credentials = creds
+	return nil
+}
+
+// setDefaults fills in the optional settings that aren't set.
+func (c *Config) setDefaults() {
+	if c.Scheme == "" {
+		c.Scheme = "https"
+	}
+	if c.Port == "" {
+		c.Port = "443"
+	}
+}
+
+// Validate returns every problem with c.
+func (c Config) Validate() []error {
+	c.setDefaults()
+	var errs []error
+	if c.Scheme != "http" && c.Scheme != "https" {
+		errs = append(errs, fmt.Errorf("scheme must be http or https, not %q", c.Scheme))
+	}
+	if n, err := strconv.Atoi(c.Port); err != nil || n <= 0 || n > 65535 {
+		errs = append(errs, fmt.Errorf("invalid port %q", c.Port))
+	}
+	if c.Insecure && (c.CACerts != "" || c.Thumbprint != "") {
+		errs = append(errs, errors.New("insecure can't be combined with cacerts or thumbprint"))
+	}
+	if c.CACerts != "" {
+		if _, err := loadCACerts(c.CACerts); err != nil {
+			errs = append(errs, fmt.Errorf("cacerts: %v", err))
+		}
+	}
+	if c.Thumbprint != "" {
+		if _, err := parseThumbprint(c.Thumbprint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, required := range []struct{ name, value string }{
+		{"hostname", c.Hostname},
+		{"cluster", c.Cluster},
+	} {
+		if required.value == "" {
+			errs = append(errs, errors.New(required.name+" is required"))
+		}
+	}
+	if c.Credentials != nil {
+		for _, err := range c.Credentials.Validate() {
+			errs = append(errs, fmt.Errorf("credentials: %v", err))
+		}
+		return errs
+	}
+	if c.Username == "" {
+		errs = append(errs, errors.New("username is required"))
+	}
+	if c.Password == "" {
+		errs = append(errs, errors.New("password is required"))
+	}
+	return errs
+}
+
+// Unverified reports whether magnet connects to the vCenter without
+// verifying its identity, because Insecure is set or the scheme is http.
+func (c Config) Unverified() bool {
+	c.setDefaults()
+	return c.Insecure || c.Scheme == "http"
+}
+
+// provider returns the source of the credentials for the vCenter.
+func (c *Config) provider() (magnet.CredentialProvider, error) {
+	if c.Credentials != nil {
+		return c.Credentials.Provider(c.Username)
+	}
+	if c.passwordFromEnv {
+		return &credentials.Env{UsernameVar: "VSPHERE_USERNAME", PasswordVar: "VSPHERE_PASSWORD", Username: c.Username}, nil
+	}
+	return magnet.StaticCredentials{Username: c.Username, Password: c.Password}, nil
 }
 
-func (c *vsphereconfig) hostAndPort() string {
+func (c *Config) hostAndPort() string {
 	if c.Scheme == "http" && c.Port != "80" {
 		return fmt.Sprintf("%s:%s", c.Hostname, c.Port)
 	}
@@ -0,0 +1,104 @@
+package vsphere_test
+
+import (
+	"context"
+	"os"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/pivotalservices/magnet/credentials"
+	"github.com/pivotalservices/magnet/vsphere"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	var saved map[string]string
+	BeforeEach(func() {
+		saved = make(map[string]string)
+		for _, name := range []string{"VSPHERE_HOSTNAME", "VSPHERE_PASSWORD", "VSPHERE_INSECURE", "VSPHERE_CLUSTER", "VSPHERE_PASSWORD_FILE", "VSPHERE_VAULT_PATH"} {
+			if v, ok := os.LookupEnv(name); ok {
+				saved[name] = v
+			}
+			os.Unsetenv(name)
+		}
+	})
+	AfterEach(func() {
+		for _, name := range []string{"VSPHERE_HOSTNAME", "VSPHERE_PASSWORD", "VSPHERE_INSECURE", "VSPHERE_CLUSTER", "VSPHERE_PASSWORD_FILE", "VSPHERE_VAULT_PATH"} {
+			os.Unsetenv(name)
+			if v, ok := saved[name]; ok {
+				os.Setenv(name, v)
+			}
+		}
+	})
+
+	It("reports every missing or invalid setting", func() {
+		c := vsphere.Config{Scheme: "ftp", Port: "http", Hostname: "vcenter"}
+		Ω(c.Validate()).Should(HaveLen(5))
+	})
+
+	It("defaults the scheme and port", func() {
+		c := vsphere.Config{Hostname: "vcenter", Username: "u", Password: "p", Cluster: "c"}
+		Ω(c.Validate()).Should(BeEmpty())
+	})
+
+	It("is overridden by the environment variables that are set", func() {
+		os.Setenv("VSPHERE_PASSWORD", "from-env")
+		os.Setenv("VSPHERE_INSECURE", "true")
+		c := vsphere.Config{Hostname: "from-file", Password: "from-file"}
+		Ω(c.ApplyEnv()).Should(Succeed())
+		Ω(c.Hostname).Should(Equal("from-file"))
+		Ω(c.Password).Should(Equal(magnet.Secret("from-env")))
+		Ω(c.Insecure).Should(BeTrue())
+	})
+
+	It("re-reads a password from the environment each time it logs in", func() {
+		os.Setenv("VSPHERE_PASSWORD", "first")
+		c := vsphere.Config{Hostname: "vcenter", Username: "magnet", Cluster: "c"}
+		Ω(c.ApplyEnv()).Should(Succeed())
+		i, err := vsphere.NewFromConfig(c, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		os.Setenv("VSPHERE_PASSWORD", "second")
+		creds, err := i.Credentials.Credentials(context.Background())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(creds).Should(Equal(magnet.Credentials{Username: "magnet", Password: "second"}))
+	})
+
+	It("doesn't require a password when a credential source is set", func() {
+		c := vsphere.Config{Hostname: "vcenter", Cluster: "c", Credentials: &credentials.Config{File: "password"}}
+		Ω(c.Validate()).Should(BeEmpty())
+	})
+
+	It("reports problems with the credential source", func() {
+		c := vsphere.Config{Hostname: "vcenter", Cluster: "c", Credentials: &credentials.Config{}}
+		Ω(c.Validate()).Should(HaveLen(1))
+	})
+
+	It("reads the credential source from the environment", func() {
+		os.Setenv("VSPHERE_PASSWORD_FILE", "/run/secrets/vcenter")
+		var c vsphere.Config
+		Ω(c.ApplyEnv()).Should(Succeed())
+		Ω(c.Credentials).Should(Equal(&credentials.Config{File: "/run/secrets/vcenter"}))
+	})
+
+	It("keeps the settings of the credential store from the file", func() {
+		os.Setenv("VSPHERE_VAULT_PATH", "secret/data/east")
+		c := vsphere.Config{Credentials: &credentials.Config{Vault: &credentials.Vault{URL: "https://vault", Path: "secret/data/magnet"}}}
+		Ω(c.ApplyEnv()).Should(Succeed())
+		Ω(c.Credentials).Should(Equal(&credentials.Config{Vault: &credentials.Vault{URL: "https://vault", Path: "secret/data/east"}}))
+	})
+
+	It("rejects more than one credential source", func() {
+		os.Setenv("VSPHERE_PASSWORD_FILE", "/run/secrets/vcenter")
+		os.Setenv("VSPHERE_VAULT_PATH", "secret/data/magnet")
+		var c vsphere.Config
+		Ω(c.ApplyEnv()).Should(MatchError("only one of VSPHERE_PASSWORD_FILE, VSPHERE_VAULT_PATH may be set"))
+	})
+
+	It("rejects an invalid boolean", func() {
+		os.Setenv("VSPHERE_INSECURE", "maybe")
+		var c vsphere.Config
+		Ω(c.ApplyEnv()).ShouldNot(Succeed())
+	})
+})
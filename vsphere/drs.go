@@ -0,0 +1,153 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// DefaultMigrationTimeout is how long Converge waits for the migrations
+// of applied DRS recommendations when MigrationTimeout is zero.
+const DefaultMigrationTimeout = 10 * time.Minute
+
+// migrationPollInterval is how often the hosts of migrating VMs are checked.
+const migrationPollInterval = 5 * time.Second
+
+// migration is a VM being moved to another host by DRS.
+type migration struct {
+	vm, destination types.ManagedObjectReference
+}
+
+// applyRecommendations asks DRS to refresh the cluster's recommendations,
+// applies those that move members of rules to fix violations of
+// anti-affinity, affinity or VM/Host rules, and waits for the resulting
+// migrations.  In partially automated or manual clusters, DRS recommends
+// these migrations, but doesn't make them.
+func (i *IaaS) applyRecommendations(ctx context.Context, c *govmomi.Client, ref types.ManagedObjectReference, rules []magnet.Rule, log magnet.Logger) error {
+	members := make(map[string]string)
+	for _, r := range rules {
+		for _, vm := range r.VMs {
+			if vm != nil {
+				members[vm.Reference] = vm.Name
+			}
+		}
+	}
+
+	if _, err := methods.RefreshRecommendation(ctx, c.Client, &types.RefreshRecommendation{This: ref}); err != nil {
+		return err
+	}
+	var mcluster mo.ClusterComputeResource
+	if err := c.RetrieveOne(ctx, ref, []string{"recommendation"}, &mcluster); err != nil {
+		return err
+	}
+
+	var migrations []migration
+	for _, r := range mcluster.Recommendation {
+		switch types.RecommendationReasonCode(r.Reason) {
+		case types.RecommendationReasonCodeAntiAffin, types.RecommendationReasonCodeJointAffin,
+			types.RecommendationReasonCodeVmHostHardAffinity, types.RecommendationReasonCodeVmHostSoftAffinity:
+		default:
+			continue
+		}
+		moves, ok := memberMigrations(r, members)
+		if !ok {
+			log.Debug("skipping DRS recommendation", "key", r.Key, "reason", r.ReasonText)
+			continue
+		}
+		if _, err := methods.ApplyRecommendation(ctx, c.Client, &types.ApplyRecommendation{This: ref, Key: r.Key}); err != nil {
+			log.Error("failed to apply DRS recommendation", "key", r.Key, "err", err)
+			return err
+		}
+		names := make([]string, len(moves))
+		for j := range moves {
+			names[j] = members[moves[j].vm.Value]
+		}
+		log.Info("applied DRS recommendation", "key", r.Key, "reason", r.ReasonText, "vms", strings.Join(names, ","))
+		migrations = append(migrations, moves...)
+	}
+	if len(migrations) == 0 {
+		log.Debug("no DRS recommendations to apply")
+		return nil
+	}
+	return i.waitForMigrations(ctx, c, migrations, log)
+}
+
+// memberMigrations returns the migrations recommended by r, and whether
+// they all move members of magnet's rules.  Recommendations with other
+// actions, such as powering on hosts, are left to the administrator.
+func memberMigrations(r types.ClusterRecommendation, members map[string]string) ([]migration, bool) {
+	var moves []migration
+	for _, a := range r.Action {
+		m, ok := a.(*types.ClusterMigrationAction)
+		if !ok || m.DrsMigration == nil {
+			return nil, false
+		}
+		if _, ok = members[m.DrsMigration.Vm.Value]; !ok {
+			return nil, false
+		}
+		moves = append(moves, migration{vm: m.DrsMigration.Vm, destination: m.DrsMigration.Destination})
+	}
+	return moves, len(moves) > 0
+}
+
+// MigrationBudget makes the IaaS a magnet.Migrator.  It returns how long
+// Converge may wait for migrations, which is zero unless
+// ApplyRecommendations is set.
+func (i *IaaS) MigrationBudget() time.Duration {
+	if !i.ApplyRecommendations {
+		return 0
+	}
+	if i.MigrationTimeout <= 0 {
+		return DefaultMigrationTimeout
+	}
+	return i.MigrationTimeout
+}
+
+// waitForMigrations waits until each VM runs on its destination host,
+// for up to MigrationTimeout.
+func (i *IaaS) waitForMigrations(ctx context.Context, c *govmomi.Client, migrations []migration, log magnet.Logger) error {
+	timeout := i.MigrationBudget()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	refs := make([]types.ManagedObjectReference, len(migrations))
+	for j := range migrations {
+		refs[j] = migrations[j].vm
+	}
+	log.Info("waiting for migrations", "vms", len(migrations))
+	for {
+		var vms []mo.VirtualMachine
+		if err := c.Retrieve(ctx, refs, []string{"runtime.host"}, &vms); err != nil {
+			return err
+		}
+		hosts := make(map[string]string)
+		for _, vm := range vms {
+			if vm.Runtime.Host != nil {
+				hosts[vm.Self.Value] = vm.Runtime.Host.Value
+			}
+		}
+		pending := 0
+		for _, m := range migrations {
+			if hosts[m.vm.Value] != m.destination.Value {
+				pending++
+			}
+		}
+		if pending == 0 {
+			log.Info("migrations completed", "vms", len(migrations))
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("vsphere: %d of %d migrations didn't complete within %s", pending, len(migrations), timeout)
+		case <-time.After(migrationPollInterval):
+		}
+	}
+}
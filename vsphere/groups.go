@@ -0,0 +1,110 @@
+package vsphere
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pivotalservices/magnet"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vmHostGroupNames returns the names of the VM group and host group
+// of the VM/Host rule named rule, such as router@vms and router@hosts
+// for router@hosts.
+func vmHostGroupNames(rule string) (vms, hosts string) {
+	job := strings.TrimSuffix(rule, "@hosts")
+	return job + "@vms", job + "@hosts"
+}
+
+// vmHostRuleSpec returns the spec of a VM/Host rule that runs the
+// members of its VM group on the hosts of its host group.
+func vmHostRuleSpec(r *magnet.Rule) *types.ClusterVmHostRuleInfo {
+	vms, hosts := vmHostGroupNames(r.Name)
+	return &types.ClusterVmHostRuleInfo{VmGroupName: vms, AffineHostGroupName: hosts}
+}
+
+// addGroupSpecs adds or updates the groups of the VM/Host rules
+// in rec.Missing.  existing holds the names of the cluster's groups.
+func addGroupSpecs(rec *magnet.RuleRecommendation, existing map[string]bool) []types.ClusterGroupSpec {
+	var specs []types.ClusterGroupSpec
+	for _, r := range rec.Missing {
+		if r.Hosts == nil {
+			continue
+		}
+		vms, hosts := vmHostGroupNames(r.Name)
+		vmGroup := &types.ClusterVmGroup{Vm: vmRefs(r.VMs)}
+		vmGroup.Name = vms
+		hostGroup := &types.ClusterHostGroup{Host: hostRefs(r.Hosts)}
+		hostGroup.Name = hosts
+		for _, g := range []types.BaseClusterGroupInfo{vmGroup, hostGroup} {
+			spec := types.ClusterGroupSpec{Info: g}
+			spec.Operation = types.ArrayUpdateOperationAdd
+			if existing[g.GetClusterGroupInfo().Name] {
+				spec.Operation = types.ArrayUpdateOperationEdit
+			}
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// removeGroupSpecs removes the groups of the VM/Host rules in
+// rec.Stale that aren't being replaced.
+func removeGroupSpecs(rec *magnet.RuleRecommendation, existing map[string]bool) []types.ClusterGroupSpec {
+	replaced := make(map[string]bool)
+	for _, r := range rec.Missing {
+		replaced[r.Name] = true
+	}
+	var specs []types.ClusterGroupSpec
+	for _, r := range rec.Stale {
+		if r.Hosts == nil || replaced[r.Name] {
+			continue
+		}
+		vms, hosts := vmHostGroupNames(r.Name)
+		for _, name := range []string{vms, hosts} {
+			if !existing[name] {
+				continue
+			}
+			spec := types.ClusterGroupSpec{}
+			spec.Operation = types.ArrayUpdateOperationRemove
+			spec.RemoveKey = name
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// reconfigureGroups applies specs to the cluster, and waits for it.
+func reconfigureGroups(ctx context.Context, cluster *object.ClusterComputeResource, specs []types.ClusterGroupSpec, log magnet.Logger) error {
+	if len(specs) == 0 {
+		return nil
+	}
+	task, err := cluster.Reconfigure(ctx, &types.ClusterConfigSpecEx{GroupSpec: specs}, true)
+	if err != nil {
+		return err
+	}
+	taskID := task.Reference().Value
+	log.Info("waiting for cluster group reconfig", "task", taskID, "groups", len(specs))
+	if err = task.Wait(ctx); err != nil {
+		log.Error("cluster group reconfig failed", "task", taskID, "err", err)
+		return err
+	}
+	return nil
+}
+
+func vmRefs(vms []*magnet.VM) []types.ManagedObjectReference {
+	refs := make([]types.ManagedObjectReference, len(vms))
+	for i := range vms {
+		refs[i].FromString("VirtualMachine:" + vms[i].Reference)
+	}
+	return refs
+}
+
+func hostRefs(hosts []*magnet.Host) []types.ManagedObjectReference {
+	refs := make([]types.ManagedObjectReference, len(hosts))
+	for i := range hosts {
+		refs[i].FromString(hosts[i].ID)
+	}
+	return refs
+}
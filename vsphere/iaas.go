@@ -2,27 +2,65 @@ package vsphere
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"time"
 
-	"github.com/kelseyhightower/envconfig"
 	"github.com/pivotalservices/magnet"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 )
 
 // IaaS is the vSphere implementation of IaaS.
 type IaaS struct {
-	URL    *url.URL
-	config *vsphereconfig
+	// URL is the vCenter's SDK endpoint.  It doesn't include credentials.
+	URL *url.URL
+
+	// Credentials supplies the username and password each
+	// time the IaaS logs in to the vCenter.
+	Credentials magnet.CredentialProvider
+
+	// Auditor, if non-nil, records every rule change made by Converge.
+	Auditor magnet.Auditor
+
+	// Backups, if non-nil, stores a snapshot of the cluster's
+	// rules before every change made by Converge.
+	Backups *BackupStore
+
+	// ApplyRecommendations, if true, makes Converge apply the DRS
+	// recommendations that fix violations of magnet's rules once it has
+	// changed them, and wait up to MigrationTimeout (or, if zero,
+	// DefaultMigrationTimeout) for the resulting migrations.  This is only
+	// needed in clusters where DRS isn't fully automated.
+	ApplyRecommendations bool
+	MigrationTimeout     time.Duration
+
+	// Instances, if non-nil, identifies the job, index, deployment and
+	// AZ of each VM, which is joined to its instance by name (the VM
+	// CID).  VMs it doesn't describe are identified by their custom
+	// attributes, as are all VMs if it fails.
+	Instances magnet.InstanceSource
+
+	config *Config
+	log    magnet.Logger
+
+	// the CAs to verify the vCenter's certificate with (nil
+	// for the system's), and the pinned thumbprint, if any
+	roots      *x509.CertPool
+	thumbprint []byte
 }
 
 // ErrNoDRS is the error returned when magnet cannot execute because DRS is not enabled.
@@ -36,33 +74,71 @@ var ErrNoDRS = errors.New("vsphere: DRS is not enabled.  please enable DRS and t
 //   - VSPHERE_USERNAME      (required)
 //   - VSPHERE_PASSWORD      (required)
 //   - VSPHERE_INSECURE      (default false)
+//   - VSPHERE_CACERTS       (default "", the system's CAs)
+//   - VSPHERE_THUMBPRINT    (default "")
 //   - VSPHERE_CLUSTER       (required)
 //   - VSPHERE_RESOURCEPOOL  (default "")
-func New() (magnet.IaaS, error) {
-	var config vsphereconfig
-	err := envconfig.Process("vsphere", &config)
-	if err != nil {
+//
+// If l is nil, nothing is logged.
+func New(l magnet.Logger) (*IaaS, error) {
+	var config Config
+	if err := config.ApplyEnv(); err != nil {
 		return nil, err
 	}
+	return NewFromConfig(config, l)
+}
 
-	uri := fmt.Sprintf("%s://%s:%s@%s/sdk", config.Scheme, url.QueryEscape(config.Username), url.QueryEscape(config.Password), config.hostAndPort())
-	parsed, err := url.Parse(uri)
+// NewFromConfig creates an IaaS that connects to the vCenter described
+// by config.  If l is nil, nothing is logged.
+func NewFromConfig(config Config, l magnet.Logger) (*IaaS, error) {
+	if l == nil {
+		l = magnet.NopLogger()
+	}
+	if errs := config.Validate(); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return nil, fmt.Errorf("vsphere: %s", strings.Join(msgs, "; "))
+	}
+	config.setDefaults()
+
+	parsed, err := url.Parse(fmt.Sprintf("%s://%s/sdk", config.Scheme, config.hostAndPort()))
 	if err != nil {
 		return nil, err
 	}
-	i := &IaaS{URL: parsed, config: &config}
+	provider, err := config.provider()
+	if err != nil {
+		return nil, err
+	}
+	i := &IaaS{URL: parsed, Credentials: provider, config: &config, log: l.With("vcenter", config.hostAndPort())}
+	if config.CACerts != "" {
+		if i.roots, err = loadCACerts(config.CACerts); err != nil {
+			return nil, fmt.Errorf("vsphere: %v", err)
+		}
+	}
+	if config.Thumbprint != "" {
+		if i.thumbprint, err = parseThumbprint(config.Thumbprint); err != nil {
+			return nil, fmt.Errorf("vsphere: %v", err)
+		}
+	}
+	if config.Unverified() {
+		i.log.Warn("the vCenter's certificate will not be verified")
+	}
 	return i, nil
 }
 
+// ClusterName is the name of the cluster that magnet manages.
+func (i *IaaS) ClusterName() string {
+	return i.config.Cluster
+}
+
 // Converge applies the specified reccomendations in order to achieve anti-affinity.
 func (i *IaaS) Converge(ctx context.Context, state *magnet.State, rec *magnet.RuleRecommendation) error {
-	c, err := govmomi.NewClient(ctx, i.URL, i.config.Insecure)
+	c, user, err := i.connect(ctx)
 	if err != nil {
 		return err
 	}
-	if !c.IsVC() {
-		return fmt.Errorf("%s is not a vCenter", i.config.hostAndPort())
-	}
 
 	clusterRef := &types.ManagedObjectReference{}
 	clusterRef.FromString(state.RuleContainer)
@@ -74,23 +150,42 @@ func (i *IaaS) Converge(ctx context.Context, state *magnet.State, rec *magnet.Ru
 	if e := mcluster.Configuration.DrsConfig.Enabled; e == nil || *e == false {
 		return ErrNoDRS
 	}
+	log := i.log.With("cluster", state.RuleContainer)
+
+	cfg, _ := mcluster.ConfigurationEx.(*types.ClusterConfigInfoEx)
+	if i.Backups != nil {
+		if cfg == nil {
+			return fmt.Errorf("vsphere: %s has no cluster configuration", clusterRef)
+		}
+		// don't change anything we can't undo
+		if _, err = i.backup(ctx, c, *clusterRef, cfg, "converge"); err != nil {
+			log.Error("failed to back up cluster rules", "err", err)
+			return err
+		}
+	}
 
 	// add missing rules
 	var ruleSpecs []types.ClusterRuleSpec
-	for _, r := range rec.Missing {
-		vmRefs := make([]types.ManagedObjectReference, len(r.VMs))
-		for i := range r.VMs {
-			vmRefs[i].FromString("VirtualMachine:" + r.VMs[i].Reference)
-		}
-		aaRule := &types.ClusterAntiAffinityRuleSpec{}
-		aaRule.Name = r.Name
-		aaRule.Mandatory = boolPtr(false)
-		aaRule.Enabled = boolPtr(true)
-		aaRule.Vm = vmRefs
+	for j := range rec.Missing {
+		r := &rec.Missing[j]
+		var info types.BaseClusterRuleInfo
+		switch {
+		case r.Hosts != nil:
+			info = vmHostRuleSpec(r)
+		case r.Affinity:
+			info = &types.ClusterAffinityRuleSpec{Vm: vmRefs(r.VMs)}
+		default:
+			info = &types.ClusterAntiAffinityRuleSpec{Vm: vmRefs(r.VMs)}
+		}
+		ruleInfo := info.GetClusterRuleInfo()
+		ruleInfo.Name = r.Name
+		ruleInfo.Mandatory = boolPtr(r.Mandatory)
+		ruleInfo.Enabled = boolPtr(true)
 		spec := types.ClusterRuleSpec{}
 		spec.Operation = types.ArrayUpdateOperationAdd
-		spec.Info = aaRule
+		spec.Info = info
 		ruleSpecs = append(ruleSpecs, spec)
+		log.Info("adding rule", "rule", r.Name, "vms", vmNames(r.VMs))
 	}
 
 	// remove stale rules
@@ -99,46 +194,152 @@ func (i *IaaS) Converge(ctx context.Context, state *magnet.State, rec *magnet.Ru
 		spec.Operation = types.ArrayUpdateOperationRemove
 		spec.RemoveKey = r.Key
 		ruleSpecs = append(ruleSpecs, spec)
+		log.Info("removing rule", "rule", r.Name, "key", r.Key, "vms", vmNames(r.VMs))
 	}
 
 	clusterSpec := &types.ClusterConfigSpecEx{RulesSpec: ruleSpecs}
 	cluster := object.NewClusterComputeResource(c.Client, *clusterRef)
 
+	existingGroups := make(map[string]bool)
+	if cfg != nil {
+		for _, g := range cfg.Group {
+			existingGroups[g.GetClusterGroupInfo().Name] = true
+		}
+	}
+
+	entries := i.auditEntries(user, state, rec)
+	// groups first, since VM/Host rules refer to them by name
+	if err = reconfigureGroups(ctx, cluster, addGroupSpecs(rec, existingGroups), log); err != nil {
+		return i.audit(log, entries, "", err)
+	}
 	task, err := cluster.Reconfigure(ctx, clusterSpec, true)
 	if err != nil {
-		return err
+		return i.audit(log, entries, "", err)
 	}
-	fmt.Print("waiting for cluster reconfig...")
+	taskID := task.Reference().Value
+	log.Info("waiting for cluster reconfig", "task", taskID)
 	err = task.Wait(ctx)
-	fmt.Println("completed")
-	return err
+	if err != nil {
+		log.Error("cluster reconfig failed", "task", taskID, "err", err)
+		return i.audit(log, entries, taskID, err)
+	}
+	log.Info("cluster reconfig completed", "task", taskID)
+	if err = i.audit(log, entries, taskID, nil); err != nil {
+		return err
+	}
+	// and the groups of removed VM/Host rules once nothing refers to them
+	if err = reconfigureGroups(ctx, cluster, removeGroupSpecs(rec, existingGroups), log); err != nil {
+		return fmt.Errorf("vsphere: the rules were changed, but removing their groups failed: %v", err)
+	}
+	if !i.ApplyRecommendations {
+		return nil
+	}
+	rules := append(append([]magnet.Rule(nil), rec.Valid...), rec.Missing...)
+	if err = i.applyRecommendations(ctx, c, *clusterRef, rules, log); err != nil {
+		return fmt.Errorf("vsphere: the rules were changed, but applying DRS recommendations failed: %v", err)
+	}
+	return nil
 }
 
 func boolPtr(b bool) *bool {
 	return &b
 }
 
+// vmNames returns a comma-separated list of the names of vms, suitable for logging.
+func vmNames(vms []*magnet.VM) string {
+	names := make([]string, 0, len(vms))
+	for _, vm := range vms {
+		if vm == nil {
+			continue
+		}
+		names = append(names, vm.Name)
+	}
+	return strings.Join(names, ",")
+}
+
 // State gets the current state of the deployment on vSphere.
 func (i *IaaS) State(ctx context.Context) (*magnet.State, error) {
-	c, err := govmomi.NewClient(ctx, i.URL, i.config.Insecure)
+	c, _, err := i.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
+	i.log.Info("connected to vCenter")
+	return i.state(ctx, c)
+}
+
+// Unverified reports whether the IaaS connects to the vCenter
+// without verifying its identity.
+func (i *IaaS) Unverified() bool {
+	return i.config.Unverified()
+}
+
+// connect logs in to the vCenter with the current credentials, and
+// returns the user it logged in as.
+func (i *IaaS) connect(ctx context.Context) (*govmomi.Client, string, error) {
+	creds, err := i.Credentials.Credentials(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	u := *i.URL
+	sc := soap.NewClient(&u, i.config.Insecure)
+	var v *verifier
+	if !i.config.Unverified() {
+		v = &verifier{host: i.config.Hostname, roots: i.roots, thumbprint: i.thumbprint}
+		sc.Client.Transport.(*http.Transport).TLSClientConfig = v.config()
+	}
+	vc, err := vim25.NewClient(ctx, sc)
+	if err != nil {
+		if v != nil && v.err != nil {
+			return nil, "", v.err
+		}
+		return nil, "", err
+	}
+	c := &govmomi.Client{Client: vc, SessionManager: session.NewManager(vc)}
+	if err = c.Login(ctx, url.UserPassword(creds.Username, string(creds.Password))); err != nil {
+		return nil, "", errors.New(magnet.Redact(err.Error(), creds.Password))
+	}
 	if !c.IsVC() {
-		return nil, fmt.Errorf("%s is not a vCenter", i.config.hostAndPort())
+		return nil, "", fmt.Errorf("%s is not a vCenter", i.config.hostAndPort())
 	}
-	fmt.Println("Connected to", i.config.hostAndPort())
-	return i.state(ctx, c)
+	return c, creds.Username, nil
 }
 
 func jobForVM(vm *mo.VirtualMachine) string {
+	return customValue(vm, "job")
+}
+
+// PolicyAttribute is the custom attribute of VMs that sets the policy
+// of their job, in the form parsed by magnet.ParseJobPolicy.
+const PolicyAttribute = "magnet-policy"
+
+// customValues returns the custom attributes of e, by name.
+func customValues(e *mo.ExtensibleManagedObject) map[string]string {
+	names := make(map[int32]string)
+	for _, field := range e.AvailableField {
+		names[field.Key] = field.Name
+	}
+	values := make(map[string]string)
+	for _, v := range e.Value {
+		cv, ok := v.(*types.CustomFieldStringValue)
+		if !ok {
+			continue
+		}
+		if name, ok := names[cv.Key]; ok {
+			values[name] = cv.Value
+		}
+	}
+	return values
+}
+
+// customValue returns the value of the named custom attribute of vm.
+func customValue(vm *mo.VirtualMachine, name string) string {
 	if vm == nil || len(vm.Value) == 0 {
 		return ""
 	}
 
 	fieldKey := int32(-1)
 	for _, field := range vm.AvailableField {
-		if field.Name == "job" {
+		if field.Name == name {
 			fieldKey = field.Key
 		}
 	}
@@ -154,6 +355,26 @@ func jobForVM(vm *mo.VirtualMachine) string {
 }
 
 func (i *IaaS) state(ctx context.Context, client *govmomi.Client) (*magnet.State, error) {
+	collector, err := collect(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	collector.filter(i.config.Cluster, i.config.ResourcePool)
+	return collector.toState(ctx, client, i.instances(ctx), i.log)
+}
+
+// instances returns the instances that i.Instances describes, by CID.
+func (i *IaaS) instances(ctx context.Context) map[string]magnet.Instance {
+	byCID, err := magnet.InstancesByCID(ctx, i.Instances)
+	if err != nil {
+		i.log.Warn("failed to list BOSH instances, using custom attributes", "err", err)
+	}
+	return byCID
+}
+
+// collect gathers every datacenter, cluster, host, resource pool
+// and VM in the vCenter.
+func collect(ctx context.Context, client *govmomi.Client) (*collector, error) {
 	f := find.NewFinder(client.Client, true)
 	collector := &collector{}
 	objects, err := f.DatacenterList(ctx, "*")
@@ -199,8 +420,7 @@ func (i *IaaS) state(ctx context.Context, client *govmomi.Client) (*magnet.State
 	}
 
 	collector.hydrate(ctx, client)
-	collector.filter(i.config.Cluster, i.config.ResourcePool)
-	return collector.toState(ctx, client)
+	return collector, nil
 }
 
 type collector struct {
@@ -222,42 +442,103 @@ type collector struct {
 	resourcepool *mo.ResourcePool
 }
 
-func (c *collector) toState(ctx context.Context, client *govmomi.Client) (*magnet.State, error) {
+func (c *collector) toState(ctx context.Context, client *govmomi.Client, instances map[string]magnet.Instance, log magnet.Logger) (*magnet.State, error) {
 	state := &magnet.State{}
 	state.RuleContainer = c.cluster.Reference().String()
 	state.VMContainer = c.resourcepool.Reference().String()
+	hostLookup := make(map[string]*magnet.Host)
 	for _, host := range c.hosts {
-		state.Hosts = append(state.Hosts, &magnet.Host{
-			ID:   host.Reference().String(),
-			Name: host.Name,
-		})
+		h := &magnet.Host{
+			ID:         host.Reference().String(),
+			Name:       host.Name,
+			Attributes: customValues(&host.ExtensibleManagedObject),
+		}
+		hostLookup[h.ID] = h
+		state.Hosts = append(state.Hosts, h)
 	}
 
+	// rules may include VMs that don't belong to a job, so
+	// look up every VM to find the hosts of the rules' members
 	vmLookup := make(map[string]*magnet.VM)
 	for i := range c.vms {
-		job := jobForVM(&c.vms[i])
-		if job == "" {
+		if c.vms[i].Config == nil {
+			// e.g. an inaccessible VM
 			continue
 		}
 		uuid := c.vmToHosts[c.vms[i].Reference().Value]
 		v := &magnet.VM{
-			ID:        c.vms[i].Config.Uuid,
-			Reference: c.vms[i].Self.Value,
-			Name:      c.vms[i].Name,
-			HostUUID:  uuid,
-			HostName:  c.hostnames[uuid],
-			Job:       job,
+			ID:         c.vms[i].Config.Uuid,
+			Reference:  c.vms[i].Self.Value,
+			Name:       c.vms[i].Name,
+			HostUUID:   uuid,
+			HostName:   c.hostnames[uuid],
+			Job:        jobForVM(&c.vms[i]),
+			Index:      customValue(&c.vms[i], "index"),
+			Deployment: customValue(&c.vms[i], "deployment"),
 		}
+		if in, ok := instances[v.Name]; ok {
+			if v.Job != "" && v.Job != in.Job {
+				log.Debug("VM's job attribute differs from its BOSH instance", "vm", v.Name, "attribute", v.Job, "job", in.Job)
+			}
+			v.Job, v.Index, v.Deployment, v.AZ = in.Job, in.Index, in.Deployment, in.AZ
+		}
+		job := v.Job
 		vmLookup[c.vms[i].Self.Value] = v
+		if job == "" {
+			continue
+		}
 		state.VMs = append(state.VMs, v)
+
+		if _, ok := state.Policies[job]; ok {
+			continue
+		}
+		if spec := customValue(&c.vms[i], PolicyAttribute); spec != "" {
+			policy, err := magnet.ParseJobPolicy(spec)
+			if err != nil {
+				log.Warn("ignoring invalid job policy", "vm", v.Name, "job", job, "err", err)
+				continue
+			}
+			if state.Policies == nil {
+				state.Policies = make(map[string]magnet.JobPolicy)
+			}
+			state.Policies[job] = policy
+		}
 	}
 
 	for _, cluster := range c.clusters {
+		groups := make(map[string]types.BaseClusterGroupInfo)
+		if cfg, ok := cluster.ConfigurationEx.(*types.ClusterConfigInfoEx); ok {
+			for _, g := range cfg.Group {
+				groups[g.GetClusterGroupInfo().Name] = g
+			}
+		}
+
 		for _, rule := range cluster.Configuration.Rule {
-			aa, ok := rule.(*types.ClusterAntiAffinityRuleSpec)
-			if !ok {
+			members := ruleVMs(rule)
+			_, affinity := rule.(*types.ClusterAffinityRuleSpec)
+			var hosts []*magnet.Host
+			switch r := rule.(type) {
+			case *types.ClusterAntiAffinityRuleSpec, *types.ClusterAffinityRuleSpec:
+			case *types.ClusterVmHostRuleInfo:
+				if r.AffineHostGroupName == "" {
+					// magnet doesn't make rules that keep VMs off hosts
+					continue
+				}
+				if g, ok := groups[r.VmGroupName]; ok {
+					members = groupMembers(g)
+				}
+				hosts = []*magnet.Host{}
+				if g, ok := groups[r.AffineHostGroupName]; ok {
+					for _, ref := range groupMembers(g) {
+						if h, ok := hostLookup[ref.String()]; ok {
+							hosts = append(hosts, h)
+						}
+					}
+				}
+			default:
 				continue
 			}
+			info := rule.GetClusterRuleInfo()
 
 			ptrToBool := func(b *bool) bool {
 				if b == nil {
@@ -266,15 +547,20 @@ func (c *collector) toState(ctx context.Context, client *govmomi.Client) (*magne
 				return *b
 			}
 			rule := &magnet.Rule{
-				Name:      aa.Name,
-				ID:        aa.RuleUuid,
-				Key:       aa.Key,
-				Enabled:   ptrToBool(aa.Enabled),
-				Mandatory: ptrToBool(aa.Mandatory),
+				Name:      info.Name,
+				ID:        info.RuleUuid,
+				Key:       info.Key,
+				Enabled:   ptrToBool(info.Enabled),
+				Mandatory: ptrToBool(info.Mandatory),
 				VMs:       []*magnet.VM{},
+				Affinity:  affinity,
+				Hosts:     hosts,
+
+				// vCenter omits compliance for rules it isn't enforcing
+				Violated: info.InCompliance != nil && !*info.InCompliance,
 			}
 
-			for _, vm := range aa.Vm {
+			for _, vm := range members {
 				rule.VMs = append(rule.VMs, vmLookup[vm.Value])
 			}
 
@@ -285,14 +571,18 @@ func (c *collector) toState(ctx context.Context, client *govmomi.Client) (*magne
 	return state, nil
 }
 
-func (c *collector) filter(cluster string, resourcepool string) {
-	for _, cl := range c.clusters {
-		if strings.EqualFold(cl.Name, cluster) {
-			c.cluster = &cl
-			break
+// findCluster returns the cluster with the specified name, or nil.
+func (c *collector) findCluster(name string) *mo.ClusterComputeResource {
+	for i := range c.clusters {
+		if strings.EqualFold(c.clusters[i].Name, name) {
+			return &c.clusters[i]
 		}
 	}
+	return nil
+}
 
+func (c *collector) filter(cluster string, resourcepool string) {
+	c.cluster = c.findCluster(cluster)
 	if c.cluster == nil {
 		// TODO: This is invalid; but may result from the renaming of a cluster
 		panic("Cannot find cluster")
@@ -365,13 +655,13 @@ var (
 	dcProps = []string{"name", "hostFolder", "vmFolder"}
 
 	// https://pubs.vmware.com/vsphere-60/index.jsp#com.vmware.wssdk.apiref.doc/vim.HostSystem.html
-	hostProps = []string{"name", "vm", "hardware"}
+	hostProps = []string{"name", "vm", "hardware", "value", "availableField"}
 
 	// https://pubs.vmware.com/vsphere-60/index.jsp#com.vmware.wssdk.apiref.doc/vim.VirtualMachine.html
 	vmProps = []string{"name", "value", "resourcePool", "availableField", "customValue", "config"}
 
 	// https://pubs.vmware.com/vsphere-60/index.jsp#com.vmware.wssdk.apiref.doc/vim.ClusterComputeResource.html
-	clusterProps = []string{"name", "host", "resourcePool", "configuration"}
+	clusterProps = []string{"name", "host", "resourcePool", "configuration", "configurationEx"}
 )
 
 func (c *collector) hydrate(ctx context.Context, client *govmomi.Client) {
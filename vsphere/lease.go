@@ -0,0 +1,184 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// DefaultLeaseAttribute is the custom attribute that holds the lease
+// when Lease.Attribute is empty.
+const DefaultLeaseAttribute = "magnet-leader"
+
+// Lease is a magnet.Elector that stores a leadership lease in a custom
+// attribute on the managed cluster, so that daemons on different hosts
+// can share a cluster.  The leader renews the lease every time it polls,
+// so TTL must be longer than the interval between polls.
+//
+// vCenter can't update a custom attribute conditionally, so Lease reads
+// the attribute back after writing it to detect daemons that took the
+// lease at the same time.  This narrows, but doesn't close, the window
+// in which two daemons could both believe they are the leader.
+type Lease struct {
+	IaaS *IaaS
+
+	// Holder identifies this daemon.  It defaults to the
+	// host name and process ID.
+	Holder string
+
+	TTL       time.Duration
+	Attribute string
+
+	// the cluster found by the last call to connect
+	cluster string
+	ref     types.ManagedObjectReference
+}
+
+// lease is the value of the lease attribute.
+type lease struct {
+	holder  string
+	expires time.Time
+}
+
+func parseLease(v string) lease {
+	parts := strings.SplitN(v, " ", 2)
+	if len(parts) != 2 {
+		return lease{}
+	}
+	expires, err := time.Parse(time.RFC3339, parts[1])
+	if err != nil {
+		return lease{}
+	}
+	return lease{holder: parts[0], expires: expires}
+}
+
+func (l lease) String() string {
+	return l.holder + " " + l.expires.UTC().Format(time.RFC3339)
+}
+
+func (l *Lease) holder() string {
+	if l.Holder != "" {
+		return l.Holder
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+func (l *Lease) attribute() string {
+	if l.Attribute == "" {
+		return DefaultLeaseAttribute
+	}
+	return l.Attribute
+}
+
+// Acquire takes the lease if it is free, has expired or is already
+// held by this daemon, and reports whether this daemon holds it.
+func (l *Lease) Acquire(ctx context.Context) (bool, error) {
+	c, m, ref, key, err := l.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+	current, err := l.read(ctx, c, ref, key)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	me := l.holder()
+	if current.holder != "" && current.holder != me && now.Before(current.expires) {
+		return false, nil
+	}
+
+	next := lease{holder: me, expires: now.Add(l.TTL)}
+	if err = m.Set(ctx, ref, key, next.String()); err != nil {
+		return false, err
+	}
+	// another daemon may have written the lease at the same time;
+	// whoever wrote last holds it
+	current, err = l.read(ctx, c, ref, key)
+	if err != nil {
+		return false, err
+	}
+	return current.holder == me, nil
+}
+
+// Release clears the lease if this daemon holds it.
+func (l *Lease) Release(ctx context.Context) error {
+	c, m, ref, key, err := l.connect(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := l.read(ctx, c, ref, key)
+	if err != nil {
+		return err
+	}
+	if current.holder != l.holder() {
+		return nil
+	}
+	return m.Set(ctx, ref, key, "")
+}
+
+// connect logs in to the vCenter and finds the cluster and the key of
+// the lease attribute, creating the attribute if it doesn't exist.
+func (l *Lease) connect(ctx context.Context) (*govmomi.Client, *object.CustomFieldsManager, types.ManagedObjectReference, int32, error) {
+	var ref types.ManagedObjectReference
+	c, _, err := l.IaaS.connect(ctx)
+	if err != nil {
+		return nil, nil, ref, 0, err
+	}
+	if l.cluster != l.IaaS.config.Cluster {
+		collector, err := collect(ctx, c)
+		if err != nil {
+			return nil, nil, ref, 0, err
+		}
+		cluster := collector.findCluster(l.IaaS.config.Cluster)
+		if cluster == nil {
+			return nil, nil, ref, 0, fmt.Errorf("vsphere: cannot find cluster %q", l.IaaS.config.Cluster)
+		}
+		l.cluster, l.ref = l.IaaS.config.Cluster, cluster.Reference()
+	}
+	ref = l.ref
+
+	m, err := object.GetCustomFieldsManager(c.Client)
+	if err != nil {
+		return nil, nil, ref, 0, err
+	}
+	key, err := m.FindKey(ctx, l.attribute())
+	if err == object.ErrKeyNameNotFound {
+		var def *types.CustomFieldDef
+		def, err = m.Add(ctx, l.attribute(), "ClusterComputeResource", nil, nil)
+		if err != nil {
+			// another daemon may have just created it
+			key, err = m.FindKey(ctx, l.attribute())
+		} else {
+			key = def.Key
+		}
+	}
+	if err != nil {
+		return nil, nil, ref, 0, err
+	}
+	return c, m, ref, key, nil
+}
+
+// read retrieves the current lease from the cluster.
+func (l *Lease) read(ctx context.Context, c *govmomi.Client, ref types.ManagedObjectReference, key int32) (lease, error) {
+	var mcluster mo.ClusterComputeResource
+	if err := c.RetrieveOne(ctx, ref, []string{"customValue"}, &mcluster); err != nil {
+		return lease{}, err
+	}
+	for _, v := range mcluster.CustomValue {
+		if v.GetCustomFieldValue().Key != key {
+			continue
+		}
+		if sv, ok := v.(*types.CustomFieldStringValue); ok {
+			return parseLease(sv.Value), nil
+		}
+	}
+	return lease{}, nil
+}
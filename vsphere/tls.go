@@ -0,0 +1,130 @@
+package vsphere
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// CertificateError is the error returned when the vCenter presents a
+// certificate that magnet doesn't trust.  It includes the thumbprints
+// of the certificate so that it can be checked and pinned.
+type CertificateError struct {
+	Host   string
+	SHA1   string // thumbprint of the presented certificate, as AB:CD:...
+	SHA256 string
+	Err    error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("vsphere: cannot verify the certificate of %s: %v.  "+
+		"It presented a certificate with SHA-256 thumbprint %s (SHA-1 %s).  "+
+		"If you trust it, pin either thumbprint with VSPHERE_THUMBPRINT, "+
+		"or set VSPHERE_CACERTS to the PEM bundle of the CA that signed it",
+		e.Host, e.Err, e.SHA256, e.SHA1)
+}
+
+// parseThumbprint decodes a SHA-1 or SHA-256 certificate thumbprint,
+// written in hex with or without colons, as govc and vCenter print them.
+func parseThumbprint(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || (len(b) != sha1.Size && len(b) != sha256.Size) {
+		return nil, fmt.Errorf("invalid thumbprint %q: must be a SHA-1 or SHA-256 hex digest", s)
+	}
+	return b, nil
+}
+
+// thumbprint returns the SHA-1 or SHA-256 thumbprint of cert.
+func thumbprint(cert *x509.Certificate, size int) []byte {
+	if size == sha1.Size {
+		sum := sha1.Sum(cert.Raw)
+		return sum[:]
+	}
+	sum := sha256.Sum256(cert.Raw)
+	return sum[:]
+}
+
+// formatThumbprint writes b as colon-separated hex bytes.
+func formatThumbprint(b []byte) string {
+	parts := make([]string, len(b))
+	for i := range b {
+		parts[i] = fmt.Sprintf("%02X", b[i])
+	}
+	return strings.Join(parts, ":")
+}
+
+// loadCACerts reads a PEM bundle of CA certificates.
+func loadCACerts(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s contains no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// verifier checks the certificate presented by the vCenter.  If a
+// thumbprint is pinned, the certificate must match it, and is only
+// verified against the CA bundle if one is set too; otherwise it is
+// verified against the CA bundle, or the system's CAs.
+type verifier struct {
+	host       string // without the port
+	roots      *x509.CertPool
+	thumbprint []byte
+
+	// err is why the last certificate was rejected
+	err *CertificateError
+}
+
+// config returns a TLS configuration that verifies certificates with v.
+// Go's own verification is disabled, so that v sees, and can describe,
+// every certificate it rejects.
+func (v *verifier) config() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: true, VerifyPeerCertificate: v.verify}
+}
+
+func (v *verifier) verify(raw [][]byte, _ [][]*x509.Certificate) error {
+	if len(raw) == 0 {
+		return errors.New("vsphere: the vCenter presented no certificate")
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i := range raw {
+		cert, err := x509.ParseCertificate(raw[i])
+		if err != nil {
+			return fmt.Errorf("vsphere: the vCenter presented an invalid certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+
+	var err error
+	if v.thumbprint != nil && !bytes.Equal(thumbprint(certs[0], len(v.thumbprint)), v.thumbprint) {
+		err = fmt.Errorf("it doesn't match the pinned thumbprint %s", formatThumbprint(v.thumbprint))
+	}
+	if err == nil && (v.thumbprint == nil || v.roots != nil) {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err = certs[0].Verify(x509.VerifyOptions{DNSName: v.host, Roots: v.roots, Intermediates: intermediates})
+	}
+	if err != nil {
+		v.err = &CertificateError{
+			Host:   v.host,
+			SHA1:   formatThumbprint(thumbprint(certs[0], sha1.Size)),
+			SHA256: formatThumbprint(thumbprint(certs[0], sha256.Size)),
+			Err:    err,
+		}
+		return v.err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package vsphere_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pivotalservices/magnet/vsphere"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS", func() {
+	var server *httptest.Server
+	var config vsphere.Config
+	BeforeEach(func() {
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		config = vsphere.Config{Hostname: u.Hostname(), Port: u.Port(), Username: "u", Password: "p", Cluster: "c"}
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	thumbprint := func() string {
+		sum := sha256.Sum256(server.Certificate().Raw)
+		parts := make([]string, len(sum))
+		for i := range sum {
+			parts[i] = fmt.Sprintf("%02x", sum[i])
+		}
+		return strings.Join(parts, ":")
+	}
+
+	connect := func() error {
+		v, err := vsphere.NewFromConfig(config, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = v.State(context.Background())
+		return err
+	}
+
+	It("reports the thumbprint of an untrusted certificate", func() {
+		err := connect()
+		Ω(err).Should(BeAssignableToTypeOf(&vsphere.CertificateError{}))
+		Ω(strings.ToLower(err.(*vsphere.CertificateError).SHA256)).Should(Equal(thumbprint()))
+		Ω(err.Error()).Should(ContainSubstring("VSPHERE_THUMBPRINT"))
+	})
+
+	It("trusts a certificate with the pinned thumbprint", func() {
+		config.Thumbprint = thumbprint()
+		err := connect()
+		Ω(err).Should(HaveOccurred())
+		Ω(err).ShouldNot(BeAssignableToTypeOf(&vsphere.CertificateError{}))
+	})
+
+	It("rejects a certificate with a different thumbprint", func() {
+		config.Thumbprint = strings.Repeat("00", 20)
+		err := connect()
+		Ω(err).Should(BeAssignableToTypeOf(&vsphere.CertificateError{}))
+		Ω(err.Error()).Should(ContainSubstring("pinned thumbprint"))
+	})
+
+	It("trusts a certificate signed by the CA bundle", func() {
+		f, err := ioutil.TempFile("", "cacerts")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(f.Name())
+		Ω(pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})).Should(Succeed())
+		f.Close()
+
+		config.CACerts = f.Name()
+		err = connect()
+		Ω(err).Should(HaveOccurred())
+		Ω(err).ShouldNot(BeAssignableToTypeOf(&vsphere.CertificateError{}))
+	})
+
+	It("rejects invalid settings", func() {
+		config.Insecure = true
+		config.Thumbprint = "not hex"
+		config.CACerts = "/does/not/exist"
+		Ω(config.Validate()).Should(HaveLen(3))
+	})
+})
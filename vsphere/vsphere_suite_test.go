@@ -0,0 +1,13 @@
+package vsphere_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestVsphere(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "vSphere Suite")
+}